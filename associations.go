@@ -0,0 +1,188 @@
+package aedstorm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/appengine/datastore"
+)
+
+// AssociationKindPrefix is the prefix of the entity kinds of the join
+// entities which link models with Associate(). The join kind of two models is
+// "_assoc_<len>_<Kind>_<Kind>", with the kinds in alphabetical order and the
+// length of the first one, so kinds with underscores don't share join kinds.
+const AssociationKindPrefix = "_assoc_"
+
+// association is the join entity stored for each link between two entities.
+// A holds the key which sorts first.
+type association struct {
+	A       *datastore.Key
+	B       *datastore.Key
+	Created time.Time
+}
+
+// associationKey returns the key of the join entity linking the entities with
+// keys a and b. It's the same regardless of the order of a and b, so each pair
+// of entities can only be linked once.
+func associationKey(ctx context.Context, a, b *datastore.Key) (*datastore.Key, *association) {
+	if a.Kind() > b.Kind() || (a.Kind() == b.Kind() && a.Encode() > b.Encode()) {
+		a, b = b, a
+	}
+	name := fmt.Sprintf("%x", sha256.Sum256([]byte(a.Encode()+"|"+b.Encode())))
+	return NewKey(ctx, associationKind(a.Kind(), b.Kind()), name, 0, nil), &association{A: a, B: b}
+}
+
+// associationKind returns the kind of the join entities between two kinds
+func associationKind(kindA, kindB string) string {
+	if kindA > kindB {
+		kindA, kindB = kindB, kindA
+	}
+	return fmt.Sprintf("%s%d_%s_%s", AssociationKindPrefix, len(kindA), kindA, kindB)
+}
+
+// modelKey returns the datastore key of model m, or ErrNoID if it has no ID.
+func modelKey(ctx context.Context, m Model) (*datastore.Key, error) {
+	dm := NewModel(m).WithContext(ctx)
+	if err := dm.verify(); err != nil {
+		return nil, err
+	}
+	if !dm.hasID() {
+		return nil, ErrNoID
+	}
+	return dm.Key(), nil
+}
+
+// Associate links the entities of models a and b, which can be of the same or
+// different kinds. Linking entities which are already linked does nothing.
+// The time the link was created at comes from the clock of the context, see
+// WithClock().
+func Associate(ctx context.Context, a, b Model) error {
+	keyA, err := modelKey(ctx, a)
+	if err != nil {
+		return err
+	}
+	keyB, err := modelKey(ctx, b)
+	if err != nil {
+		return err
+	}
+	key, assoc := associationKey(ctx, keyA, keyB)
+	assoc.Created = contextNow(ctx).UTC()
+	return runInTransaction(ctx, func(tc context.Context) error {
+		var existing association
+		err := driverGet(tc, key, &existing)
+		if err == nil {
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		_, err = driverPut(tc, key, assoc)
+		return err
+	}, nil)
+}
+
+// Dissociate removes the link between the entities of models a and b.
+// Removing a link which doesn't exist does nothing.
+func Dissociate(ctx context.Context, a, b Model) error {
+	keyA, err := modelKey(ctx, a)
+	if err != nil {
+		return err
+	}
+	keyB, err := modelKey(ctx, b)
+	if err != nil {
+		return err
+	}
+	key, _ := associationKey(ctx, keyA, keyB)
+	if err := driverDelete(ctx, key); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return nil
+}
+
+// Related loads the entities linked to model a into out, which must be a
+// pointer to a slice of structs or struct pointers of the kind to load. The
+// entities are loaded in a single batch, trying the cache first. Linked
+// entities which no longer exist or are soft deleted are left out.
+func Related(ctx context.Context, a Model, out interface{}) error {
+	sv := reflect.ValueOf(out)
+	if !isModelSlice(out) {
+		return fmt.Errorf("Related needs a pointer to a slice of structs, not %T", out)
+	}
+	sv = sv.Elem()
+	target := structType(sv.Type())
+	targetKind, err := getEntityName(reflect.New(target).Interface())
+	if err != nil {
+		return err
+	}
+	key, err := modelKey(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	// Links between entities of the same kind can have the key on either side
+	kind := associationKind(key.Kind(), targetKind)
+	sides := []string{"A", "B"}
+	if key.Kind() != targetKind {
+		sides = []string{"B"}
+		if key.Kind() < targetKind {
+			sides = []string{"A"}
+		}
+	}
+
+	found := make([][]association, len(sides))
+	var eg errgroup.Group
+	for i, side := range sides {
+		i, side := i, side
+		eg.Go(func() error {
+			_, lists, err := runAll(ctx, &driver.Query{Kind: kind, Filters: []driver.Filter{{Filter: side + " =", Value: key}}, Limit: -1})
+			if err != nil {
+				return err
+			}
+			found[i] = make([]association, len(lists))
+			for j, props := range lists {
+				if err := datastore.LoadStruct(&found[i][j], props); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	var keys []*datastore.Key
+	seen := make(map[string]bool)
+	for i, side := range sides {
+		for _, assoc := range found[i] {
+			other := assoc.B
+			if side == "B" {
+				other = assoc.A
+			}
+			if other.Kind() != targetKind || seen[other.Encode()] {
+				continue
+			}
+			seen[other.Encode()] = true
+			keys = append(keys, other)
+		}
+	}
+
+	loaded, err := getMulti(ctx, keys, target)
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return err
+	}
+	mismatch := err
+	for _, m := range loaded {
+		if !m.IsValid() || NewModel(m.Interface()).IsDeleted() {
+			continue
+		}
+		appendSliceElem(sv, m)
+	}
+	return mismatch
+}
@@ -0,0 +1,103 @@
+package aedstorm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type testTag struct {
+	ID   string
+	Name string
+}
+
+func (m *testTag) GetID() string {
+	return m.ID
+}
+
+func TestAssociationKind(t *testing.T) {
+	assert.Equal(t, "_assoc_4_Post_Tag", associationKind("Post", "Tag"))
+	assert.Equal(t, "_assoc_4_Post_Tag", associationKind("Tag", "Post"))
+	assert.Equal(t, "_assoc_4_User_User", associationKind("User", "User"))
+	assert.NotEqual(t, associationKind("a_b", "c"), associationKind("a", "b_c"))
+}
+
+func TestAssociateWithoutID(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	post, tag := &testPost{}, &testTag{ID: "go"}
+	assert.Equal(t, ErrNoID, Associate(mctx, post, tag))
+	assert.Equal(t, ErrNoID, Associate(mctx, tag, post))
+	assert.Equal(t, "", post.ID)
+}
+
+func TestAssociateClock(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	mctx := WithClock(NewMemoryContext(context.Background()), func() time.Time { return now })
+	post, tag := &testPost{ID: "post"}, &testTag{ID: "go"}
+	assert.NoError(t, Associate(mctx, post, tag))
+
+	key, _ := associationKey(mctx, NewModel(post).WithContext(mctx).Key(), NewModel(tag).WithContext(mctx).Key())
+	var assoc association
+	assert.NoError(t, driverGet(mctx, key, &assoc))
+	assert.True(t, now.Equal(assoc.Created))
+}
+
+func TestAssociationKey(t *testing.T) {
+	post := datastore.NewKey(ctx, "testPost", "post", 0, nil)
+	tag := datastore.NewKey(ctx, "testTag", "tag", 0, nil)
+
+	k1, a1 := associationKey(ctx, post, tag)
+	k2, a2 := associationKey(ctx, tag, post)
+	assert.True(t, k1.Equal(k2))
+	assert.Equal(t, "_assoc_8_testPost_testTag", k1.Kind())
+	assert.Len(t, k1.StringID(), 64)
+	assert.True(t, a1.A.Equal(post))
+	assert.True(t, a1.B.Equal(tag))
+	assert.Equal(t, a1, a2)
+
+	other := datastore.NewKey(ctx, "testTag", "other", 0, nil)
+	k3, _ := associationKey(ctx, post, other)
+	assert.False(t, k1.Equal(k3))
+
+	// Entities of the same kind are ordered by key
+	k4, a4 := associationKey(ctx, tag, other)
+	k5, a5 := associationKey(ctx, other, tag)
+	assert.True(t, k4.Equal(k5))
+	assert.Equal(t, a4, a5)
+}
+
+func TestRelatedInvalidOut(t *testing.T) {
+	assert.Error(t, Related(ctx, &testPost{ID: "post"}, []testTag{}))
+	assert.Error(t, Related(ctx, &testPost{ID: "post"}, &[]string{}))
+}
+
+func TestAssociate(t *testing.T) {
+	post := &testPost{ID: "assoc-post"}
+	tags := []*testTag{{ID: "assoc-go", Name: "go"}, {ID: "assoc-gae", Name: "gae"}}
+	for _, tag := range tags {
+		assert.NoError(t, NewModel(tag).WithContext(ctx).Save())
+		assert.NoError(t, Associate(ctx, post, tag))
+	}
+	// Linking twice doesn't create a duplicate
+	assert.NoError(t, Associate(ctx, tags[0], post))
+
+	var related []testTag
+	assert.NoError(t, Related(ctx, post, &related))
+	assert.Len(t, related, 2)
+
+	// The post itself was never saved, so it's left out
+	var posts []*testPost
+	assert.NoError(t, Related(ctx, tags[0], &posts))
+	assert.Len(t, posts, 0)
+
+	assert.NoError(t, Dissociate(ctx, post, tags[0]))
+	assert.NoError(t, Dissociate(ctx, post, tags[0]))
+	related = nil
+	assert.NoError(t, Related(ctx, post, &related))
+	if assert.Len(t, related, 1) {
+		assert.Equal(t, "gae", related[0].Name)
+	}
+}
@@ -0,0 +1,400 @@
+package aedstorm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	gocache "github.com/bradberger/gocache/cache"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// maxTransactionGroups is the maximum number of entity groups of a cross-group
+// transaction
+const maxTransactionGroups = 25
+
+// ErrSkip is returned by the function of UpdateAll() to leave an entity
+// unchanged, without it counting as a failure.
+var ErrSkip = errors.New("Entity skipped")
+
+// BulkResult is the outcome of DeleteAll() and UpdateAll(): the number of
+// entities which were processed, skipped with ErrSkip, and the ones which
+// failed.
+type BulkResult struct {
+	Processed int
+	Skipped   int
+	Failed    []BulkFailure
+}
+
+// BulkFailure is an entity which DeleteAll() or UpdateAll() couldn't process
+type BulkFailure struct {
+	Key *datastore.Key
+	Err error
+}
+
+// ErrPartialFailure is returned by DeleteAll() and UpdateAll() when some
+// entities failed. The failures are in the BulkResult.
+type ErrPartialFailure struct {
+	Processed int
+	Failed    int
+}
+
+func (e *ErrPartialFailure) Error() string {
+	return fmt.Sprintf("%d entities failed, %d were processed", e.Failed, e.Processed)
+}
+
+// WithHooks makes DeleteAll() and UpdateAll() run the OnSave, OnDelete,
+// OnCache and OnUncache callbacks of each entity, which means the entities
+// have to be loaded before they're deleted.
+func (q *Query) WithHooks() *Query {
+	q.hooks = true
+	return q
+}
+
+// DeleteAll deletes all entities matching the query. The keys are read with a
+// keys only query and deleted in batches of MaxBatchSize as they come in, and
+// the deleted entities are removed from the cache. Entities which need more
+// than a plain delete, because they're soft deleted, have unique fields or
+// relationships with cascade rules, are deleted one by one with Delete().
+//
+// A failed batch doesn't stop the others from being deleted. The entities
+// which failed are in the result, and an *ErrPartialFailure is returned.
+func (q *Query) DeleteAll(ctx context.Context) (BulkResult, error) {
+	var res BulkResult
+	perEntity, err := q.deletesPerEntity()
+	if err != nil {
+		return res, err
+	}
+	err = q.eachKeyBatch(ctx, func(keys []*datastore.Key) error {
+		if !perEntity && !q.hooks {
+			res.add(keys, getDriver(ctx).DeleteMulti(ctx, keys))
+			res.uncache(ctx, keys)
+			return ctx.Err()
+		}
+
+		models, err := getMulti(ctx, keys, q.typ)
+		if err != nil {
+			res.add(keys, err)
+			return ctx.Err()
+		}
+		var (
+			batchKeys   []*datastore.Key
+			batchModels []*DataModel
+		)
+		for i, m := range models {
+			if !m.IsValid() {
+				continue
+			}
+			dm := newModelWithKey(m.Interface(), keys[i]).WithContext(ctx)
+			if !q.hooks {
+				dm.withoutHooks()
+			}
+			if perEntity {
+				res.add(keys[i:i+1], dm.Delete())
+				continue
+			}
+			batchKeys, batchModels = append(batchKeys, keys[i]), append(batchModels, dm)
+		}
+		if len(batchKeys) == 0 {
+			return ctx.Err()
+		}
+
+		err = getDriver(ctx).DeleteMulti(ctx, batchKeys)
+		deleted := res.add(batchKeys, err)
+		var afterModels []*DataModel
+		for i, dm := range batchModels {
+			if deleted[i] {
+				afterModels = append(afterModels, dm)
+			}
+		}
+		res.after(afterModels, (*DataModel).afterBatchDelete)
+		return ctx.Err()
+	})
+	return res.result(err)
+}
+
+// UpdateAll loads all entities matching the query, calls fn with each of
+// them, and writes them back. fn gets a pointer to a new struct of the
+// query's model type. It can return ErrSkip to leave the entity unchanged,
+// which is counted in the result's Skipped, while any other error leaves it
+// unchanged as a failure. Updated entities get their timestamps, defaults and
+// schema version set like with Save(), and are removed from the cache.
+//
+// The entities are read from the datastore and written back in transactions
+// of up to maxTransactionGroups entity groups, so concurrent changes aren't
+// lost. Transactions which hit a concurrent change are retried, so fn can be
+// called more than once for an entity. Entities with unique fields are
+// updated one by one.
+//
+// The keys are streamed from a keys only query, so updating a property the
+// query filters or orders on can make entities show up again or be skipped.
+// Entities which fail don't stop the others from being updated; they're in
+// the result, and an *ErrPartialFailure is returned.
+func (q *Query) UpdateAll(ctx context.Context, fn func(m Model) error) (BulkResult, error) {
+	var res BulkResult
+	if q.typ == nil {
+		return res, ErrModelInvalid
+	}
+	unique := fieldsWithOption(q.typ, "unique")
+	err := q.eachKeyBatch(ctx, func(keys []*datastore.Key) error {
+		max := maxTransactionGroups
+		if len(unique) > 0 {
+			max = 1
+		}
+		for _, batch := range transactionBatches(keys, max) {
+			q.updateBatch(ctx, batch, unique, fn, &res)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return res.result(err)
+}
+
+// updateBatch updates the entities with the given keys in a single
+// transaction, and adds the outcome to res. Models with unique fields are
+// written along with their markers, so they have to be in a batch of their
+// own.
+func (q *Query) updateBatch(ctx context.Context, keys []*datastore.Key, unique [][]int, fn func(m Model) error, res *BulkResult) {
+	var (
+		errs   []error
+		models []*DataModel
+	)
+	err := runInTransaction(ctx, func(tc context.Context) error {
+		// Only the outcome of the last attempt counts
+		errs, models = make([]error, len(keys)), make([]*DataModel, len(keys))
+		loaded, err := loadMulti(tc, keys, q.typ, false)
+		if err != nil {
+			return err
+		}
+
+		var (
+			batchKeys  []*datastore.Key
+			batchLists []datastore.PropertyList
+		)
+		for i, m := range loaded {
+			if !m.IsValid() {
+				errs[i] = datastore.ErrNoSuchEntity
+				continue
+			}
+			dm := newModelWithKey(m.Interface(), keys[i]).WithContext(tc)
+			if !q.hooks {
+				dm.withoutHooks()
+			}
+			if errs[i] = fn(dm.model); errs[i] != nil {
+				continue
+			}
+			if len(unique) > 0 {
+				if errs[i] = dm.beforeSave(); errs[i] != nil {
+					continue
+				}
+				if err := dm.writeUnique(tc, unique); err != nil {
+					return err
+				}
+				models[i] = dm
+				continue
+			}
+			props, err := dm.bulkProperties()
+			if errs[i] = err; err != nil {
+				continue
+			}
+			batchKeys, batchLists, models[i] = append(batchKeys, keys[i]), append(batchLists, props), dm
+		}
+		if len(batchKeys) == 0 {
+			return nil
+		}
+		_, err = getDriver(tc).PutMulti(tc, batchKeys, batchLists)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		for _, k := range keys {
+			res.Failed = append(res.Failed, BulkFailure{k, err})
+		}
+		return
+	}
+
+	var (
+		savedKeys   []*datastore.Key
+		savedModels []*DataModel
+	)
+	for i, k := range keys {
+		switch errs[i] {
+		case nil:
+			res.Processed++
+			savedKeys, savedModels = append(savedKeys, k), append(savedModels, models[i].WithContext(ctx))
+		case ErrSkip:
+			res.Skipped++
+		case datastore.ErrNoSuchEntity:
+			// Deleted since the keys were read
+		default:
+			res.Failed = append(res.Failed, BulkFailure{k, errs[i]})
+		}
+	}
+	if q.hooks {
+		res.after(savedModels, (*DataModel).afterSave)
+	} else {
+		res.uncache(ctx, savedKeys)
+	}
+}
+
+// transactionBatches splits the keys into batches of consecutive keys, with
+// at most max entity groups each.
+func transactionBatches(keys []*datastore.Key, max int) [][]*datastore.Key {
+	var (
+		batches [][]*datastore.Key
+		start   int
+		groups  = make(map[string]bool)
+	)
+	for i, k := range keys {
+		root := k
+		for root.Parent() != nil {
+			root = root.Parent()
+		}
+		if !groups[root.Encode()] && len(groups) == max {
+			batches = append(batches, keys[start:i])
+			start, groups = i, make(map[string]bool)
+		}
+		groups[root.Encode()] = true
+	}
+	if start < len(keys) {
+		batches = append(batches, keys[start:])
+	}
+	return batches
+}
+
+// deletesPerEntity returns true if the entities of the query have to be
+// deleted one by one with Delete().
+func (q *Query) deletesPerEntity() (bool, error) {
+	if q.typ == nil {
+		return false, ErrModelInvalid
+	}
+	if q.deletedProperty != "" || len(fieldsWithOption(q.typ, "unique")) > 0 {
+		return true, nil
+	}
+	rules, err := NewModel(reflect.New(q.typ).Interface()).cascadeRules()
+	return len(rules) > 0, err
+}
+
+// bulkProperties prepares the model like Save() does, and returns the
+// properties to write.
+func (dm *DataModel) bulkProperties() (datastore.PropertyList, error) {
+	if err := dm.beforeSave(); err != nil {
+		return nil, err
+	}
+	m, err := encryptModel(dm.Context(), dm.model)
+	if err != nil {
+		return nil, err
+	}
+	return saveProperties(m)
+}
+
+// eachKeyBatch runs the query as a keys only query, and calls f with batches
+// of at most MaxBatchSize keys as they're read.
+func (q *Query) eachKeyBatch(ctx context.Context, f func(keys []*datastore.Key) error) error {
+	kq := *q
+	kq.keysOnly = true
+	var it driver.Iterator
+	if len(q.disjunctions) > 0 {
+		merged, err := kq.runMerged(ctx, true)
+		if err != nil {
+			return err
+		}
+		it = merged
+	} else {
+		spec, err := kq.query(ctx)
+		if err != nil {
+			return err
+		}
+		it = getDriver(ctx).Run(ctx, spec)
+	}
+
+	var batch []*datastore.Key
+	for {
+		key, err := it.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if batch = append(batch, key); len(batch) == MaxBatchSize {
+			if err := f(batch); err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		return f(batch)
+	}
+	return nil
+}
+
+// add counts the keys of a batch operation as processed or failed, depending
+// on err, and returns which ones succeeded.
+func (res *BulkResult) add(keys []*datastore.Key, err error) []bool {
+	ok := make([]bool, len(keys))
+	merr, _ := err.(appengine.MultiError)
+	for i, k := range keys {
+		switch {
+		case err == nil:
+		case merr != nil && i < len(merr) && merr[i] == nil:
+		case merr != nil && i < len(merr):
+			res.Failed = append(res.Failed, BulkFailure{k, merr[i]})
+			continue
+		default:
+			res.Failed = append(res.Failed, BulkFailure{k, err})
+			continue
+		}
+		ok[i] = true
+		res.Processed++
+	}
+	return ok
+}
+
+// uncache removes the entities with the given keys from the cache. Failures
+// are counted, even though the entities themselves were processed.
+func (res *BulkResult) uncache(ctx context.Context, keys []*datastore.Key) {
+	for _, k := range keys {
+		if err := cacheDel(ctx, cacheKeyForKey(k)); err != nil && err != gocache.ErrCacheMiss {
+			res.Failed = append(res.Failed, BulkFailure{k, err})
+		}
+	}
+}
+
+// after runs f concurrently for each model of a processed batch, and counts
+// its errors as failures.
+func (res *BulkResult) after(models []*DataModel, f func(dm *DataModel) error) {
+	errs := make([]error, len(models))
+	var wg sync.WaitGroup
+	for i, dm := range models {
+		wg.Add(1)
+		go func(i int, dm *DataModel) {
+			defer wg.Done()
+			if err := f(dm); err != nil && err != gocache.ErrCacheMiss {
+				errs[i] = err
+			}
+		}(i, dm)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			res.Failed = append(res.Failed, BulkFailure{models[i].Key(), err})
+		}
+	}
+}
+
+// result returns the result of a bulk operation, with an *ErrPartialFailure
+// if entities failed and the operation itself didn't.
+func (res BulkResult) result(err error) (BulkResult, error) {
+	if err == nil && len(res.Failed) > 0 {
+		err = &ErrPartialFailure{Processed: res.Processed, Failed: len(res.Failed)}
+	}
+	return res, err
+}
@@ -0,0 +1,276 @@
+package aedstorm
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gocache "github.com/bradberger/gocache/cache"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var bulkHookCalls int32
+
+type testBulkHookModel struct {
+	ID  string
+	Age int
+}
+
+func (m *testBulkHookModel) Save() error {
+	atomic.AddInt32(&bulkHookCalls, 1)
+	return nil
+}
+
+func (m *testBulkHookModel) Delete() error {
+	atomic.AddInt32(&bulkHookCalls, 1)
+	return nil
+}
+
+func TestDeleteAll(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	res, err := NewQuery(&testMemoryModel{}).Filter("Age =", 25).DeleteAll(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Processed)
+	assert.Empty(t, res.Failed)
+
+	var left []testMemoryModel
+	_, err = NewQuery(&testMemoryModel{}).Order("Name").GetAll(mctx, &left)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, memoryIDs(left))
+
+	// The cache is kept in sync
+	var cached testMemoryModel
+	assert.Equal(t, gocache.ErrCacheMiss, cacheGet(mctx, "model.testMemoryModel.b", &cached))
+	assert.NoError(t, cacheGet(mctx, "model.testMemoryModel.a", &cached))
+}
+
+func TestDeleteAllBatches(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	n := MaxBatchSize*2 + 1
+	for i := 0; i < n; i++ {
+		assert.NoError(t, NewModel(&testMemoryModel{ID: fmt.Sprintf("m%d", i)}).WithContext(mctx).Save())
+	}
+
+	res, err := NewQuery(&testMemoryModel{}).DeleteAll(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, n, res.Processed)
+	count, err := NewQuery(&testMemoryModel{}).Count(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestDeleteAllSoftDelete(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	for _, id := range []string{"a", "b"} {
+		assert.NoError(t, NewModel(&testSoftDeleteModel{ID: id}).WithContext(mctx).Save())
+	}
+
+	res, err := NewQuery(&testSoftDeleteModel{}).DeleteAll(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Processed)
+
+	count, err := NewQuery(&testSoftDeleteModel{}).Count(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	count, err = NewQuery(&testSoftDeleteModel{}).OnlyDeleted().Count(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestDeleteAllWithHooks(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	for _, id := range []string{"a", "b", "c"} {
+		assert.NoError(t, NewModel(&testBulkHookModel{ID: id}).WithContext(mctx).Save())
+	}
+
+	atomic.StoreInt32(&bulkHookCalls, 0)
+	_, err := NewQuery(&testBulkHookModel{}).DeleteAll(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&bulkHookCalls))
+
+	for _, id := range []string{"a", "b", "c"} {
+		assert.NoError(t, NewModel(&testBulkHookModel{ID: id}).WithContext(mctx).Save())
+	}
+	atomic.StoreInt32(&bulkHookCalls, 0)
+	res, err := NewQuery(&testBulkHookModel{}).WithHooks().DeleteAll(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Processed)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&bulkHookCalls))
+}
+
+func TestUpdateAll(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	res, err := NewQuery(&testMemoryModel{}).Filter("Age =", 25).UpdateAll(mctx, func(m Model) error {
+		m.(*testMemoryModel).Age++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Processed)
+
+	var updated []testMemoryModel
+	_, err = NewQuery(&testMemoryModel{}).Filter("Age =", 26).GetAll(mctx, &updated)
+	assert.NoError(t, err)
+	assert.Len(t, updated, 2)
+
+	// Loading gets the updated entity instead of the cached one
+	m := &testMemoryModel{ID: "b"}
+	assert.NoError(t, NewModel(m).WithContext(mctx).Load())
+	assert.Equal(t, 26, m.Age)
+}
+
+func TestUpdateAllPartialFailure(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	errSkip := errors.New("skip")
+	res, err := NewQuery(&testMemoryModel{}).UpdateAll(mctx, func(m Model) error {
+		if m.(*testMemoryModel).ID == "c" {
+			return errSkip
+		}
+		m.(*testMemoryModel).Name = "updated"
+		return nil
+	})
+	assert.Equal(t, &ErrPartialFailure{Processed: 3, Failed: 1}, err)
+	assert.Equal(t, 3, res.Processed)
+	assert.Len(t, res.Failed, 1)
+	assert.Equal(t, "c", res.Failed[0].Key.StringID())
+	assert.Equal(t, errSkip, res.Failed[0].Err)
+
+	m := &testMemoryModel{ID: "c"}
+	assert.NoError(t, NewModel(m).WithContext(mctx).Load())
+	assert.Equal(t, "carol", m.Name)
+}
+
+func TestUpdateAllWithHooks(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	for _, id := range []string{"a", "b"} {
+		assert.NoError(t, NewModel(&testBulkHookModel{ID: id}).WithContext(mctx).Save())
+	}
+
+	atomic.StoreInt32(&bulkHookCalls, 0)
+	res, err := NewQuery(&testBulkHookModel{}).WithHooks().UpdateAll(mctx, func(m Model) error {
+		m.(*testBulkHookModel).Age = 10
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Processed)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&bulkHookCalls))
+
+	// With hooks, the updated models are cached like Save() does
+	var cached testBulkHookModel
+	assert.NoError(t, cacheGet(mctx, "model.testBulkHookModel.a", &cached))
+	assert.Equal(t, 10, cached.Age)
+}
+
+func TestBulkContextDone(t *testing.T) {
+	mctx, cancel := context.WithCancel(newTestMemoryContext(t))
+	cancel()
+	_, err := NewQuery(&testMemoryModel{}).DeleteAll(mctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+type testBulkSoftHookModel struct {
+	ID        string
+	DeletedAt time.Time
+}
+
+func (m *testBulkSoftHookModel) Save() error {
+	atomic.AddInt32(&bulkHookCalls, 1)
+	return nil
+}
+
+func (m *testBulkSoftHookModel) Delete() error {
+	atomic.AddInt32(&bulkHookCalls, 1)
+	return nil
+}
+
+func TestDeleteAllPerEntityWithoutHooks(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	for _, id := range []string{"a", "b"} {
+		assert.NoError(t, NewModel(&testBulkSoftHookModel{ID: id}).WithContext(mctx).Save())
+	}
+
+	atomic.StoreInt32(&bulkHookCalls, 0)
+	res, err := NewQuery(&testBulkSoftHookModel{}).DeleteAll(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Processed)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&bulkHookCalls))
+}
+
+func TestUpdateAllSkip(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	res, err := NewQuery(&testMemoryModel{}).UpdateAll(mctx, func(m Model) error {
+		if m.(*testMemoryModel).Age == 25 {
+			return ErrSkip
+		}
+		m.(*testMemoryModel).Name = "updated"
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Processed)
+	assert.Equal(t, 2, res.Skipped)
+	assert.Empty(t, res.Failed)
+}
+
+func TestUpdateAllIgnoresCache(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	// A stale cached copy isn't what's updated
+	assert.NoError(t, cacheSet(mctx, "model.testMemoryModel.b", &testMemoryModel{ID: "b", Name: "stale", Age: 99}))
+	_, err := NewQuery(&testMemoryModel{}).Filter("Age =", 25).UpdateAll(mctx, func(m Model) error {
+		m.(*testMemoryModel).Age++
+		return nil
+	})
+	assert.NoError(t, err)
+
+	m := &testMemoryModel{ID: "b"}
+	assert.NoError(t, NewModel(m).WithContext(mctx).Load())
+	assert.Equal(t, "bob", m.Name)
+	assert.Equal(t, 26, m.Age)
+}
+
+func TestTransactionBatches(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	root := NewKey(mctx, "testMemoryModel", "root", 0, nil)
+	var keys []*datastore.Key
+	for i := 0; i < 5; i++ {
+		keys = append(keys, NewKey(mctx, "testMemoryModel", fmt.Sprint(i), 0, nil))
+		keys = append(keys, NewKey(mctx, "testMemoryModel", fmt.Sprint(i), 0, root))
+	}
+
+	batches := transactionBatches(keys, 3)
+	var sizes []int
+	for _, b := range batches {
+		sizes = append(sizes, len(b))
+	}
+	// The children of root are all in the entity group of root
+	assert.Equal(t, []int{4, 4, 2}, sizes)
+	assert.Len(t, transactionBatches(keys, 1), 10)
+	assert.Empty(t, transactionBatches(nil, 3))
+}
+
+func TestUpdateAllUnique(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	for _, id := range []string{"a", "b"} {
+		assert.NoError(t, NewModel(&testUniqueModel{ID: id, Email: id + "@example.com"}).WithContext(mctx).Save())
+	}
+
+	res, err := NewQuery(&testUniqueModel{}).UpdateAll(mctx, func(m Model) error {
+		m.(*testUniqueModel).Email = "same@example.com"
+		return nil
+	})
+	assert.IsType(t, &ErrPartialFailure{}, err)
+	assert.Equal(t, 1, res.Processed)
+	if assert.Len(t, res.Failed, 1) {
+		assert.IsType(t, &ErrUniqueViolation{}, res.Failed[0].Err)
+	}
+
+	// The old value of the updated entity is free again
+	assert.NoError(t, NewModel(&testUniqueModel{ID: "c", Email: "a@example.com"}).WithContext(mctx).Save())
+}
@@ -0,0 +1,65 @@
+package aedstorm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrCachedProjection is returned by GetAllCached for projection queries
+var ErrCachedProjection = errors.New("GetAllCached can't be used with projection queries")
+
+// GetAllCached runs the query as a keys only query, which is a lot cheaper
+// than loading the entities, and then loads the entities from the cache. Only
+// the entities which aren't cached are loaded from the datastore, with a
+// single batch get, and are cached for the next time. The results are in the
+// order of the query, and entities which were deleted in the meantime are
+// left out. out must be a pointer to a slice of structs or struct pointers.
+// Like with GetAll(), an *datastore.ErrFieldMismatch is returned after all
+// entities are loaded.
+func (q *Query) GetAllCached(ctx context.Context, out interface{}) ([]*datastore.Key, error) {
+
+	// For purposes of mocking, this allows the results to be set in advance
+	if res, err := q.mockedGetAll(ctx); res != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return res.getAll(out)
+	}
+
+	if !isModelSlice(out) {
+		return nil, fmt.Errorf("GetAllCached needs a pointer to a slice of structs, not %T", out)
+	}
+	if len(q.projection) > 0 {
+		return nil, ErrCachedProjection
+	}
+
+	kq := *q
+	kq.keysOnly = true
+	keys, err := kq.GetAll(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	sv := reflect.ValueOf(out).Elem()
+	loaded, err := getMulti(ctx, keys, structType(sv.Type()))
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return nil, err
+	}
+	mismatch := err
+	var found []*datastore.Key
+	for i, m := range loaded {
+		if !m.IsValid() {
+			continue
+		}
+		appendSliceElem(sv, m)
+		found = append(found, keys[i])
+	}
+	if err := q.preloadSlice(ctx, out); err != nil {
+		return found, err
+	}
+	return found, mismatch
+}
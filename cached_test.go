@@ -0,0 +1,79 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetAllCachedMock(t *testing.T) {
+	SetMockQueryResult([]testModel{{ID: "foo"}}, nil, nil)
+	var out []testModel
+	_, err := NewQuery(&testModel{}).GetAllCached(ctx, &out)
+	assert.NoError(t, err)
+	assert.Len(t, out, 1)
+}
+
+func TestGetAllCachedInvalid(t *testing.T) {
+	_, err := NewQuery(&testModel{}).GetAllCached(ctx, []testModel{})
+	assert.Error(t, err)
+
+	var out []testPartialModel
+	_, err = NewQuery(&testPartialModel{}).Project("Name").GetAllCached(ctx, &out)
+	assert.Equal(t, ErrCachedProjection, err)
+}
+
+func TestGetAllCached(t *testing.T) {
+	names := []string{"cached-a", "cached-b", "cached-c"}
+	for _, name := range names {
+		assert.NoError(t, NewModel(&testAuthor{ID: name, Name: name}).WithContext(ctx).Save())
+	}
+	// One of them is only in the datastore
+	NewModel(&testAuthor{ID: "cached-b"}).WithContext(ctx).Uncache()
+
+	var out []*testAuthor
+	keys, err := NewQuery(&testAuthor{}).Where(In("Name", "cached-a", "cached-b", "cached-c")).Order("-Name").GetAllCached(ctx, &out)
+	assert.NoError(t, err)
+	if assert.Len(t, out, 3) && assert.Len(t, keys, 3) {
+		for i, name := range []string{"cached-c", "cached-b", "cached-a"} {
+			assert.Equal(t, name, out[i].Name)
+			assert.Equal(t, name, keys[i].StringID())
+		}
+	}
+}
+
+// testGetMultiDriver records the number of keys of each GetMulti call
+type testGetMultiDriver struct {
+	driver.Driver
+	calls *[]int
+}
+
+func (d testGetMultiDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst []datastore.PropertyList) error {
+	*d.calls = append(*d.calls, len(keys))
+	return d.Driver.GetMulti(ctx, keys, dst)
+}
+
+func TestGetMultiBatches(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	keys := make([]*datastore.Key, maxGetMulti+10)
+	for i := range keys {
+		m := &testMemoryModel{ID: fmt.Sprintf("m%04d", i)}
+		assert.NoError(t, NewModel(m).WithContext(mctx).Save())
+		keys[i] = NewModel(m).WithContext(mctx).Key()
+	}
+	mctx = WithCache(mctx, NoCache)
+	var calls []int
+	mctx = withDriver(mctx, testGetMultiDriver{getDriver(mctx), &calls})
+
+	models, err := getMulti(mctx, keys, reflect.TypeOf(testMemoryModel{}))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{maxGetMulti, 10}, calls)
+	for i, m := range models {
+		assert.Equal(t, keys[i].StringID(), m.Interface().(*testMemoryModel).ID)
+	}
+}
@@ -0,0 +1,270 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+
+	gocache "github.com/bradberger/gocache/cache"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/appengine/datastore"
+)
+
+// Cascade rules, which set what happens to the children of a has-many
+// relationship when the model is deleted. They're set with the cascade
+// option, like `aedstorm:"has_many=ProjectKey,cascade=delete"`. When the model
+// is only soft deleted, the children which support soft delete are soft
+// deleted along with it, and nothing else happens to the children.
+const (
+	// CascadeDelete deletes the children along with the model
+	CascadeDelete = "delete"
+	// CascadeNullify clears the property of the children which refers to the model
+	CascadeNullify = "nullify"
+	// CascadeRestrict stops the model from being deleted while it has children
+	CascadeRestrict = "restrict"
+)
+
+// ErrRestricted is returned by Delete() when the model still has children in
+// a relationship with the restrict cascade rule.
+type ErrRestricted struct {
+	Kind  string
+	Field string
+}
+
+func (e *ErrRestricted) Error() string {
+	return fmt.Sprintf("Cannot delete %s entity while it has %s", e.Kind, e.Field)
+}
+
+type cascadeRule struct {
+	field reflect.StructField
+	prop  string
+	rule  string
+}
+
+// cascadeRules returns the cascade rules of the model's relationships.
+func (dm *DataModel) cascadeRules() ([]cascadeRule, error) {
+	t := reflect.TypeOf(dm.model).Elem()
+	var rules []cascadeRule
+	for _, idx := range fieldsWithOption(t, "cascade") {
+		field := t.FieldByIndex(idx)
+		opts := parseTagOptions(field)
+		prop, ok := opts.Value("has_many")
+		if !ok {
+			return nil, fmt.Errorf("Field %s of type %s has a cascade rule but no has_many relationship", field.Name, t.Name())
+		}
+		rule, _ := opts.Value("cascade")
+		switch rule {
+		case CascadeDelete, CascadeNullify, CascadeRestrict:
+		default:
+			return nil, fmt.Errorf("Unknown cascade rule %q on field %s of type %s", rule, field.Name, t.Name())
+		}
+		rules = append(rules, cascadeRule{field, prop, rule})
+	}
+	return rules, nil
+}
+
+// restrict returns an *ErrRestricted if the model still has children in a
+// relationship with the restrict cascade rule. Soft deleted children only
+// count if hard is true.
+func (dm *DataModel) restrict(hard bool) error {
+	rules, err := dm.cascadeRules()
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	if err := dm.verify(); err != nil {
+		return err
+	}
+	for _, r := range rules {
+		if r.rule != CascadeRestrict {
+			continue
+		}
+		q, err := hasManyQuery(dm.Context(), reflect.ValueOf(dm.model), r.field, r.prop)
+		if err != nil {
+			return err
+		}
+		if hard {
+			q.WithDeleted()
+		}
+		keys, err := q.KeysOnly().Limit(1).GetAll(dm.Context(), nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			return &ErrRestricted{Kind: dm.getEntityName(), Field: r.field.Name}
+		}
+	}
+	return nil
+}
+
+// cascade applies the delete and nullify cascade rules of the model, which
+// has already been deleted. If soft is true the model was only soft deleted,
+// so only the children which support soft delete are soft deleted too, and
+// the others are left alone. Otherwise children are deleted with their own
+// Delete() semantics, or hard deleted if hard is true.
+func (dm *DataModel) cascade(hard, soft bool) error {
+	rules, err := dm.cascadeRules()
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		switch {
+		case r.rule == CascadeDelete && soft:
+			err = dm.cascadeSoftDelete(r)
+		case r.rule == CascadeDelete:
+			err = dm.cascadeDelete(r, hard)
+		case r.rule == CascadeNullify && !soft:
+			err = dm.cascadeNullify(r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// children loads the children of a cascade rule.
+func (dm *DataModel) children(r cascadeRule, withDeleted bool) ([]*datastore.Key, reflect.Value, error) {
+	q, err := hasManyQuery(dm.Context(), reflect.ValueOf(dm.model), r.field, r.prop)
+	if err != nil {
+		return nil, reflect.Value{}, err
+	}
+	if withDeleted {
+		q.WithDeleted()
+	}
+	children := reflect.New(reflect.SliceOf(reflect.PtrTo(structType(r.field.Type))))
+	keys, err := q.GetAll(dm.Context(), children.Interface())
+	return keys, children.Elem(), err
+}
+
+// cascadeSoftDelete soft deletes the children of a cascade rule, if they
+// support soft delete.
+func (dm *DataModel) cascadeSoftDelete(r cascadeRule) error {
+	if !NewModel(reflect.New(structType(r.field.Type)).Interface()).IsSoftDeletable() {
+		return nil
+	}
+	keys, children, err := dm.children(r, false)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < children.Len(); i++ {
+		if err := dm.child(children.Index(i).Interface(), keys[i]).Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cascadeDelete deletes the children of a cascade rule in batches. Children
+// which need more than a plain delete, because they have unique fields or are
+// soft deleted, are deleted one by one. The restrict rules of all children of
+// a batch are checked before it's deleted, and their own cascade rules are
+// applied afterwards.
+func (dm *DataModel) cascadeDelete(r cascadeRule, hard bool) error {
+	keys, children, err := dm.children(r, hard)
+	if err != nil {
+		return err
+	}
+
+	ctx, parent := dm.Context(), dm.Key()
+	for start := 0; start < len(keys); start += MaxBatchSize {
+		end := start + MaxBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		var (
+			batchKeys   []*datastore.Key
+			batchModels []*DataModel
+		)
+		for i := start; i < end; i++ {
+			child := dm.child(children.Index(i).Interface(), keys[i])
+			if len(fieldsWithOption(children.Index(i).Type().Elem(), "unique")) > 0 || (!hard && child.IsSoftDeletable()) {
+				if err := child.delete(hard); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := child.restrict(hard); err != nil {
+				return err
+			}
+			batchKeys, batchModels = append(batchKeys, keys[i]), append(batchModels, child)
+		}
+
+		if err := deleteMulti(ctx, parent, batchKeys); err != nil {
+			return err
+		}
+		var eg errgroup.Group
+		for _, child := range batchModels {
+			eg.Go(child.afterBatchDelete)
+		}
+		if err := eg.Wait(); err != nil {
+			return err
+		}
+		for _, child := range batchModels {
+			if err := child.cascade(hard, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteMulti deletes the keys, in a transaction if they're all in the
+// entity group of parent.
+func deleteMulti(ctx context.Context, parent *datastore.Key, keys []*datastore.Key) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	for _, k := range keys {
+		if !hasAncestor(k, parent) {
+			return getDriver(ctx).DeleteMulti(ctx, keys)
+		}
+	}
+	return runInTransaction(ctx, func(tc context.Context) error {
+		return getDriver(tc).DeleteMulti(tc, keys)
+	}, nil)
+}
+
+// hasAncestor returns true if ancestor is one of the parents of k.
+func hasAncestor(k, ancestor *datastore.Key) bool {
+	for p := k.Parent(); p != nil; p = p.Parent() {
+		if p.Equal(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// afterBatchDelete removes a model deleted as part of a batch from the cache,
+// and runs its OnDelete callback.
+func (dm *DataModel) afterBatchDelete() error {
+	if err := dm.Uncache(); err != nil && err != gocache.ErrCacheMiss {
+		return err
+	}
+	if obj, ok := dm.model.(OnDelete); ok && !dm.noHooks {
+		return obj.Delete()
+	}
+	return nil
+}
+
+// cascadeNullify clears the property of each child of a cascade rule which
+// refers to the model.
+func (dm *DataModel) cascadeNullify(r cascadeRule) error {
+	keys, children, err := dm.children(r, true)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < children.Len(); i++ {
+		child := children.Index(i).Elem()
+		for j := 0; j < child.NumField(); j++ {
+			if propertyName(child.Type(), []int{j}) == r.prop {
+				child.Field(j).Set(reflect.Zero(child.Field(j).Type()))
+			}
+		}
+		if err := dm.child(children.Index(i).Interface(), keys[i]).Save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package aedstorm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type testTask struct {
+	ID      string
+	Project string
+}
+
+type testProject struct {
+	ID    string
+	Tasks []*testTask `datastore:"-" aedstorm:"has_many=Project,cascade=delete"`
+}
+
+type testNote struct {
+	ID      string
+	Project string
+}
+
+type testRestrictedProject struct {
+	ID    string
+	Notes []*testNote `datastore:"-" aedstorm:"has_many=Project,cascade=restrict"`
+}
+
+type testNullifiedProject struct {
+	ID    string
+	Notes []*testNote `datastore:"-" aedstorm:"has_many=Project,cascade=nullify"`
+}
+
+type testBadCascadeProject struct {
+	ID    string
+	Notes []*testNote `datastore:"-" aedstorm:"has_many=Project,cascade=explode"`
+}
+
+type testCascadeWithoutRelation struct {
+	ID    string
+	Notes []*testNote `datastore:"-" aedstorm:"cascade=delete"`
+}
+
+func TestCascadeRules(t *testing.T) {
+	rules, err := NewModel(&testProject{}).cascadeRules()
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, CascadeDelete, rules[0].rule)
+		assert.Equal(t, "Project", rules[0].prop)
+	}
+
+	rules, err = NewModel(&testModel{}).cascadeRules()
+	assert.NoError(t, err)
+	assert.Empty(t, rules)
+}
+
+func TestCascadeRulesInvalid(t *testing.T) {
+	_, err := NewModel(&testBadCascadeProject{}).cascadeRules()
+	assert.EqualError(t, err, `Unknown cascade rule "explode" on field Notes of type testBadCascadeProject`)
+	_, err = NewModel(&testCascadeWithoutRelation{}).cascadeRules()
+	assert.EqualError(t, err, "Field Notes of type testCascadeWithoutRelation has a cascade rule but no has_many relationship")
+}
+
+func TestHasAncestor(t *testing.T) {
+	c := context.Background()
+	root := datastore.NewKey(c, "Project", "p", 0, nil)
+	child := datastore.NewKey(c, "Task", "t", 0, root)
+	grandchild := datastore.NewKey(c, "Note", "n", 0, child)
+	assert.True(t, hasAncestor(child, root))
+	assert.True(t, hasAncestor(grandchild, root))
+	assert.False(t, hasAncestor(root, root))
+	assert.False(t, hasAncestor(datastore.NewKey(c, "Task", "t", 0, nil), root))
+}
+
+func TestErrRestricted(t *testing.T) {
+	err := &ErrRestricted{Kind: "Project", Field: "Notes"}
+	assert.EqualError(t, err, "Cannot delete Project entity while it has Notes")
+}
+
+func TestCascadeDelete(t *testing.T) {
+	p := &testProject{}
+	dm := NewModel(p).WithContext(ctx)
+	assert.NoError(t, dm.Save())
+	task := &testTask{Project: dm.ID()}
+	assert.NoError(t, NewModel(task).WithContext(ctx).Save())
+
+	assert.NoError(t, dm.Delete())
+	var tasks []testTask
+	_, err := NewQuery(&testTask{}).Filter("Project =", p.ID).GetAll(ctx, &tasks)
+	assert.NoError(t, err)
+	assert.Empty(t, tasks)
+}
+
+func TestCascadeRestrict(t *testing.T) {
+	p := &testRestrictedProject{}
+	dm := NewModel(p).WithContext(ctx)
+	assert.NoError(t, dm.Save())
+	assert.NoError(t, NewModel(&testNote{Project: dm.ID()}).WithContext(ctx).Save())
+	assert.IsType(t, &ErrRestricted{}, dm.Delete())
+}
+
+func TestCascadeNullify(t *testing.T) {
+	p := &testNullifiedProject{}
+	dm := NewModel(p).WithContext(ctx)
+	assert.NoError(t, dm.Save())
+	note := &testNote{Project: dm.ID()}
+	assert.NoError(t, NewModel(note).WithContext(ctx).Save())
+	assert.NoError(t, dm.Delete())
+
+	var notes []testNote
+	_, err := NewQuery(&testNote{}).Filter("Project =", p.ID).GetAll(ctx, &notes)
+	assert.NoError(t, err)
+	assert.Empty(t, notes)
+}
+
+type testSoftTask struct {
+	ID        string
+	Project   string
+	DeletedAt time.Time
+}
+
+type testSoftProject struct {
+	ID        string
+	DeletedAt time.Time
+	Tasks     []*testTask     `datastore:"-" aedstorm:"has_many=Project,cascade=delete"`
+	SoftTasks []*testSoftTask `datastore:"-" aedstorm:"has_many=Project,cascade=delete"`
+	Notes     []*testNote     `datastore:"-" aedstorm:"has_many=Project,cascade=nullify"`
+}
+
+func TestCascadeSoftDelete(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	dm := NewModel(&testSoftProject{ID: "p"}).WithContext(mctx)
+	assert.NoError(t, dm.Save())
+	assert.NoError(t, NewModel(&testTask{ID: "t", Project: "p"}).WithContext(mctx).Save())
+	assert.NoError(t, NewModel(&testSoftTask{ID: "s", Project: "p"}).WithContext(mctx).Save())
+	assert.NoError(t, NewModel(&testNote{ID: "n", Project: "p"}).WithContext(mctx).Save())
+
+	assert.NoError(t, dm.Delete())
+
+	// Children which can't be soft deleted are left alone
+	assert.NoError(t, NewModel(&testTask{ID: "t"}).WithContext(mctx).Load())
+	note := &testNote{ID: "n"}
+	assert.NoError(t, NewModel(note).WithContext(mctx).Load())
+	assert.Equal(t, "p", note.Project)
+
+	soft := &testSoftTask{ID: "s"}
+	assert.Equal(t, datastore.ErrNoSuchEntity, NewModel(soft).WithContext(mctx).Load())
+	assert.NoError(t, NewModel(soft).WithContext(mctx).WithDeleted().Load())
+	assert.True(t, NewModel(soft).IsDeleted())
+
+	assert.NoError(t, dm.HardDelete())
+	assert.Equal(t, datastore.ErrNoSuchEntity, NewModel(&testTask{ID: "t"}).WithContext(mctx).Load())
+	assert.Equal(t, datastore.ErrNoSuchEntity, NewModel(&testSoftTask{ID: "s"}).WithContext(mctx).WithDeleted().Load())
+}
+
+func TestCascadeChildrenUnderAncestor(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	root := NewKey(mctx, "Account", "a", 0, nil)
+
+	dm := NewModel(&testProject{ID: "p"}).WithContext(mctx)
+	assert.NoError(t, dm.Save())
+	taskKey := NewKey(mctx, "testTask", "t", 0, root)
+	assert.NoError(t, newModelWithKey(&testTask{ID: "t", Project: "p"}, taskKey).WithContext(mctx).Save())
+
+	nm := NewModel(&testNullifiedProject{ID: "n"}).WithContext(mctx)
+	assert.NoError(t, nm.Save())
+	noteKey := NewKey(mctx, "testNote", "n", 0, root)
+	assert.NoError(t, newModelWithKey(&testNote{ID: "n", Project: "n"}, noteKey).WithContext(mctx).Save())
+
+	assert.NoError(t, dm.Delete())
+	assert.NoError(t, nm.Delete())
+
+	// The children are changed at their own keys, and no entities are written
+	// at the keys their ID fields would have as root entities
+	assert.Equal(t, datastore.ErrNoSuchEntity, newModelWithKey(&testTask{}, taskKey).WithContext(mctx).Load())
+	note := &testNote{}
+	assert.NoError(t, newModelWithKey(note, noteKey).WithContext(mctx).Load())
+	assert.Empty(t, note.Project)
+	var props datastore.PropertyList
+	assert.Equal(t, datastore.ErrNoSuchEntity, driverGet(mctx, NewKey(mctx, "testNote", "n", 0, nil), &props))
+}
@@ -0,0 +1,459 @@
+// Package clouddatastore is an aedstorm driver for Cloud Datastore, which runs
+// outside of App Engine, like on Cloud Run or GKE, and with the local
+// emulator when DATASTORE_EMULATOR_HOST is set:
+//
+//	client, err := datastore.NewClient(ctx, "my-project")
+//	ctx = clouddatastore.NewContext(ctx, client, "my-project")
+//	err = aedstorm.NewModel(&user).WithContext(ctx).Save()
+//
+// Models, keys and queries are the same as with App Engine, with keys created
+// by aedstorm.NewKey() instead of datastore.NewKey().
+//
+// Unlike the aedstorm package, this package depends on the Cloud Datastore
+// client, cloud.google.com/go/datastore, and on google.golang.org/api, which
+// programs importing it need to have, like with:
+//
+//	go get cloud.google.com/go/datastore
+package clouddatastore
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	aedstorm "github.com/bradberger/go-aedstorm"
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	"google.golang.org/api/iterator"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	aedatastore "google.golang.org/appengine/datastore"
+)
+
+// ErrNestedTransaction is returned when a transaction is started in another one
+var ErrNestedTransaction = errors.New("Nested transactions are not supported")
+
+type txContextKey struct{}
+
+// cloudDriver is the aedstorm driver of a Cloud Datastore client. The
+// project ID is the app ID of its keys.
+type cloudDriver struct {
+	client    *datastore.Client
+	projectID string
+}
+
+// NewContext returns a context whose models and queries use the client. The
+// project ID is the app ID of the keys created with aedstorm.NewKey(). Models
+// aren't cached, since there's no memcache outside of App Engine; use
+// aedstorm.WithCache() to cache them elsewhere.
+func NewContext(ctx context.Context, client *datastore.Client, projectID string) context.Context {
+	return aedstorm.WithCache(driver.NewContext(ctx, &cloudDriver{client, projectID}), aedstorm.NoCache)
+}
+
+func (d *cloudDriver) NewKey(ctx context.Context, kind, stringID string, intID int64, parent *aedatastore.Key) *aedatastore.Key {
+	return driver.MakeKey(d.projectID, aedstorm.NamespaceFromContext(ctx), kind, stringID, intID, parent)
+}
+
+func (d *cloudDriver) AllocateID(ctx context.Context, kind string, parent *aedatastore.Key) (int64, error) {
+	k := datastore.IncompleteKey(kind, toCloudKey(parent))
+	k.Namespace = aedstorm.NamespaceFromContext(ctx)
+	if parent != nil {
+		k.Namespace = parent.Namespace()
+	}
+	keys, err := d.client.AllocateIDs(ctx, []*datastore.Key{k})
+	if err != nil {
+		return 0, err
+	}
+	return keys[0].ID, nil
+}
+
+func (d *cloudDriver) GetMulti(ctx context.Context, keys []*aedatastore.Key, dst []aedatastore.PropertyList) error {
+	if len(keys) != len(dst) {
+		return errors.New("Keys and destinations must have the same length")
+	}
+	lists := make([]datastore.PropertyList, len(keys))
+	var err error
+	if tx := transaction(ctx); tx != nil {
+		err = tx.GetMulti(toCloudKeys(keys), lists)
+	} else {
+		err = d.client.GetMulti(ctx, toCloudKeys(keys), lists)
+	}
+	merr, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return convertError(err)
+	}
+
+	var (
+		errs   = make(appengine.MultiError, len(keys))
+		failed bool
+	)
+	for i := range keys {
+		if isMulti && merr[i] != nil {
+			errs[i], failed = convertError(merr[i]), true
+			continue
+		}
+		if dst[i], errs[i] = d.fromCloudProperties(lists[i]); errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (d *cloudDriver) PutMulti(ctx context.Context, keys []*aedatastore.Key, src []aedatastore.PropertyList) ([]*aedatastore.Key, error) {
+	if len(keys) != len(src) {
+		return nil, errors.New("Keys and sources must have the same length")
+	}
+	lists := make([]datastore.PropertyList, len(src))
+	for i := range src {
+		var err error
+		if lists[i], err = toCloudProperties(src[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	tx := transaction(ctx)
+	if tx == nil {
+		out, err := d.client.PutMulti(ctx, toCloudKeys(keys), lists)
+		if err != nil {
+			return nil, convertError(err)
+		}
+		return d.fromCloudKeys(out), nil
+	}
+
+	// Keys of a transaction are only complete once it commits, so incomplete
+	// keys are allocated first.
+	ckeys := toCloudKeys(keys)
+	var incomplete []*datastore.Key
+	for _, k := range ckeys {
+		if k.Incomplete() {
+			incomplete = append(incomplete, k)
+		}
+	}
+	if len(incomplete) > 0 {
+		allocated, err := d.client.AllocateIDs(ctx, incomplete)
+		if err != nil {
+			return nil, convertError(err)
+		}
+		for i, k := range ckeys {
+			if k.Incomplete() {
+				ckeys[i], allocated = allocated[0], allocated[1:]
+			}
+		}
+	}
+	if _, err := tx.PutMulti(ckeys, lists); err != nil {
+		return nil, convertError(err)
+	}
+	return d.fromCloudKeys(ckeys), nil
+}
+
+func (d *cloudDriver) DeleteMulti(ctx context.Context, keys []*aedatastore.Key) error {
+	if tx := transaction(ctx); tx != nil {
+		return convertError(tx.DeleteMulti(toCloudKeys(keys)))
+	}
+	return convertError(d.client.DeleteMulti(ctx, toCloudKeys(keys)))
+}
+
+// RunInTransaction runs f in a transaction of the client. The Attempts and
+// ReadOnly options are supported; all transactions of Cloud Datastore are
+// cross-group.
+func (d *cloudDriver) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *aedatastore.TransactionOptions) error {
+	if transaction(ctx) != nil {
+		return ErrNestedTransaction
+	}
+	var txOpts []datastore.TransactionOption
+	if opts != nil {
+		if opts.Attempts > 0 {
+			txOpts = append(txOpts, datastore.MaxAttempts(opts.Attempts))
+		}
+		if opts.ReadOnly {
+			txOpts = append(txOpts, datastore.ReadOnly)
+		}
+	}
+	_, err := d.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(context.WithValue(ctx, txContextKey{}, tx))
+	}, txOpts...)
+	if err == datastore.ErrConcurrentTransaction {
+		return aedatastore.ErrConcurrentTransaction
+	}
+	return err
+}
+
+func (d *cloudDriver) Run(ctx context.Context, q *driver.Query) driver.Iterator {
+	cq, err := d.query(ctx, q)
+	if err != nil {
+		return &driverIterator{err: err}
+	}
+	return &driverIterator{driver: d, it: d.client.Run(ctx, cq), keysOnly: q.KeysOnly}
+}
+
+func (d *cloudDriver) Count(ctx context.Context, q *driver.Query) (int, error) {
+	cq, err := d.query(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	return d.client.Count(ctx, cq)
+}
+
+// query returns the Cloud Datastore query of the driver query
+func (d *cloudDriver) query(ctx context.Context, q *driver.Query) (*datastore.Query, error) {
+	cq := datastore.NewQuery(q.Kind).Namespace(aedstorm.NamespaceFromContext(ctx))
+	if q.Ancestor != nil {
+		cq = cq.Ancestor(toCloudKey(q.Ancestor)).Namespace(q.Ancestor.Namespace())
+	}
+	for _, f := range q.Filters {
+		v, _, err := toCloudValue(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		cq = cq.Filter(f.Filter, v)
+	}
+	for _, o := range q.Orders {
+		cq = cq.Order(o)
+	}
+	if len(q.Projection) > 0 {
+		cq = cq.Project(q.Projection...)
+	}
+	if q.Distinct {
+		cq = cq.Distinct()
+	}
+	if len(q.DistinctOn) > 0 {
+		cq = cq.DistinctOn(q.DistinctOn...)
+	}
+	if q.KeysOnly {
+		cq = cq.KeysOnly()
+	}
+	if q.Limit >= 0 {
+		cq = cq.Limit(q.Limit)
+	}
+	if q.Offset > 0 {
+		cq = cq.Offset(q.Offset)
+	}
+	if q.Start != "" {
+		c, err := toCloudCursor(q.Start)
+		if err != nil {
+			return nil, err
+		}
+		cq = cq.Start(c)
+	}
+	if q.End != "" {
+		c, err := toCloudCursor(q.End)
+		if err != nil {
+			return nil, err
+		}
+		cq = cq.End(c)
+	}
+	if q.EventualConsistency {
+		cq = cq.EventualConsistency()
+	}
+	if tx := transaction(ctx); tx != nil {
+		cq = cq.Transaction(tx)
+	}
+	return cq, nil
+}
+
+// driverIterator iterates over the results of a Cloud Datastore query
+type driverIterator struct {
+	driver   *cloudDriver
+	it       *datastore.Iterator
+	keysOnly bool
+	err      error
+}
+
+func (t *driverIterator) Next(dst *aedatastore.PropertyList) (*aedatastore.Key, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	var (
+		props datastore.PropertyList
+		k     *datastore.Key
+		err   error
+	)
+	if t.keysOnly {
+		k, err = t.it.Next(nil)
+	} else {
+		k, err = t.it.Next(&props)
+	}
+	if err == iterator.Done {
+		return nil, aedatastore.Done
+	}
+	if err != nil {
+		return nil, convertError(err)
+	}
+	if !t.keysOnly && dst != nil {
+		if *dst, err = t.driver.fromCloudProperties(props); err != nil {
+			return nil, err
+		}
+	}
+	return t.driver.fromCloudKey(k), nil
+}
+
+func (t *driverIterator) Cursor() (string, error) {
+	if t.err != nil {
+		return "", t.err
+	}
+	c, err := t.it.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+// toCloudCursor decodes a cursor returned by driverIterator.Cursor()
+func toCloudCursor(s string) (datastore.Cursor, error) {
+	c, err := datastore.DecodeCursor(s)
+	if err != nil {
+		return datastore.Cursor{}, driver.ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// transaction returns the transaction of the context, if it has one
+func transaction(ctx context.Context) *datastore.Transaction {
+	tx, _ := ctx.Value(txContextKey{}).(*datastore.Transaction)
+	return tx
+}
+
+// convertError returns the App Engine datastore error of a Cloud Datastore
+// error, so it can be compared with the errors of the datastore package.
+func convertError(err error) error {
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return aedatastore.ErrNoSuchEntity
+	case datastore.ErrInvalidKey:
+		return aedatastore.ErrInvalidKey
+	case datastore.ErrInvalidEntityType:
+		return aedatastore.ErrInvalidEntityType
+	}
+	if merr, ok := err.(datastore.MultiError); ok {
+		errs := make(appengine.MultiError, len(merr))
+		for i, e := range merr {
+			errs[i] = convertError(e)
+		}
+		return errs
+	}
+	return err
+}
+
+func toCloudKey(k *aedatastore.Key) *datastore.Key {
+	if k == nil {
+		return nil
+	}
+	return &datastore.Key{
+		Kind:      k.Kind(),
+		ID:        k.IntID(),
+		Name:      k.StringID(),
+		Parent:    toCloudKey(k.Parent()),
+		Namespace: k.Namespace(),
+	}
+}
+
+func toCloudKeys(keys []*aedatastore.Key) []*datastore.Key {
+	out := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		out[i] = toCloudKey(k)
+	}
+	return out
+}
+
+func (d *cloudDriver) fromCloudKey(k *datastore.Key) *aedatastore.Key {
+	if k == nil {
+		return nil
+	}
+	return driver.MakeKey(d.projectID, k.Namespace, k.Kind, k.Name, k.ID, d.fromCloudKey(k.Parent))
+}
+
+func (d *cloudDriver) fromCloudKeys(keys []*datastore.Key) []*aedatastore.Key {
+	out := make([]*aedatastore.Key, len(keys))
+	for i, k := range keys {
+		out[i] = d.fromCloudKey(k)
+	}
+	return out
+}
+
+// toCloudProperties converts the properties of an App Engine entity. Values
+// of multiple properties are merged into a single slice property.
+func toCloudProperties(props aedatastore.PropertyList) (datastore.PropertyList, error) {
+	var (
+		out      datastore.PropertyList
+		multiple = make(map[string]int)
+	)
+	for _, p := range props {
+		v, indexable, err := toCloudValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Property %s: %v", p.Name, err)
+		}
+		noIndex := p.NoIndex || !indexable
+		if !p.Multiple {
+			out = append(out, datastore.Property{Name: p.Name, Value: v, NoIndex: noIndex})
+			continue
+		}
+		i, ok := multiple[p.Name]
+		if !ok {
+			i, multiple[p.Name] = len(out), len(out)
+			out = append(out, datastore.Property{Name: p.Name, Value: []interface{}{}, NoIndex: noIndex})
+		}
+		out[i].Value = append(out[i].Value.([]interface{}), v)
+		out[i].NoIndex = out[i].NoIndex || noIndex
+	}
+	return out, nil
+}
+
+// toCloudValue converts a property value, and returns whether it can be
+// indexed. Like in the App Engine datastore, []byte values are never indexed
+// while ByteString values are.
+func toCloudValue(v interface{}) (interface{}, bool, error) {
+	switch v := v.(type) {
+	case *aedatastore.Key:
+		return toCloudKey(v), true, nil
+	case appengine.GeoPoint:
+		return datastore.GeoPoint{Lat: v.Lat, Lng: v.Lng}, true, nil
+	case aedatastore.ByteString:
+		return []byte(v), true, nil
+	case []byte:
+		return v, false, nil
+	case nil, int64, bool, string, float64, time.Time:
+		return v, true, nil
+	}
+	return nil, false, fmt.Errorf("Unsupported value type %T", v)
+}
+
+// fromCloudProperties converts the properties of a Cloud Datastore entity.
+// Slice properties are split into multiple properties.
+func (d *cloudDriver) fromCloudProperties(props datastore.PropertyList) (aedatastore.PropertyList, error) {
+	var out aedatastore.PropertyList
+	for _, p := range props {
+		values, multiple := p.Value.([]interface{})
+		if !multiple {
+			values = []interface{}{p.Value}
+		}
+		for _, v := range values {
+			v, err := d.fromCloudValue(v, p.NoIndex)
+			if err != nil {
+				return nil, fmt.Errorf("Property %s: %v", p.Name, err)
+			}
+			out = append(out, aedatastore.Property{Name: p.Name, Value: v, NoIndex: p.NoIndex, Multiple: multiple})
+		}
+	}
+	return out, nil
+}
+
+func (d *cloudDriver) fromCloudValue(v interface{}, noIndex bool) (interface{}, error) {
+	switch v := v.(type) {
+	case *datastore.Key:
+		return d.fromCloudKey(v), nil
+	case datastore.GeoPoint:
+		return appengine.GeoPoint{Lat: v.Lat, Lng: v.Lng}, nil
+	case []byte:
+		if noIndex {
+			return v, nil
+		}
+		return aedatastore.ByteString(v), nil
+	case *datastore.Entity:
+		return nil, errors.New("Entity values are not supported")
+	}
+	return v, nil
+}
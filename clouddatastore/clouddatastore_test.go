@@ -0,0 +1,82 @@
+package clouddatastore
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/appengine"
+	aedatastore "google.golang.org/appengine/datastore"
+)
+
+func TestKeys(t *testing.T) {
+	d := &cloudDriver{projectID: "project"}
+	parent := driver.MakeKey("project", "tenant", "Parent", "p", 0, nil)
+	k := driver.MakeKey("project", "tenant", "Child", "", 42, parent)
+
+	ck := toCloudKey(k)
+	assert.Equal(t, "Child", ck.Kind)
+	assert.Equal(t, int64(42), ck.ID)
+	assert.Equal(t, "tenant", ck.Namespace)
+	assert.Equal(t, "p", ck.Parent.Name)
+	assert.True(t, d.fromCloudKey(ck).Equal(k))
+	assert.Nil(t, toCloudKey(nil))
+}
+
+func TestProperties(t *testing.T) {
+	d := &cloudDriver{projectID: "project"}
+	now := time.Now().UTC()
+	k := driver.MakeKey("project", "", "Kind", "a", 0, nil)
+	props := aedatastore.PropertyList{
+		{Name: "Name", Value: "alice"},
+		{Name: "Tags", Value: "admin", Multiple: true},
+		{Name: "Tags", Value: "staff", Multiple: true},
+		{Name: "Blob", Value: []byte("blob")},
+		{Name: "Short", Value: aedatastore.ByteString("short")},
+		{Name: "Ref", Value: k},
+		{Name: "Where", Value: appengine.GeoPoint{Lat: 1, Lng: 2}},
+		{Name: "At", Value: now, NoIndex: true},
+	}
+
+	cprops, err := toCloudProperties(props)
+	assert.NoError(t, err)
+	assert.Len(t, cprops, 7)
+	assert.Equal(t, []interface{}{"admin", "staff"}, cprops[1].Value)
+	assert.True(t, cprops[2].NoIndex)
+	assert.False(t, cprops[3].NoIndex)
+	assert.Equal(t, datastore.GeoPoint{Lat: 1, Lng: 2}, cprops[5].Value)
+
+	back, err := d.fromCloudProperties(cprops)
+	assert.NoError(t, err)
+	assert.Len(t, back, len(props))
+	for i := range props {
+		assert.Equal(t, props[i].Name, back[i].Name)
+		assert.Equal(t, props[i].Multiple, back[i].Multiple)
+	}
+	assert.Equal(t, aedatastore.ByteString("short"), back[4].Value)
+	assert.True(t, back[5].Value.(*aedatastore.Key).Equal(k))
+
+	_, err = toCloudProperties(aedatastore.PropertyList{{Name: "Bad", Value: struct{}{}}})
+	assert.Error(t, err)
+	_, err = d.fromCloudProperties(datastore.PropertyList{{Name: "Nested", Value: &datastore.Entity{}}})
+	assert.Error(t, err)
+}
+
+func TestConvertError(t *testing.T) {
+	assert.Equal(t, aedatastore.ErrNoSuchEntity, convertError(datastore.ErrNoSuchEntity))
+	merr := convertError(datastore.MultiError{nil, datastore.ErrNoSuchEntity})
+	assert.Equal(t, appengine.MultiError{nil, aedatastore.ErrNoSuchEntity}, merr)
+	assert.Nil(t, convertError(nil))
+}
+
+func TestCursor(t *testing.T) {
+	c, err := toCloudCursor("")
+	assert.NoError(t, err)
+	assert.Equal(t, "", c.String())
+
+	_, err = toCloudCursor("not a cursor!")
+	assert.Equal(t, driver.ErrInvalidCursor, err)
+}
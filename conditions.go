@@ -0,0 +1,258 @@
+package aedstorm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	typeOfGeoPoint   = reflect.TypeOf(appengine.GeoPoint{})
+	typeOfByteString = reflect.TypeOf(datastore.ByteString(nil))
+)
+
+// Condition is a filter on a single property, built with Eq, NotEq, Gt, Gte,
+// Lt, Lte or In and applied with Query.Where.
+type Condition struct {
+	Property string
+	Op       string
+	Value    interface{}
+}
+
+// Eq returns a condition matching entities whose property equals value
+func Eq(property string, value interface{}) Condition {
+	return Condition{property, "=", value}
+}
+
+// NotEq returns a condition matching entities whose property doesn't equal
+// value. It's run as a < and a > sub-query, and since the datastore needs the
+// first order of a query with an inequality filter to be on its property, it
+// fails for queries which order on another property first.
+func NotEq(property string, value interface{}) Condition {
+	return Condition{property, "!=", value}
+}
+
+// Gt returns a condition matching entities whose property is greater than value
+func Gt(property string, value interface{}) Condition {
+	return Condition{property, ">", value}
+}
+
+// Gte returns a condition matching entities whose property is greater than or equal to value
+func Gte(property string, value interface{}) Condition {
+	return Condition{property, ">=", value}
+}
+
+// Lt returns a condition matching entities whose property is less than value
+func Lt(property string, value interface{}) Condition {
+	return Condition{property, "<", value}
+}
+
+// Lte returns a condition matching entities whose property is less than or equal to value
+func Lte(property string, value interface{}) Condition {
+	return Condition{property, "<=", value}
+}
+
+// In returns a condition matching entities whose property equals any of the values
+func In(property string, values ...interface{}) Condition {
+	return Condition{property, "in", values}
+}
+
+// Where adds the conditions to the query after checking them against the
+// model: the property has to exist and be indexed, and the value has to be of
+// a type the property can hold. If a condition can never match, the query
+// isn't run and the error is returned when the query is, or right away by
+// Err().
+//
+// The datastore has no in, or and != operators, so queries with such
+// conditions are split into sub-queries, one for each combination of their
+// alternatives. The sub-queries run concurrently, and their results are
+// merged keeping the order and limit of the query. Merged results have no
+// cursors, so those queries can't be paged with Page().
+func (q *Query) Where(conds ...Condition) *Query {
+	for _, c := range conds {
+		if q.err != nil {
+			return q
+		}
+		if q.err = q.checkCondition(c); q.err != nil {
+			return q
+		}
+		switch c.Op {
+		case "in", "!=", "or":
+			alts, err := alternatives(c)
+			if q.err = err; err != nil {
+				return q
+			}
+			q.disjunctions = append(q.disjunctions, alts)
+			q.conditions = append(q.conditions, c)
+		default:
+			q.Filter(c.Property+" "+c.Op, c.Value)
+		}
+	}
+	return q
+}
+
+// checkCondition returns an error if condition c can never match an entity
+// of the query's model.
+func (q *Query) checkCondition(c Condition) error {
+	switch c.Op {
+	case "=", "<", "<=", ">", ">=", "!=", "in", "or":
+	default:
+		return fmt.Errorf("Unknown operator %q in condition on %s", c.Op, c.Property)
+	}
+
+	if c.Op == "or" {
+		conds, ok := c.Value.([]Condition)
+		if !ok {
+			return fmt.Errorf("Filter or needs a []Condition value, not %T", c.Value)
+		}
+		if len(conds) == 0 {
+			return errors.New("Filter or needs at least one condition")
+		}
+		for _, sub := range conds {
+			if err := q.checkCondition(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	values := []interface{}{c.Value}
+	if c.Op == "in" {
+		var ok bool
+		if values, ok = c.Value.([]interface{}); !ok {
+			return fmt.Errorf("Filter in on %s needs a []interface{} value, not %T", c.Property, c.Value)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("Filter in on %s needs at least one value", c.Property)
+		}
+	}
+
+	if c.Property == "__key__" {
+		for _, v := range values {
+			if _, ok := v.(*datastore.Key); !ok {
+				return fmt.Errorf("Filter on __key__ needs a *datastore.Key value, not %T", v)
+			}
+		}
+		return nil
+	}
+	if q.typ == nil {
+		return nil
+	}
+
+	field, ok := findProperty(q.typ, c.Property)
+	if !ok {
+		return fmt.Errorf("Type %s has no property %s", q.typ.Name(), c.Property)
+	}
+	opts := parseTagOptions(field)
+	if hasDatastoreOption(field, "noindex") || field.Type == typeOfBytes {
+		return fmt.Errorf("Property %s of type %s isn't indexed, so it can't be filtered on", c.Property, q.typ.Name())
+	}
+	if opts.Has("encrypt") {
+		if !opts.Has("deterministic") {
+			return fmt.Errorf("Property %s of type %s is encrypted, so it can't be filtered on", c.Property, q.typ.Name())
+		}
+		if c.Op != "=" && c.Op != "in" {
+			return fmt.Errorf("Property %s of type %s is encrypted, so it can only be filtered on equality", c.Property, q.typ.Name())
+		}
+	}
+
+	want := propertyCategory(field.Type)
+	for _, v := range values {
+		if v == nil {
+			if field.Type.Kind() == reflect.Ptr {
+				continue
+			}
+			return fmt.Errorf("Property %s of type %s can't be nil", c.Property, q.typ.Name())
+		}
+		if got := propertyCategory(reflect.TypeOf(v)); got != want {
+			return fmt.Errorf("Value %v of type %T can never match property %s of type %s, which holds %s values", v, v, c.Property, q.typ.Name(), want)
+		}
+	}
+	return nil
+}
+
+// findProperty returns the struct field of type t which holds the property
+// with the given name. Ref fields are returned as *datastore.Key fields, and
+// slice fields as fields of their element type.
+func findProperty(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tagName := strings.Split(field.Tag.Get("datastore"), ",")[0]
+		if tagName == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		if field.Type.Kind() == reflect.Slice && field.Type != typeOfBytes && field.Type != typeOfByteString {
+			field.Type = field.Type.Elem()
+		}
+		if field.Type == typeOfRef {
+			field.Type = typeOfKeyPtr
+		}
+
+		nested := field.Type.Kind() == reflect.Struct && field.Type != typeOfTime && field.Type != typeOfGeoPoint
+		if field.Anonymous && tagName == "" {
+			if nested {
+				if sub, ok := findProperty(field.Type, name); ok {
+					return sub, true
+				}
+			}
+			continue
+		}
+
+		propName := tagName
+		if propName == "" {
+			propName = field.Name
+		}
+		if nested {
+			if strings.HasPrefix(name, propName+".") {
+				if sub, ok := findProperty(field.Type, name[len(propName)+1:]); ok {
+					return sub, true
+				}
+			}
+			continue
+		}
+		if propName == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// hasDatastoreOption returns true if the datastore tag of the field has the option
+func hasDatastoreOption(field reflect.StructField, option string) bool {
+	for _, opt := range strings.Split(field.Tag.Get("datastore"), ",")[1:] {
+		if opt == option {
+			return true
+		}
+	}
+	return false
+}
+
+// propertyCategory returns the kind of datastore value which a field or value
+// of type t is stored as.
+func propertyCategory(t reflect.Type) string {
+	switch t {
+	case typeOfTime:
+		return "time"
+	case typeOfKeyPtr:
+		return "key"
+	case typeOfGeoPoint:
+		return "geo point"
+	case typeOfBytes, typeOfByteString:
+		return "byte string"
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	}
+	return t.String()
+}
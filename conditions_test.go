@@ -0,0 +1,142 @@
+package aedstorm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type testConditionAddress struct {
+	City string
+}
+
+type testConditionBase struct {
+	Owner *datastore.Key
+}
+
+type testConditionModel struct {
+	testConditionBase
+	ID       string
+	Name     string `datastore:"name"`
+	Age      int
+	Score    float64
+	Active   bool
+	Created  time.Time
+	Tags     []string
+	Notes    string `datastore:",noindex"`
+	Data     []byte
+	Secret   string `aedstorm:"encrypt"`
+	Email    string `aedstorm:"encrypt,deterministic"`
+	Author   Ref
+	Address  testConditionAddress
+	Ignored  string `datastore:"-"`
+	internal string
+}
+
+func TestFindProperty(t *testing.T) {
+	typ := reflect.TypeOf(testConditionModel{})
+	for name, fieldName := range map[string]string{
+		"name":         "Name",
+		"Age":          "Age",
+		"Tags":         "Tags",
+		"Owner":        "Owner",
+		"Author":       "Author",
+		"Address.City": "City",
+	} {
+		field, ok := findProperty(typ, name)
+		if assert.True(t, ok, name) {
+			assert.Equal(t, fieldName, field.Name)
+		}
+	}
+
+	field, _ := findProperty(typ, "Tags")
+	assert.Equal(t, reflect.TypeOf(""), field.Type)
+	field, _ = findProperty(typ, "Author")
+	assert.Equal(t, typeOfKeyPtr, field.Type)
+
+	for _, name := range []string{"Name", "Ignored", "internal", "Address", "Address.Street", "Missing"} {
+		_, ok := findProperty(typ, name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestPropertyCategory(t *testing.T) {
+	assert.Equal(t, "integer", propertyCategory(reflect.TypeOf(int32(0))))
+	assert.Equal(t, "float", propertyCategory(reflect.TypeOf(float32(0))))
+	assert.Equal(t, "string", propertyCategory(reflect.TypeOf("")))
+	assert.Equal(t, "boolean", propertyCategory(reflect.TypeOf(true)))
+	assert.Equal(t, "time", propertyCategory(typeOfTime))
+	assert.Equal(t, "key", propertyCategory(typeOfKeyPtr))
+	assert.Equal(t, "byte string", propertyCategory(typeOfByteString))
+}
+
+func TestWhere(t *testing.T) {
+	k := datastore.NewKey(ctx, "testConditionModel", "foo", 0, nil)
+	valid := []Condition{
+		Eq("name", "foo"),
+		Gt("Age", 18),
+		Gte("Age", int64(18)),
+		Lt("Score", 1.5),
+		Lte("Created", time.Now()),
+		Eq("Active", true),
+		Eq("Tags", "go"),
+		Eq("Owner", k),
+		Eq("Owner", nil),
+		Eq("Author", k),
+		Eq("Address.City", "Berlin"),
+		Eq("Email", "foo@example.com"),
+		Gt("__key__", k),
+	}
+	for _, c := range valid {
+		assert.NoError(t, NewQuery(&testConditionModel{}).Where(c).err, c.Property)
+	}
+
+	invalid := map[string]Condition{
+		"Type testConditionModel has no property Name":                                                                 Eq("Name", "foo"),
+		"Value 18 of type string can never match property Age of type testConditionModel, which holds integer values":  Eq("Age", "18"),
+		"Property Notes of type testConditionModel isn't indexed, so it can't be filtered on":                          Eq("Notes", "foo"),
+		"Property Data of type testConditionModel isn't indexed, so it can't be filtered on":                           Eq("Data", []byte("foo")),
+		"Property Secret of type testConditionModel is encrypted, so it can't be filtered on":                          Eq("Secret", "foo"),
+		"Property Email of type testConditionModel is encrypted, so it can only be filtered on equality":               Gt("Email", "foo"),
+		"Property Age of type testConditionModel can't be nil":                                                         Eq("Age", nil),
+		"Filter on __key__ needs a *datastore.Key value, not string":                                                   Eq("__key__", "foo"),
+		"Filter in on Age needs at least one value":                                                                    In("Age"),
+		"Value foo of type string can never match property Age of type testConditionModel, which holds integer values": In("Age", 1, "foo"),
+	}
+	for msg, c := range invalid {
+		assert.EqualError(t, NewQuery(&testConditionModel{}).Where(c).err, msg)
+	}
+}
+
+func TestWhereStopsAtFirstError(t *testing.T) {
+	q := NewQuery(&testConditionModel{}).Where(Eq("Missing", 1), Eq("Other", 2))
+	assert.EqualError(t, q.Err(), "Type testConditionModel has no property Missing")
+	assert.NoError(t, NewQuery(&testConditionModel{}).Err())
+
+	_, err := q.Count(context.Background())
+	assert.Equal(t, q.err, err)
+	var out []testConditionModel
+	_, err = q.GetAll(context.Background(), &out)
+	assert.Equal(t, q.err, err)
+}
+
+func TestWhereMalformedConditions(t *testing.T) {
+	for _, tc := range []struct {
+		c   Condition
+		err string
+	}{
+		{Condition{"Name", "or", "foo"}, "Filter or needs a []Condition value, not string"},
+		{Condition{"Age", "in", 5}, "Filter in on Age needs a []interface{} value, not int"},
+		{Or(Condition{"Age", "in", []int{1}}), "Filter in on Age needs a []interface{} value, not []int"},
+		{Condition{"Age", "~", 5}, `Unknown operator "~" in condition on Age`},
+		{Condition{"Age", "", 5}, `Unknown operator "" in condition on Age`},
+	} {
+		q := NewQuery(&testConditionModel{})
+		assert.NotPanics(t, func() { q.Where(tc.c) })
+		assert.EqualError(t, q.Err(), tc.err)
+	}
+}
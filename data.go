@@ -4,10 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"sync"
 
 	gocache "github.com/bradberger/gocache/cache"
-	"github.com/bradberger/rest/cache"
 
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
@@ -21,21 +21,33 @@ var (
 	ErrNoContext    = errors.New("No net/context was loaded")
 	ErrNilModel     = errors.New("Model is nil")
 	ErrModelInvalid = errors.New("Model must be a struct pointer")
+
+	ErrNotSoftDeletable = errors.New("Model has no soft delete marker")
 )
 
 const (
 	// TagName is the tag name where we look for custom tag values, like "id"
+	//
+	// Deprecated: the datastore package treats `datastore:"id"` as renaming the
+	// property to "id". Use the `aedstorm:"id"` option instead, see OptionTagName.
 	TagName = "datastore"
 )
 
 // DataModel is a ORM styled structure for saving and loading entities
 type DataModel struct {
-	model       Model
-	ctx         context.Context
-	verified    bool
-	entity      string
-	idFieldName string
-	uid         string
+	model        Model
+	ctx          context.Context
+	verified     bool
+	entity       string
+	idFieldName  string
+	uid          string
+	key          *datastore.Key
+	clock        Clock
+	withDeleted  bool
+	loadDefaults bool
+	preloads     []string
+	idErr        error
+	noHooks      bool
 	sync.Mutex
 }
 
@@ -51,6 +63,33 @@ func NewModel(m Model) *DataModel {
 	return &DataModel{model: m}
 }
 
+// newModelWithKey returns a data model for loading the entity with key k into m
+// withoutHooks keeps the OnSave, OnDelete, OnCache and OnUncache callbacks of
+// the model from being run, like for bulk operations without WithHooks().
+func (dm *DataModel) withoutHooks() *DataModel {
+	dm.noHooks = true
+	return dm
+}
+
+// child returns the model of a child of dm, in the same context and with the
+// same callbacks setting.
+func (dm *DataModel) child(m Model, k *datastore.Key) *DataModel {
+	c := newModelWithKey(m, k).WithContext(dm.Context())
+	c.noHooks = dm.noHooks
+	return c
+}
+
+func newModelWithKey(m Model, k *datastore.Key) *DataModel {
+	dm := NewModel(m)
+	dm.key = k
+	dm.entity = k.Kind()
+	dm.uid = k.StringID()
+	if dm.uid == "" {
+		dm.uid = strconv.FormatInt(k.IntID(), 10)
+	}
+	return dm
+}
+
 // verify checks that the DataModel has an ID field, context, and non-nil model.
 // It should be called before any function that needs one of those things. The
 // results are stored in memory for a bit better performance.
@@ -70,8 +109,16 @@ func (dm *DataModel) verify() (err error) {
 	// See if implements the EntityID interface, if not then try to guess the field
 	_, ok := dm.model.(EntityID)
 
-	// Try to get the ID field, but only fail if the model doesn't implement EntityID
-	if dm.idFieldName, err = dm.getIDField(); !ok && err != nil {
+	// Try to get the ID field, but only fail if there's none and the model doesn't implement EntityID
+	field, found, err := findIDField(reflect.TypeOf(dm.model).Elem())
+	if err != nil {
+		return err
+	}
+	if !found && !ok {
+		return fmt.Errorf("Type %s has no ID field", reflect.TypeOf(dm.model).Elem().Name())
+	}
+	dm.idFieldName = field.Name
+	if err := checkSoftDeleteField(reflect.TypeOf(dm.model).Elem()); err != nil {
 		return err
 	}
 
@@ -81,19 +128,15 @@ func (dm *DataModel) verify() (err error) {
 
 // getIDField gets the name of the struct field which serves as an ID for the given model.
 func (dm *DataModel) getIDField() (string, error) {
-
 	t := reflect.ValueOf(dm.model).Type().Elem()
-
-	// Iterate over all available fields and read the tag value or return if the field name is ID
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
-		tag := field.Tag.Get(TagName)
-		if field.Name == "ID" || tag == "id" {
-			return field.Name, nil
-		}
+	field, ok, err := findIDField(t)
+	if err != nil {
+		return "", err
 	}
-
-	return "", fmt.Errorf("Type %s has no ID field", t.Name())
+	if !ok {
+		return "", fmt.Errorf("Type %s has no ID field", t.Name())
+	}
+	return field.Name, nil
 }
 
 func (dm *DataModel) getEntityName() string {
@@ -116,45 +159,128 @@ func (dm *DataModel) fromCache() error {
 	if err := dm.verify(); err != nil {
 		return err
 	}
-	return cache.New(dm.Context()).Get(dm.cacheKey(), dm.model)
+	cached := reflect.New(reflect.TypeOf(dm.model).Elem())
+	if err := cacheGet(dm.Context(), dm.cacheKey(), cached.Interface()); err != nil {
+		return err
+	}
+
+	// Cached entities might have been stored with an older schema version,
+	// in which case they're migrated from the datastore instead
+	if stale, err := isStale(cached.Interface()); err != nil || stale {
+		if err == nil {
+			err = gocache.ErrCacheMiss
+		}
+		return err
+	}
+	reflect.ValueOf(dm.model).Elem().Set(cached.Elem())
+	return decryptModel(dm.Context(), dm.model)
 }
 
 // Load loads the entity from the datastore. Must have an ID for this to work.
+// Soft deleted entities are treated as missing unless WithDeleted() is used.
 func (dm *DataModel) Load() error {
+	if err := dm.load(); err != nil {
+		return err
+	}
+	if dm.IsDeleted() && !dm.withDeleted {
+		return datastore.ErrNoSuchEntity
+	}
+	if len(dm.preloads) > 0 {
+		return preload(dm.Context(), []reflect.Value{reflect.ValueOf(dm.model)}, dm.preloads, dm.withDeleted)
+	}
+	return nil
+}
+
+func (dm *DataModel) load() error {
 
 	if err := dm.verify(); err != nil {
 		return err
 	}
 
-	if err := dm.fromCache(); err == nil {
-		return nil
+	// Only the stored entity tells which properties are missing, so loads
+	// with defaults always read it from the datastore
+	if !dm.loadDefaults {
+		if err := dm.fromCache(); err == nil {
+			return nil
+		}
 	}
 
-	if err := datastore.Get(dm.Context(), dm.Key(), dm.model); err != nil {
+	props, err := dm.get()
+	if err != nil {
 		return err
 	}
-	// If successful, then cache so we'll have it next time
+	if err := decryptModel(dm.Context(), dm.model); err != nil {
+		return err
+	}
+	// If successful, then cache so we'll have it next time. The defaults are
+	// set after that, so the cache holds the entity as it's stored.
 	if err := dm.Cache(); err != nil {
 		return err
 	}
+	if dm.loadDefaults {
+		return setDefaults(dm.model, props)
+	}
 	return nil
 }
 
-// Key returns the datastore key
+// get reads the entity from the datastore into the model, running any schema
+// migrations it needs, and returns the properties it was loaded from.
+func (dm *DataModel) get() (datastore.PropertyList, error) {
+	var props datastore.PropertyList
+	if err := driverGet(dm.Context(), dm.Key(), &props); err != nil {
+		return nil, err
+	}
+	props, migrated, err := migrate(dm.Context(), dm.model, props)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadProperties(dm.model, props); err != nil {
+		return nil, err
+	}
+	if migrated && migrationWriteBack(dm.getEntityName()) {
+		if _, err := driverPut(dm.Context(), dm.Key(), &props); err != nil {
+			return nil, err
+		}
+	}
+	return props, nil
+}
+
+// Key returns the datastore key. If the ID field is a *datastore.Key, it's
+// returned as is, and int64 ID fields result in a numeric key.
 func (dm *DataModel) Key() *datastore.Key {
-	return datastore.NewKey(dm.Context(), dm.getEntityName(), dm.ID(), 0, nil)
+	if dm.key != nil {
+		return dm.key
+	}
+	id := dm.ID()
+	if v, ok := dm.idValue(); ok {
+		switch {
+		case v.Type() == typeOfKeyPtr:
+			if k := v.Interface().(*datastore.Key); k != nil {
+				return k
+			}
+		case v.Kind() == reflect.Int64:
+			if v.Int() != 0 {
+				return NewKey(dm.Context(), dm.getEntityName(), "", v.Int(), nil)
+			}
+		}
+	}
+	return NewKey(dm.Context(), dm.getEntityName(), id, 0, nil)
 }
 
 // ID returns the underlying data struct's unique ID. If the supplied struct
 // implements this interface, then it's result will be that of the model's EntityID()
-// function. Otherwise, a new random uuid v4 will be used.
+// function. If not, the value of the ID field is used, which can be a string,
+// int64, UUID or *datastore.Key. If that's not set either, a new ID is
+// generated, which is a random uuid v4 for all but int64 ID fields. If
+// allocating an int64 ID fails, an empty string is returned, and Save()
+// returns the error.
 func (dm *DataModel) ID() string {
 
 	if dm.uid != "" {
 		return dm.uid
 	}
 
-	// Try to get the entity name from a Entity() method. If not, fall back to a new UUID v4
+	// Try to get the entity name from a Entity() method. If not, fall back to the ID field
 	if obj, ok := dm.model.(EntityID); ok {
 		if id := obj.GetID(); id != "" {
 			dm.uid = id
@@ -162,12 +288,19 @@ func (dm *DataModel) ID() string {
 		}
 	}
 
-	uuid, err := NewUUID()
-	if err != nil {
-		panic(err)
+	if v, ok := dm.idValue(); ok {
+		if id := idString(v); id != "" {
+			dm.uid = id
+			return dm.uid
+		}
 	}
 
-	dm.uid = uuid.String()
+	id, err := dm.newID()
+	if err != nil {
+		dm.idErr = err
+		return ""
+	}
+	dm.uid = id
 
 	// If can set the id field, do it now.
 	setter, ok := dm.model.(SetID)
@@ -175,20 +308,32 @@ func (dm *DataModel) ID() string {
 		setter.SetID(dm.uid)
 	}
 
-	if fieldName, err := dm.getIDField(); err == nil {
-		reflect.ValueOf(dm.model).Elem().FieldByName(fieldName).SetString(dm.uid)
-	}
-
 	return dm.uid
 }
 
 // Save writes the entity to the datastore
 func (dm *DataModel) Save() error {
+	if err := dm.beforeSave(); err != nil {
+		return err
+	}
+	if err := dm.write(); err != nil {
+		return err
+	}
+	return dm.afterSave()
+}
+
+// beforeSave validates the model and fills in its timestamps, defaults and
+// schema version, before it's written.
+func (dm *DataModel) beforeSave() error {
 
 	if err := dm.verify(); err != nil {
 		return err
 	}
 
+	if obj, ok := dm.model.(PartialModel); ok && obj.IsPartial() {
+		return ErrPartialModel
+	}
+
 	// Check if the struct has en Error() method, and use it if it does.
 	if obj, ok := dm.model.(EntityError); ok {
 		if err := obj.Error(); err != nil {
@@ -196,18 +341,48 @@ func (dm *DataModel) Save() error {
 		}
 	}
 
-	if _, err := datastore.Put(dm.Context(), dm.Key(), dm.model); err != nil {
+	if err := dm.setTimestamps(); err != nil {
+		return err
+	}
+
+	if err := setDefaults(dm.model, nil); err != nil {
+		return err
+	}
+
+	if err := setSchemaVersion(dm.model); err != nil {
 		return err
 	}
 
+	// Generating the ID can fail for IDs allocated by the datastore
+	return dm.ensureID()
+}
+
+// afterSave caches the written model and runs its OnSave callback
+func (dm *DataModel) afterSave() error {
 	var eg errgroup.Group
 	eg.Go(dm.Cache)
-	if obj, ok := dm.model.(OnSave); ok {
+	if obj, ok := dm.model.(OnSave); ok && !dm.noHooks {
 		eg.Go(obj.Save)
 	}
 	return eg.Wait()
 }
 
+// put writes the model to the datastore, with its encrypted fields encrypted.
+// The key is built first, since that sets the ID field of new models.
+func (dm *DataModel) put(ctx context.Context) error {
+	key := dm.Key()
+	m, err := encryptModel(ctx, dm.model)
+	if err != nil {
+		return err
+	}
+	props, err := saveProperties(m)
+	if err != nil {
+		return err
+	}
+	_, err = driverPut(ctx, key, &props)
+	return err
+}
+
 // Context returns the internal net/context
 func (dm *DataModel) Context() context.Context {
 	return dm.ctx
@@ -217,15 +392,28 @@ func (dm *DataModel) cacheKey() string {
 	return fmt.Sprintf("model.%s.%s", dm.getEntityName(), dm.ID())
 }
 
+// cacheKeyForKey returns the cache key of the entity with the given datastore key
+func cacheKeyForKey(k *datastore.Key) string {
+	id := k.StringID()
+	if id == "" {
+		id = fmt.Sprintf("%d", k.IntID())
+	}
+	return fmt.Sprintf("model.%s.%s", k.Kind(), id)
+}
+
 // Cache caches the entity in memcache
 func (dm *DataModel) Cache() error {
 	if err := dm.verify(); err != nil {
 		return err
 	}
-	if err := cache.New(dm.Context()).Set(dm.cacheKey(), dm.model, 0); err != nil {
+	m, err := encryptModel(dm.Context(), dm.model)
+	if err != nil {
+		return err
+	}
+	if err := cacheSet(dm.Context(), dm.cacheKey(), m); err != nil {
 		return err
 	}
-	if obj, ok := dm.model.(OnCache); ok {
+	if obj, ok := dm.model.(OnCache); ok && !dm.noHooks {
 		if err := obj.Cache(); err != nil {
 			return err
 		}
@@ -241,10 +429,10 @@ func (dm *DataModel) WithContext(ctx context.Context) *DataModel {
 
 // Uncache removes the cached model from cache
 func (dm *DataModel) Uncache() error {
-	if err := cache.New(dm.Context()).Del(dm.cacheKey()); err != nil {
+	if err := cacheDel(dm.Context(), dm.cacheKey()); err != nil {
 		return err
 	}
-	if obj, ok := dm.model.(OnUncache); ok {
+	if obj, ok := dm.model.(OnUncache); ok && !dm.noHooks {
 		if err := obj.Uncache(); err != nil {
 			return err
 		}
@@ -252,15 +440,46 @@ func (dm *DataModel) Uncache() error {
 	return nil
 }
 
-// Delete deletes the entity from the datastore and cache
+// Delete deletes the entity from the datastore and cache. If the model has a
+// soft delete marker, it's set and the model is saved instead, and only the
+// children which support soft delete are soft deleted by its cascade rules.
+// Restrict rules are checked first, the other cascade rules are applied after
+// the model is deleted.
 func (dm *DataModel) Delete() error {
-	if err := datastore.Delete(dm.Context(), dm.Key()); err != nil && err != gocache.ErrCacheMiss {
+	return dm.delete(false)
+}
+
+// HardDelete deletes the entity from the datastore and cache, even if the
+// model has a soft delete marker. Children deleted by cascade rules are hard
+// deleted too.
+func (dm *DataModel) HardDelete() error {
+	return dm.delete(true)
+}
+
+// delete deletes the model, or only marks it as deleted if it supports soft
+// delete and hard is false. The model is deleted before its cascade rules are
+// applied, so a failed cascade leaves orphaned children behind, instead of a
+// model whose children are gone.
+func (dm *DataModel) delete(hard bool) error {
+	if err := dm.restrict(hard); err != nil {
+		return err
+	}
+	if field, ok := dm.softDeleteValue(); ok && !hard {
+		if err := dm.softDelete(field); err != nil {
+			return err
+		}
+		return dm.cascade(hard, true)
+	}
+	if err := dm.remove(); err != nil && err != gocache.ErrCacheMiss {
 		return err
 	}
 	var eg errgroup.Group
 	eg.Go(dm.Uncache)
-	if obj, ok := dm.model.(OnDelete); ok {
+	if obj, ok := dm.model.(OnDelete); ok && !dm.noHooks {
 		eg.Go(obj.Delete)
 	}
-	return eg.Wait()
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	return dm.cascade(hard, false)
 }
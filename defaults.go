@@ -0,0 +1,120 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+var typeOfDuration = reflect.TypeOf(time.Duration(0))
+
+// WithLoadDefaults makes Load() fill in the `aedstorm:"default=..."` values of
+// fields whose property is missing from the stored entity, which happens for
+// entities saved before the field was added. The cache can't tell which
+// properties are missing, so the entity is always read from the datastore,
+// and cached without the defaults.
+func (dm *DataModel) WithLoadDefaults() *DataModel {
+	dm.loadDefaults = true
+	return dm
+}
+
+// setDefaults sets the default value of each zero valued field tagged with
+// `aedstorm:"default=..."`. If props isn't nil, only the fields which have no
+// property in it are set.
+func setDefaults(m Model, props datastore.PropertyList) error {
+	v := reflect.ValueOf(m).Elem()
+	t := v.Type()
+
+	var loaded map[string]bool
+	if props != nil {
+		loaded = make(map[string]bool, len(props))
+		for _, p := range props {
+			loaded[p.Name] = true
+		}
+	}
+
+	for _, idx := range fieldsWithOption(t, "default") {
+		if loaded[propertyName(t, idx)] {
+			continue
+		}
+		field := v.FieldByIndex(idx)
+		if !isZero(field) {
+			continue
+		}
+		str, _ := parseTagOptions(t.FieldByIndex(idx)).Value("default")
+		if err := setFromString(field, str); err != nil {
+			return fmt.Errorf("Invalid default for field %s of type %s: %v", t.FieldByIndex(idx).Name, t.Name(), err)
+		}
+	}
+	return nil
+}
+
+// isZero returns true if v holds the zero value of its type.
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// setFromString parses str according to the type of v and sets it.
+func setFromString(v reflect.Value, str string) error {
+	switch v.Type() {
+	case typeOfTime:
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	case typeOfDuration:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(str, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(str, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(str, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// loadProperties loads props into the model, using its own Load() method if
+// it implements the datastore.PropertyLoadSaver interface. It's the
+// counterpart of saveProperties.
+func loadProperties(m Model, props datastore.PropertyList) error {
+	if pls, ok := m.(datastore.PropertyLoadSaver); ok {
+		return pls.Load(props)
+	}
+	return datastore.LoadStruct(m, refPropertiesToFields(m, props))
+}
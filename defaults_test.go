@@ -0,0 +1,104 @@
+package aedstorm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type testModelWithDefaults struct {
+	ID       string
+	Name     string        `aedstorm:"default=unknown"`
+	Count    int           `datastore:"count" aedstorm:"default=3"`
+	Ratio    float64       `aedstorm:"default=0.5"`
+	Active   bool          `aedstorm:"default=true"`
+	Timeout  time.Duration `aedstorm:"default=1m"`
+	Since    time.Time     `aedstorm:"default=2017-01-01T00:00:00Z"`
+	Untagged string
+}
+
+func (m *testModelWithDefaults) GetID() string {
+	return m.ID
+}
+
+type testModelWithBadDefault struct {
+	ID    string
+	Count int `aedstorm:"default=many"`
+}
+
+func TestSetDefaults(t *testing.T) {
+	tm := &testModelWithDefaults{}
+	assert.NoError(t, setDefaults(tm, nil))
+	assert.Equal(t, "unknown", tm.Name)
+	assert.Equal(t, 3, tm.Count)
+	assert.Equal(t, 0.5, tm.Ratio)
+	assert.True(t, tm.Active)
+	assert.Equal(t, time.Minute, tm.Timeout)
+	assert.Equal(t, time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), tm.Since)
+	assert.Empty(t, tm.Untagged)
+}
+
+func TestSetDefaultsKeepsValues(t *testing.T) {
+	tm := &testModelWithDefaults{Name: "foo", Count: 1}
+	assert.NoError(t, setDefaults(tm, nil))
+	assert.Equal(t, "foo", tm.Name)
+	assert.Equal(t, 1, tm.Count)
+}
+
+func TestSetDefaultsMissingProperties(t *testing.T) {
+	tm := &testModelWithDefaults{}
+	props := datastore.PropertyList{
+		{Name: "Name", Value: ""},
+		{Name: "count", Value: int64(0)},
+	}
+	assert.NoError(t, setDefaults(tm, props))
+	assert.Equal(t, "", tm.Name)
+	assert.Equal(t, 0, tm.Count)
+	assert.True(t, tm.Active)
+}
+
+func TestSetDefaultsInvalid(t *testing.T) {
+	err := setDefaults(&testModelWithBadDefault{}, nil)
+	assert.EqualError(t, err, `Invalid default for field Count of type testModelWithBadDefault: strconv.ParseInt: parsing "many": invalid syntax`)
+}
+
+func TestLoadDefaults(t *testing.T) {
+	dm := NewModel(&testModelWithDefaults{ID: "old-entity"}).WithContext(ctx)
+	props := &datastore.PropertyList{{Name: "ID", Value: "old-entity"}, {Name: "Name", Value: ""}}
+	if _, err := datastore.Put(ctx, dm.Key(), props); !assert.NoError(t, err) {
+		return
+	}
+	dm.Uncache()
+
+	loaded := &testModelWithDefaults{ID: "old-entity"}
+	assert.NoError(t, NewModel(loaded).WithContext(ctx).WithLoadDefaults().Load())
+	assert.Equal(t, "", loaded.Name)
+	assert.Equal(t, 3, loaded.Count)
+	assert.True(t, loaded.Active)
+}
+
+func TestLoadDefaultsIgnoresCache(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	dm := NewModel(&testModelWithDefaults{ID: "old-entity"}).WithContext(mctx)
+	props := &datastore.PropertyList{{Name: "ID", Value: "old-entity"}, {Name: "Name", Value: ""}}
+	_, err := driverPut(mctx, dm.Key(), props)
+	assert.NoError(t, err)
+
+	// A plain load caches the entity as it's stored
+	plain := &testModelWithDefaults{ID: "old-entity"}
+	assert.NoError(t, NewModel(plain).WithContext(mctx).Load())
+	assert.Equal(t, 0, plain.Count)
+
+	withDefaults := &testModelWithDefaults{ID: "old-entity"}
+	assert.NoError(t, NewModel(withDefaults).WithContext(mctx).WithLoadDefaults().Load())
+	assert.Equal(t, 3, withDefaults.Count)
+	assert.Equal(t, "", withDefaults.Name)
+
+	// Which doesn't leak the defaults into the cache
+	plain = &testModelWithDefaults{ID: "old-entity"}
+	assert.NoError(t, NewModel(plain).WithContext(mctx).Load())
+	assert.Equal(t, 0, plain.Count)
+}
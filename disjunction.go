@@ -0,0 +1,475 @@
+package aedstorm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// MaxSubQueries is the maximum number of sub-queries a query with in, or and
+// != conditions is split into.
+const MaxSubQueries = 30
+
+// ErrNoCursor is returned when asking for the cursor of a query with in, or
+// or != conditions, since their results are merged from several sub-queries.
+var ErrNoCursor = errors.New("Queries with in, or and != conditions have no cursors")
+
+// Or returns a condition matching entities which match any of the conditions
+func Or(conds ...Condition) Condition {
+	return Condition{Op: "or", Value: conds}
+}
+
+// alternatives returns the simple conditions of which any has to match for
+// condition c to match.
+func alternatives(c Condition) ([]Condition, error) {
+	switch c.Op {
+	case "in":
+		values, ok := c.Value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Filter in on %s needs a []interface{} value, not %T", c.Property, c.Value)
+		}
+		var alts []Condition
+		for _, v := range values {
+			alts = append(alts, Eq(c.Property, v))
+		}
+		return alts, nil
+	case "!=":
+		return []Condition{Lt(c.Property, c.Value), Gt(c.Property, c.Value)}, nil
+	case "or":
+		conds, ok := c.Value.([]Condition)
+		if !ok {
+			return nil, fmt.Errorf("Filter or needs a []Condition value, not %T", c.Value)
+		}
+		var alts []Condition
+		for _, sub := range conds {
+			subAlts, err := alternatives(sub)
+			if err != nil {
+				return nil, err
+			}
+			alts = append(alts, subAlts...)
+		}
+		return alts, nil
+	}
+	return []Condition{c}, nil
+}
+
+// subQueries returns one query spec for each combination of the
+// alternatives of the in, or and != conditions. They don't have the limit,
+// offset and keys only settings of the query.
+func (q *Query) subQueries(ctx context.Context) ([]*driver.Query, error) {
+	base, err := q.baseQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n := 1
+	for _, alts := range q.disjunctions {
+		if n *= len(alts); n > MaxSubQueries {
+			return nil, fmt.Errorf("Query needs more than %d sub-queries for its in, or and != conditions", MaxSubQueries)
+		}
+	}
+
+	queries := []*driver.Query{base}
+	for _, alts := range q.disjunctions {
+		var next []*driver.Query
+		for _, spec := range queries {
+			for _, c := range alts {
+				var value interface{} = c.Value
+				f := filter{c.Property + " " + c.Op, c.Value}
+				if q.typ != nil && deterministicProperty(q.typ, c.Property) {
+					if value, err = f.encrypt(ctx, q.entity); err != nil {
+						return nil, err
+					}
+				}
+				next = append(next, spec.WithFilter(f.filterStr, value))
+			}
+		}
+		queries = next
+	}
+	return queries, nil
+}
+
+// ErrMergeOrder is returned for queries with in, or and != conditions which
+// have no orders, and whose sub-queries have inequality filters on different
+// properties. The datastore sorts those sub-queries by different properties,
+// so their results can't be merged as they're read.
+var ErrMergeOrder = errors.New("Queries with in, or and != conditions need an order when their sub-queries have inequality filters on different properties")
+
+// getAllMerged runs the sub-queries and merges all their results, see
+// runMerged().
+func (q *Query) getAllMerged(ctx context.Context, keysOnly bool) ([]*datastore.Key, []datastore.PropertyList, error) {
+	t, err := q.runMerged(ctx, keysOnly)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		keys  []*datastore.Key
+		lists []datastore.PropertyList
+	)
+	for {
+		r, err := t.next()
+		if err == datastore.Done {
+			return keys, lists, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, r.key)
+		if !keysOnly {
+			lists = append(lists, r.props)
+		}
+	}
+}
+
+// mergeOrders returns the orders by which the results of all sub-queries are
+// sorted, which is the order they're merged in. Without orders, the datastore
+// sorts the results of a query with an inequality filter by its property, so
+// all sub-queries have to filter on the same one.
+func (q *Query) mergeOrders(queries []*driver.Query) ([]string, error) {
+	if len(q.orders) > 0 {
+		return q.orders, nil
+	}
+	var inequality string
+	for i, spec := range queries {
+		var prop string
+		for _, f := range spec.Filters {
+			name, op, err := f.Property()
+			if err != nil {
+				return nil, err
+			}
+			if op != "=" && name != "__key__" {
+				prop = name
+			}
+		}
+		if i > 0 && prop != inequality {
+			return nil, ErrMergeOrder
+		}
+		inequality = prop
+	}
+	if inequality == "" {
+		return nil, nil
+	}
+	return []string{inequality}, nil
+}
+
+// mergedIterator merges the results of the sub-queries of a query as they're
+// read. Each sub-query is sorted by the merge orders, so the next result is
+// always the smallest of their next ones. Only the keys which were already
+// returned are kept, to leave out duplicates.
+type mergedIterator struct {
+	orders []string
+	its    []driver.Iterator
+	heads  []*mergedResult
+	seen   map[string]bool
+	offset int
+	// limit is the number of results left, a negative value means unlimited
+	limit int
+}
+
+// runMerged runs the sub-queries, and returns an iterator which merges their
+// results, leaving out duplicates and keeping the order, offset and limit of
+// the query. Entities are only loaded if keysOnly is false or the results
+// have to be sorted. The first results of the sub-queries are read
+// concurrently.
+func (q *Query) runMerged(ctx context.Context, keysOnly bool) (*mergedIterator, error) {
+	queries, err := q.subQueries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := q.mergeOrders(queries)
+	if err != nil {
+		return nil, err
+	}
+	keysOnly = keysOnly && len(orders) == 0
+
+	t := &mergedIterator{
+		orders: orders,
+		its:    make([]driver.Iterator, len(queries)),
+		heads:  make([]*mergedResult, len(queries)),
+		seen:   make(map[string]bool),
+		offset: q.offset,
+		limit:  -1,
+	}
+	if q.limited {
+		t.limit = q.limit
+	}
+	var eg errgroup.Group
+	for i, spec := range queries {
+		i, spec := i, spec
+		spec.KeysOnly = keysOnly
+		if q.limited {
+			spec.Limit = q.limit + q.offset
+		}
+		t.its[i] = getDriver(ctx).Run(ctx, spec)
+		eg.Go(func() error {
+			return t.advance(i)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// advance reads the next result of sub-query i
+func (t *mergedIterator) advance(i int) error {
+	var props datastore.PropertyList
+	key, err := t.its[i].Next(&props)
+	if err == datastore.Done {
+		t.heads[i] = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.heads[i] = &mergedResult{key, props}
+	return nil
+}
+
+// Next returns the key of the next merged result, and its properties unless
+// the results are keys only.
+func (t *mergedIterator) Next(dst *datastore.PropertyList) (*datastore.Key, error) {
+	r, err := t.next()
+	if err != nil {
+		return nil, err
+	}
+	if dst != nil {
+		*dst = r.props
+	}
+	return r.key, nil
+}
+
+// Cursor returns ErrNoCursor, since merged results have no cursors
+func (t *mergedIterator) Cursor() (string, error) {
+	return "", ErrNoCursor
+}
+
+// next returns the next merged result, or datastore.Done if there are no more.
+func (t *mergedIterator) next() (mergedResult, error) {
+	for t.limit != 0 {
+		best := -1
+		for i, h := range t.heads {
+			if h != nil && (best < 0 || compareResults(t.orders, *h, *t.heads[best]) < 0) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		r := *t.heads[best]
+		if err := t.advance(best); err != nil {
+			return mergedResult{}, err
+		}
+		if t.seen[r.key.Encode()] {
+			continue
+		}
+		t.seen[r.key.Encode()] = true
+		if t.offset > 0 {
+			t.offset--
+			continue
+		}
+		if t.limit > 0 {
+			t.limit--
+		}
+		return r, nil
+	}
+	return mergedResult{}, datastore.Done
+}
+
+// mergedResult is a result of one of the sub-queries
+type mergedResult struct {
+	key   *datastore.Key
+	props datastore.PropertyList
+}
+
+// compareResults compares two results by the orders, and then by key, which
+// is the default order of the datastore.
+func compareResults(orders []string, a, b mergedResult) int {
+	for _, order := range orders {
+		name, desc := parseOrder(order)
+		var c int
+		switch name {
+		case "__key__":
+			c = compareKeys(a.key, b.key)
+		case "__scatter__":
+			c = compareInts(scatterValue(a.key), scatterValue(b.key))
+		default:
+			c = compareValues(sortValue(a.props, name, desc), sortValue(b.props, name, desc))
+		}
+		if desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return compareKeys(a.key, b.key)
+}
+
+// parseOrder returns the property name of an order, and whether it's
+// descending.
+func parseOrder(order string) (string, bool) {
+	name := strings.TrimSpace(order)
+	if strings.HasPrefix(name, "-") {
+		return strings.TrimSpace(name[1:]), true
+	}
+	return name, false
+}
+
+// sortValue returns the value of the property which the datastore sorts an
+// entity by, which is the smallest value of multi-valued properties in
+// ascending order and the largest one in descending order.
+func sortValue(props datastore.PropertyList, name string, desc bool) interface{} {
+	var (
+		value interface{}
+		found bool
+	)
+	for _, p := range props {
+		if p.Name != name {
+			continue
+		}
+		if c := compareValues(p.Value, value); !found || (desc && c > 0) || (!desc && c < 0) {
+			value, found = p.Value, true
+		}
+	}
+	return value
+}
+
+// valueRank is the position of the type of a property value in the sort
+// order of the datastore
+func valueRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64:
+		return 1
+	case time.Time:
+		return 2
+	case bool:
+		return 3
+	case []byte, datastore.ByteString, string:
+		return 4
+	case float64:
+		return 5
+	case appengine.GeoPoint:
+		return 6
+	case *datastore.Key:
+		return 7
+	}
+	return 8
+}
+
+// compareValues compares two property values the way the datastore sorts
+// them, returning -1, 0 or 1.
+func compareValues(a, b interface{}) int {
+	if ra, rb := valueRank(a), valueRank(b); ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch a := a.(type) {
+	case int64:
+		return compareInts(a, b.(int64))
+	case time.Time:
+		bt := b.(time.Time)
+		if a.Before(bt) {
+			return -1
+		}
+		if a.After(bt) {
+			return 1
+		}
+		return 0
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	case []byte, datastore.ByteString, string:
+		return bytes.Compare(toBytes(a), toBytes(b))
+	case float64:
+		bf := b.(float64)
+		if a < bf {
+			return -1
+		}
+		if a > bf {
+			return 1
+		}
+		return 0
+	case appengine.GeoPoint:
+		bg := b.(appengine.GeoPoint)
+		if a.Lat != bg.Lat {
+			return compareValues(a.Lat, bg.Lat)
+		}
+		return compareValues(a.Lng, bg.Lng)
+	case *datastore.Key:
+		return compareKeys(a, b.(*datastore.Key))
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func toBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case datastore.ByteString:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+// compareKeys compares two keys by their paths, with numeric IDs sorting
+// before string IDs.
+func compareKeys(a, b *datastore.Key) int {
+	pa, pb := keyPath(a), keyPath(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if c := strings.Compare(pa[i].Kind(), pb[i].Kind()); c != 0 {
+			return c
+		}
+		aNamed, bNamed := pa[i].StringID() != "", pb[i].StringID() != ""
+		switch {
+		case aNamed && bNamed:
+			if c := strings.Compare(pa[i].StringID(), pb[i].StringID()); c != 0 {
+				return c
+			}
+		case !aNamed && !bNamed:
+			if c := compareInts(pa[i].IntID(), pb[i].IntID()); c != 0 {
+				return c
+			}
+		case aNamed:
+			return 1
+		default:
+			return -1
+		}
+	}
+	return compareInts(int64(len(pa)), int64(len(pb)))
+}
+
+// keyPath returns the ancestors of k followed by k itself
+func keyPath(k *datastore.Key) []*datastore.Key {
+	var path []*datastore.Key
+	for ; k != nil; k = k.Parent() {
+		path = append([]*datastore.Key{k}, path...)
+	}
+	return path
+}
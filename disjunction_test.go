@@ -0,0 +1,180 @@
+package aedstorm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestAlternatives(t *testing.T) {
+	for _, tc := range []struct {
+		c    Condition
+		alts []Condition
+	}{
+		{In("Age", 1, 2), []Condition{Eq("Age", 1), Eq("Age", 2)}},
+		{NotEq("Age", 1), []Condition{Lt("Age", 1), Gt("Age", 1)}},
+		{Or(Eq("name", "foo"), In("Age", 1, 2)), []Condition{Eq("name", "foo"), Eq("Age", 1), Eq("Age", 2)}},
+		{Eq("Age", 1), []Condition{Eq("Age", 1)}},
+	} {
+		alts, err := alternatives(tc.c)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.alts, alts)
+	}
+
+	_, err := alternatives(Condition{"Age", "in", 5})
+	assert.EqualError(t, err, "Filter in on Age needs a []interface{} value, not int")
+	_, err = alternatives(Or(Condition{"Age", "or", "foo"}))
+	assert.EqualError(t, err, "Filter or needs a []Condition value, not string")
+}
+
+func TestWhereDisjunctions(t *testing.T) {
+	q := NewQuery(&testConditionModel{}).Where(In("Age", 1, 2), Eq("Active", true), Or(Eq("name", "foo"), NotEq("Score", 1.5)))
+	assert.NoError(t, q.err)
+	assert.Len(t, q.disjunctions, 2)
+
+	queries, err := q.subQueries(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, queries, 6)
+
+	assert.EqualError(t, NewQuery(&testConditionModel{}).Where(Or(Eq("Missing", 1))).err, "Type testConditionModel has no property Missing")
+	assert.EqualError(t, NewQuery(&testConditionModel{}).Where(Or()).err, "Filter or needs at least one condition")
+}
+
+func TestSubQueriesLimit(t *testing.T) {
+	values := make([]interface{}, 6)
+	for i := range values {
+		values[i] = i
+	}
+	q := NewQuery(&testConditionModel{}).Where(In("Age", values...), In("Score", 1.0, 2.0, 3.0, 4.0, 5.0, 6.0))
+	_, err := q.subQueries(ctx)
+	assert.EqualError(t, err, "Query needs more than 30 sub-queries for its in, or and != conditions")
+}
+
+func TestCompareValues(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, -1, compareValues(int64(1), int64(2)))
+	assert.Equal(t, 1, compareValues("b", "a"))
+	assert.Equal(t, 0, compareValues(1.5, 1.5))
+	assert.Equal(t, -1, compareValues(false, true))
+	assert.Equal(t, -1, compareValues(now, now.Add(time.Second)))
+	assert.Equal(t, -1, compareValues(nil, int64(0)))
+	assert.Equal(t, -1, compareValues(int64(10), "1"))
+	assert.Equal(t, -1, compareValues([]byte("a"), "b"))
+}
+
+func TestCompareKeys(t *testing.T) {
+	parent := datastore.NewKey(ctx, "Parent", "p", 0, nil)
+	a := datastore.NewKey(ctx, "Kind", "a", 0, nil)
+	b := datastore.NewKey(ctx, "Kind", "b", 0, nil)
+	id := datastore.NewKey(ctx, "Kind", "", 10, nil)
+	child := datastore.NewKey(ctx, "Kind", "a", 0, parent)
+
+	assert.Equal(t, -1, compareKeys(a, b))
+	assert.Equal(t, 0, compareKeys(a, datastore.NewKey(ctx, "Kind", "a", 0, nil)))
+	assert.Equal(t, -1, compareKeys(id, a))
+	assert.Equal(t, -1, compareKeys(a, child))
+	assert.Equal(t, 1, compareKeys(datastore.NewKey(ctx, "Other", "a", 0, nil), a))
+	assert.Equal(t, -1, compareKeys(parent, child))
+}
+
+func TestSortValue(t *testing.T) {
+	props := datastore.PropertyList{
+		{Name: "Tags", Value: "b", Multiple: true},
+		{Name: "Tags", Value: "a", Multiple: true},
+		{Name: "Tags", Value: "c", Multiple: true},
+	}
+	assert.Equal(t, "a", sortValue(props, "Tags", false))
+	assert.Equal(t, "c", sortValue(props, "Tags", true))
+	assert.Nil(t, sortValue(props, "Missing", false))
+}
+
+func TestCompareResults(t *testing.T) {
+	a := mergedResult{datastore.NewKey(ctx, "Kind", "a", 0, nil), datastore.PropertyList{{Name: "Age", Value: int64(30)}}}
+	b := mergedResult{datastore.NewKey(ctx, "Kind", "b", 0, nil), datastore.PropertyList{{Name: "Age", Value: int64(20)}}}
+
+	assert.Equal(t, -1, compareResults(nil, a, b))
+	assert.Equal(t, 1, compareResults([]string{"Age"}, a, b))
+	assert.Equal(t, -1, compareResults([]string{"-Age"}, a, b))
+	assert.Equal(t, 1, compareResults([]string{"-__key__"}, a, b))
+}
+
+func TestPageDisjunction(t *testing.T) {
+	var out []testConditionModel
+	_, err := NewQuery(&testConditionModel{}).Where(In("Age", 1, 2)).Page(ctx, 10, "", &out)
+	assert.Equal(t, ErrNoCursor, err)
+}
+
+func TestGetAllDisjunction(t *testing.T) {
+	for i, name := range []string{"in-a", "in-b", "in-c"} {
+		assert.NoError(t, NewModel(&testAuthor{ID: name, Name: name}).WithContext(ctx).Save(), i)
+	}
+
+	var out []testAuthor
+	_, err := NewQuery(&testAuthor{}).Where(In("Name", "in-a", "in-c", "in-a")).Order("-Name").GetAll(ctx, &out)
+	assert.NoError(t, err)
+	if assert.Len(t, out, 2) {
+		assert.Equal(t, "in-c", out[0].Name)
+		assert.Equal(t, "in-a", out[1].Name)
+	}
+
+	n, err := NewQuery(&testAuthor{}).Where(In("Name", "in-a", "in-b", "in-c")).Limit(2).Count(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestRunMerged(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	// Results are merged in order as they're read, leaving out duplicates
+	var ids []string
+	it := NewQuery(&testMemoryModel{}).Where(Or(Eq("Tags", "staff"), Eq("Age", 25))).Order("-Name").Offset(1).Limit(2).Run(mctx)
+	for {
+		var m testMemoryModel
+		_, err := it.Next(&m)
+		if err == datastore.Done {
+			break
+		}
+		assert.NoError(t, err)
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []string{"b", "a"}, ids)
+	_, err := it.Cursor()
+	assert.Equal(t, ErrNoCursor, err)
+
+	// Without orders, sub-queries with an inequality are merged by its property
+	var all []testMemoryModel
+	_, err = NewQuery(&testMemoryModel{}).Where(NotEq("Age", 30)).GetAll(mctx, &all)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "d", "c"}, memoryIDs(all))
+}
+
+func TestMergeOrders(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	q := NewQuery(&testMemoryModel{}).Where(Or(Lt("Age", 26), Gt("Name", "c")))
+	_, err := q.GetAll(mctx, &[]testMemoryModel{})
+	assert.Equal(t, ErrMergeOrder, err)
+	_, err = q.DeleteAll(mctx)
+	assert.Equal(t, ErrMergeOrder, err)
+
+	queries, err := NewQuery(&testMemoryModel{}).Where(In("Age", 25, 30)).subQueries(mctx)
+	assert.NoError(t, err)
+	orders, err := NewQuery(&testMemoryModel{}).mergeOrders(queries)
+	assert.NoError(t, err)
+	assert.Empty(t, orders)
+}
+
+func TestDeleteAllDisjunction(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	res, err := NewQuery(&testMemoryModel{}).Where(In("Name", "alice", "carol", "nobody")).DeleteAll(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Processed)
+
+	var left []testMemoryModel
+	_, err = NewQuery(&testMemoryModel{}).GetAll(mctx, &left)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "d"}, memoryIDs(left))
+}
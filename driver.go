@@ -0,0 +1,388 @@
+package aedstorm
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	gocache "github.com/bradberger/gocache/cache"
+	"github.com/bradberger/rest/cache"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// ErrInvalidCursor is returned when a cursor wasn't created by the driver of
+// the context it's used with
+var ErrInvalidCursor = driver.ErrInvalidCursor
+
+type (
+	cacheContextKey     struct{}
+	namespaceContextKey struct{}
+)
+
+// Cache is where models are cached. The memcache of App Engine is used unless
+// the context has another one, see WithCache(). Get returns
+// cache.ErrCacheMiss for missing values. GetMulti gets the values of keys into
+// dst, which has the same length, with a single call. Like the GetMulti of the
+// datastore, it returns an appengine.MultiError if some of the values weren't
+// got, with cache.ErrCacheMiss for the missing ones.
+type Cache interface {
+	Get(ctx context.Context, key string, dst interface{}) error
+	GetMulti(ctx context.Context, keys []string, dst []interface{}) error
+	Set(ctx context.Context, key string, value interface{}) error
+	Del(ctx context.Context, key string) error
+}
+
+// withDriver returns a context whose models and queries use the driver.
+// Drivers are internal, so they're otherwise only set by NewMemoryContext(),
+// Record(), Replay() and clouddatastore.NewContext().
+func withDriver(ctx context.Context, d driver.Driver) context.Context {
+	return driver.NewContext(ctx, d)
+}
+
+// WithCache returns a context whose models are cached in c. Use NoCache to
+// turn caching off.
+func WithCache(ctx context.Context, c Cache) context.Context {
+	return context.WithValue(ctx, cacheContextKey{}, c)
+}
+
+// getDriver returns the driver of the context
+func getDriver(ctx context.Context) driver.Driver {
+	if d, ok := driver.FromContext(ctx); ok {
+		return d
+	}
+	return appengineDriver{}
+}
+
+// getCache returns the cache of the context
+func getCache(ctx context.Context) Cache {
+	if c, ok := ctx.Value(cacheContextKey{}).(Cache); ok {
+		return c
+	}
+	return AppEngineCache{}
+}
+
+// WithNamespace returns a context whose keys, queries and cached models are
+// in the namespace, for any driver.
+func WithNamespace(ctx context.Context, namespace string) (context.Context, error) {
+	ctx, err := appengine.Namespace(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return context.WithValue(ctx, namespaceContextKey{}, namespace), nil
+}
+
+// NamespaceFromContext returns the namespace set with WithNamespace()
+func NamespaceFromContext(ctx context.Context) string {
+	ns, _ := ctx.Value(namespaceContextKey{}).(string)
+	return ns
+}
+
+// cacheGet gets the cached value of key into dst
+func cacheGet(ctx context.Context, key string, dst interface{}) error {
+	return getCache(ctx).Get(ctx, key, dst)
+}
+
+// multiError calls fn for each of n values, and returns an
+// appengine.MultiError with the errors if there are any.
+func multiError(n int, fn func(i int) error) error {
+	var merr appengine.MultiError
+	for i := 0; i < n; i++ {
+		if err := fn(i); err != nil {
+			if merr == nil {
+				merr = make(appengine.MultiError, n)
+			}
+			merr[i] = err
+		}
+	}
+	if merr == nil {
+		return nil
+	}
+	return merr
+}
+
+// cacheSet caches the value under key
+func cacheSet(ctx context.Context, key string, value interface{}) error {
+	return getCache(ctx).Set(ctx, key, value)
+}
+
+// cacheDel removes the cached value of key
+func cacheDel(ctx context.Context, key string) error {
+	return getCache(ctx).Del(ctx, key)
+}
+
+// NewKey returns a new key of the driver of the context. Keys of the datastore
+// of App Engine are only created with an App Engine context, whereas those of
+// other drivers can be created in any environment.
+func NewKey(ctx context.Context, kind, stringID string, intID int64, parent *datastore.Key) *datastore.Key {
+	return getDriver(ctx).NewKey(ctx, kind, stringID, intID, parent)
+}
+
+// driverGet loads the entity with the given key into dst, which is either a
+// *datastore.PropertyList or a struct pointer.
+func driverGet(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	lists := make([]datastore.PropertyList, 1)
+	if err := getDriver(ctx).GetMulti(ctx, []*datastore.Key{key}, lists); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok {
+			return merr[0]
+		}
+		return err
+	}
+	if pl, ok := dst.(*datastore.PropertyList); ok {
+		*pl = lists[0]
+		return nil
+	}
+	return datastore.LoadStruct(dst, lists[0])
+}
+
+// driverPut saves src, which is either a *datastore.PropertyList or a struct
+// pointer, as the entity with the given key.
+func driverPut(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	props, ok := src.(*datastore.PropertyList)
+	if !ok {
+		saved, err := datastore.SaveStruct(src)
+		if err != nil {
+			return nil, err
+		}
+		pl := datastore.PropertyList(saved)
+		props = &pl
+	}
+	keys, err := getDriver(ctx).PutMulti(ctx, []*datastore.Key{key}, []datastore.PropertyList{*props})
+	if err != nil {
+		if merr, ok := err.(appengine.MultiError); ok {
+			return nil, merr[0]
+		}
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// driverDelete deletes the entity with the given key
+func driverDelete(ctx context.Context, key *datastore.Key) error {
+	if err := getDriver(ctx).DeleteMulti(ctx, []*datastore.Key{key}); err != nil {
+		if merr, ok := err.(appengine.MultiError); ok {
+			return merr[0]
+		}
+		return err
+	}
+	return nil
+}
+
+// runInTransaction runs f in a transaction of the driver of the context
+func runInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	return getDriver(ctx).RunInTransaction(ctx, f, opts)
+}
+
+// runAll runs the query and returns all its results. For keys only queries,
+// no property lists are returned.
+func runAll(ctx context.Context, q *driver.Query) ([]*datastore.Key, []datastore.PropertyList, error) {
+	var (
+		keys  []*datastore.Key
+		lists []datastore.PropertyList
+	)
+	it := getDriver(ctx).Run(ctx, q)
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == datastore.Done {
+			return keys, lists, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		if !q.KeysOnly {
+			lists = append(lists, props)
+		}
+	}
+}
+
+// appengineDriver is the datastore of App Engine, which is used unless the
+// context has another driver
+type appengineDriver struct{}
+
+func (appengineDriver) NewKey(ctx context.Context, kind, stringID string, intID int64, parent *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, kind, stringID, intID, parent)
+}
+
+func (appengineDriver) AllocateID(ctx context.Context, kind string, parent *datastore.Key) (int64, error) {
+	low, _, err := datastore.AllocateIDs(ctx, kind, parent, 1)
+	return low, err
+}
+
+func (appengineDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst []datastore.PropertyList) error {
+	return datastore.GetMulti(ctx, keys, dst)
+}
+
+func (appengineDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src []datastore.PropertyList) ([]*datastore.Key, error) {
+	return datastore.PutMulti(ctx, keys, src)
+}
+
+func (appengineDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return datastore.DeleteMulti(ctx, keys)
+}
+
+func (appengineDriver) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	return datastore.RunInTransaction(ctx, f, opts)
+}
+
+func (appengineDriver) Run(ctx context.Context, q *driver.Query) driver.Iterator {
+	dq, err := datastoreQuery(q)
+	if err != nil {
+		return errIterator{err}
+	}
+	return appengineIterator{dq.Run(ctx), q.KeysOnly}
+}
+
+func (appengineDriver) Count(ctx context.Context, q *driver.Query) (int, error) {
+	dq, err := datastoreQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	return dq.Count(ctx)
+}
+
+// datastoreQuery returns the App Engine datastore query of the driver query
+func datastoreQuery(q *driver.Query) (*datastore.Query, error) {
+	dq := datastore.NewQuery(q.Kind)
+	if q.Ancestor != nil {
+		dq = dq.Ancestor(q.Ancestor)
+	}
+	for _, f := range q.Filters {
+		dq = dq.Filter(f.Filter, f.Value)
+	}
+	for _, o := range q.Orders {
+		dq = dq.Order(o)
+	}
+	if len(q.Projection) > 0 {
+		dq = dq.Project(q.Projection...)
+	}
+	if q.Distinct {
+		dq = dq.Distinct()
+	}
+	if len(q.DistinctOn) > 0 {
+		dq = dq.DistinctOn(q.DistinctOn...)
+	}
+	if q.KeysOnly {
+		dq = dq.KeysOnly()
+	}
+	if q.Limit >= 0 {
+		dq = dq.Limit(q.Limit)
+	}
+	if q.Offset > 0 {
+		dq = dq.Offset(q.Offset)
+	}
+	if q.Start != "" {
+		c, err := datastore.DecodeCursor(q.Start)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		dq = dq.Start(c)
+	}
+	if q.End != "" {
+		c, err := datastore.DecodeCursor(q.End)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		dq = dq.End(c)
+	}
+	if q.EventualConsistency {
+		dq = dq.EventualConsistency()
+	}
+	if q.BatchSize > 0 {
+		dq = dq.BatchSize(q.BatchSize)
+	}
+	return dq, nil
+}
+
+type appengineIterator struct {
+	it       *datastore.Iterator
+	keysOnly bool
+}
+
+func (t appengineIterator) Next(dst *datastore.PropertyList) (*datastore.Key, error) {
+	if t.keysOnly {
+		return t.it.Next(nil)
+	}
+	return t.it.Next(dst)
+}
+
+func (t appengineIterator) Cursor() (string, error) {
+	c, err := t.it.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return c.String(), nil
+}
+
+// errIterator is the iterator of a query which couldn't be run
+type errIterator struct {
+	err error
+}
+
+func (t errIterator) Next(dst *datastore.PropertyList) (*datastore.Key, error) {
+	return nil, t.err
+}
+
+func (t errIterator) Cursor() (string, error) {
+	return "", t.err
+}
+
+// AppEngineCache is the memcache backed cache of App Engine
+type AppEngineCache struct{}
+
+func (AppEngineCache) Get(ctx context.Context, key string, dst interface{}) error {
+	return cache.New(ctx).Get(key, dst)
+}
+
+// GetMulti gets the values with a single memcache call. The values are gob
+// encoded, like those of Get.
+func (AppEngineCache) GetMulti(ctx context.Context, keys []string, dst []interface{}) error {
+	items, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		return err
+	}
+	return multiError(len(keys), func(i int) error {
+		item, ok := items[keys[i]]
+		if !ok {
+			return gocache.ErrCacheMiss
+		}
+		return gob.NewDecoder(bytes.NewReader(item.Value)).Decode(dst[i])
+	})
+}
+
+func (AppEngineCache) Set(ctx context.Context, key string, value interface{}) error {
+	return cache.New(ctx).Set(key, value, 0)
+}
+
+func (AppEngineCache) Del(ctx context.Context, key string) error {
+	return cache.New(ctx).Del(key)
+}
+
+// NoCache is a cache which never holds anything, for drivers without a cache
+// or to turn caching off with WithCache(). Its Get always misses, while Set and
+// Del always succeed.
+var NoCache Cache = noCache{}
+
+type noCache struct{}
+
+func (noCache) Get(ctx context.Context, key string, dst interface{}) error {
+	return gocache.ErrCacheMiss
+}
+
+func (noCache) GetMulti(ctx context.Context, keys []string, dst []interface{}) error {
+	return multiError(len(keys), func(i int) error {
+		return gocache.ErrCacheMiss
+	})
+}
+
+func (noCache) Set(ctx context.Context, key string, value interface{}) error {
+	return nil
+}
+
+func (noCache) Del(ctx context.Context, key string) error {
+	return nil
+}
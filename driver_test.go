@@ -0,0 +1,40 @@
+package aedstorm
+
+import (
+	"testing"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	gocache "github.com/bradberger/gocache/cache"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestWithDriver(t *testing.T) {
+	d := &memoryDriver{entities: make(map[string]memoryEntity)}
+	dctx := WithCache(withDriver(context.Background(), d), NoCache)
+	assert.Equal(t, d, getDriver(dctx))
+	assert.Equal(t, NoCache, getCache(dctx))
+	assert.Equal(t, appengineDriver{}, getDriver(context.Background()))
+	assert.Equal(t, AppEngineCache{}, getCache(context.Background()))
+
+	m := &testMemoryModel{ID: "a", Name: "alice"}
+	assert.NoError(t, NewModel(m).WithContext(dctx).Save())
+	loaded := &testMemoryModel{ID: "a"}
+	assert.NoError(t, NewModel(loaded).WithContext(dctx).Load())
+	assert.Equal(t, "alice", loaded.Name)
+	assert.NoError(t, NewModel(loaded).WithContext(dctx).Delete())
+}
+
+func TestAppEngineDriverInvalidCursor(t *testing.T) {
+	_, err := appengineDriver{}.Run(ctx, &driver.Query{Kind: "Kind", Limit: -1, Start: "not a cursor!"}).Next(nil)
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = appengineDriver{}.Count(ctx, &driver.Query{Kind: "Kind", Limit: -1, End: "not a cursor!"})
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestNoCache(t *testing.T) {
+	var m testMemoryModel
+	assert.NoError(t, NoCache.Set(ctx, "key", &testMemoryModel{Name: "cached"}))
+	assert.Equal(t, gocache.ErrCacheMiss, NoCache.Get(ctx, "key", &m))
+	assert.NoError(t, NoCache.Del(ctx, "key"))
+}
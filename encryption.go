@@ -0,0 +1,277 @@
+package aedstorm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/context"
+)
+
+// encryptedPrefix marks encrypted values, which are stored as "enc:<key id>:<base64 nonce+ciphertext>"
+const encryptedPrefix = "enc:"
+
+// Encryption errors
+var (
+	ErrNoKeyProvider    = errors.New("No KeyProvider is set for encrypted fields")
+	ErrInvalidEncrypted = errors.New("Encrypted value is malformed")
+)
+
+var typeOfBytes = reflect.TypeOf([]byte(nil))
+
+// KeyProvider supplies the AES keys used to encrypt fields tagged with
+// `aedstorm:"encrypt"`. Values are always encrypted with the current key, and
+// the key ID is stored along with them so older keys can still be used for
+// decrypting after the current key was rotated.
+type KeyProvider interface {
+	// CurrentKey returns the ID and value of the key used for encrypting new values
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	// Key returns the value of the key with the given ID
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider with a fixed set of keys. Keys must be
+// 16, 24 or 32 bytes long, and key IDs must not contain colons.
+type StaticKeyProvider struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+// CurrentKey implements the KeyProvider interface
+func (p *StaticKeyProvider) CurrentKey(ctx context.Context) (string, []byte, error) {
+	key, err := p.Key(ctx, p.Current)
+	return p.Current, key, err
+}
+
+// Key implements the KeyProvider interface
+func (p *StaticKeyProvider) Key(ctx context.Context, id string) ([]byte, error) {
+	key, ok := p.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown encryption key %q", id)
+	}
+	return key, nil
+}
+
+var (
+	keyProvider   KeyProvider
+	keyProviderMu sync.RWMutex
+)
+
+// SetKeyProvider sets the KeyProvider for encrypted fields.
+func SetKeyProvider(kp KeyProvider) {
+	keyProviderMu.Lock()
+	defer keyProviderMu.Unlock()
+	keyProvider = kp
+}
+
+func getKeyProvider() (KeyProvider, error) {
+	keyProviderMu.RLock()
+	defer keyProviderMu.RUnlock()
+	if keyProvider == nil {
+		return nil, ErrNoKeyProvider
+	}
+	return keyProvider, nil
+}
+
+// encryptValue encrypts plaintext with the current key, authenticating aad
+// along with it. If deterministic is true, the nonce is derived from the
+// plaintext and aad, so equal values encrypt to the same ciphertext for as
+// long as the current key doesn't change.
+func encryptValue(ctx context.Context, plaintext []byte, deterministic bool, aad []byte) (string, error) {
+	kp, err := getKeyProvider()
+	if err != nil {
+		return "", err
+	}
+	id, key, err := kp.CurrentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(deriveKey(key, "encryption"))
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if deterministic {
+		mac := hmac.New(sha256.New, deriveKey(key, "nonce"))
+		binary.Write(mac, binary.BigEndian, uint32(len(aad)))
+		mac.Write(aad)
+		mac.Write(plaintext)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, aad)
+	return encryptedPrefix + id + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decryptValue decrypts a value returned by encryptValue with the same aad.
+// Values without the encrypted prefix are returned as is, so fields can be
+// encrypted after data has already been stored in plain text.
+func decryptValue(ctx context.Context, value string, aad []byte) ([]byte, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return []byte(value), nil
+	}
+	parts := strings.SplitN(value[len(encryptedPrefix):], ":", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidEncrypted
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidEncrypted
+	}
+
+	kp, err := getKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	key, err := kp.Key(ctx, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(deriveKey(key, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrInvalidEncrypted
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+// deriveKey derives the subkey for the given purpose from a key of the
+// KeyProvider with HKDF, so the same key material is never used for two
+// things. The subkey has the length of key.
+func deriveKey(key []byte, purpose string) []byte {
+	sub := make([]byte, len(key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("aedstorm "+purpose)), sub); err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// fieldAAD returns the additional authenticated data of an encrypted
+// property, which binds its ciphertexts to the kind and property, so they
+// can't be moved to another field.
+func fieldAAD(kind, property string) []byte {
+	return []byte(kind + "\x00" + property)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedFields returns the index of each field of struct type t tagged
+// with `aedstorm:"encrypt"`.
+func encryptedFields(t reflect.Type) ([][]int, error) {
+	found := fieldsWithOption(t, "encrypt")
+	for _, idx := range found {
+		field := t.FieldByIndex(idx)
+		if field.Type.Kind() != reflect.String && field.Type != typeOfBytes {
+			return nil, fmt.Errorf("Encrypted field %s of type %s must be a string or []byte", field.Name, t.Name())
+		}
+	}
+	return found, nil
+}
+
+// encryptModel returns a copy of m with its encrypted fields encrypted. If m
+// has no encrypted fields, m itself is returned. Empty strings are encrypted
+// too, so equality filters on "" match them, but nil byte slices are left
+// as is.
+func encryptModel(ctx context.Context, m Model) (Model, error) {
+	v := reflect.ValueOf(m).Elem()
+	found, err := encryptedFields(v.Type())
+	if err != nil || len(found) == 0 {
+		return m, err
+	}
+	kind, err := getEntityName(m)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := reflect.New(v.Type())
+	cp.Elem().Set(v)
+	for _, idx := range found {
+		field := cp.Elem().FieldByIndex(idx)
+		deterministic := parseTagOptions(v.Type().FieldByIndex(idx)).Has("deterministic")
+		aad := fieldAAD(kind, propertyName(v.Type(), idx))
+		if field.Kind() == reflect.String {
+			enc, err := encryptValue(ctx, []byte(field.String()), deterministic, aad)
+			if err != nil {
+				return nil, err
+			}
+			field.SetString(enc)
+			continue
+		}
+		if field.IsNil() {
+			continue
+		}
+		enc, err := encryptValue(ctx, field.Bytes(), deterministic, aad)
+		if err != nil {
+			return nil, err
+		}
+		field.SetBytes([]byte(enc))
+	}
+	return cp.Interface(), nil
+}
+
+// decryptModel decrypts the encrypted fields of m in place.
+func decryptModel(ctx context.Context, m Model) error {
+	v := reflect.ValueOf(m).Elem()
+	found, err := encryptedFields(v.Type())
+	if err != nil || len(found) == 0 {
+		return err
+	}
+	kind, err := getEntityName(m)
+	if err != nil {
+		return err
+	}
+	for _, idx := range found {
+		field := v.FieldByIndex(idx)
+		aad := fieldAAD(kind, propertyName(v.Type(), idx))
+		if field.Kind() == reflect.String {
+			dec, err := decryptValue(ctx, field.String(), aad)
+			if err != nil {
+				return err
+			}
+			field.SetString(string(dec))
+			continue
+		}
+		if field.IsNil() {
+			continue
+		}
+		dec, err := decryptValue(ctx, string(field.Bytes()), aad)
+		if err != nil {
+			return err
+		}
+		field.SetBytes(dec)
+	}
+	return nil
+}
+
+// deterministicProperty returns true if the property of struct type t is an
+// encrypted field which uses deterministic encryption.
+func deterministicProperty(t reflect.Type, property string) bool {
+	for _, idx := range fieldsWithOption(t, "deterministic") {
+		if propertyName(t, idx) == property && parseTagOptions(t.FieldByIndex(idx)).Has("encrypt") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package aedstorm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type testEncryptedModel struct {
+	ID     string
+	Email  string `aedstorm:"encrypt,deterministic"`
+	Phone  string `aedstorm:"encrypt"`
+	Secret []byte `aedstorm:"encrypt"`
+	Name   string
+}
+
+func (m *testEncryptedModel) GetID() string {
+	return m.ID
+}
+
+type testBadEncryptedModel struct {
+	ID  string
+	Age int `aedstorm:"encrypt"`
+}
+
+var testKeys = &StaticKeyProvider{
+	Current: "v2",
+	Keys: map[string][]byte{
+		"v1": []byte("0123456789abcdef"),
+		"v2": []byte("0123456789abcdef0123456789abcdef"),
+	},
+}
+
+func withTestKeys() func() {
+	old := keyProvider
+	SetKeyProvider(testKeys)
+	return func() {
+		SetKeyProvider(old)
+	}
+}
+
+var testAAD = fieldAAD("testEncryptedModel", "Email")
+
+func TestEncryptNoKeyProvider(t *testing.T) {
+	old := keyProvider
+	defer SetKeyProvider(old)
+	SetKeyProvider(nil)
+	_, err := encryptValue(context.Background(), []byte("foo"), false, nil)
+	assert.Equal(t, ErrNoKeyProvider, err)
+}
+
+func TestEncryptDecryptValue(t *testing.T) {
+	defer withTestKeys()()
+	c := context.Background()
+
+	enc, err := encryptValue(c, []byte("foo@example.com"), false, testAAD)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(enc, "enc:v2:"))
+	enc2, err := encryptValue(c, []byte("foo@example.com"), false, testAAD)
+	assert.NoError(t, err)
+	assert.NotEqual(t, enc, enc2)
+
+	dec, err := decryptValue(c, enc, testAAD)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo@example.com", string(dec))
+}
+
+func TestEncryptDeterministic(t *testing.T) {
+	defer withTestKeys()()
+	c := context.Background()
+	enc, err := encryptValue(c, []byte("foo@example.com"), true, testAAD)
+	assert.NoError(t, err)
+	enc2, err := encryptValue(c, []byte("foo@example.com"), true, testAAD)
+	assert.NoError(t, err)
+	assert.Equal(t, enc, enc2)
+}
+
+func TestEncryptBindsField(t *testing.T) {
+	defer withTestKeys()()
+	c := context.Background()
+	enc, err := encryptValue(c, []byte("foo@example.com"), true, testAAD)
+	assert.NoError(t, err)
+
+	// Ciphertexts can't be moved to another property or kind
+	_, err = decryptValue(c, enc, fieldAAD("testEncryptedModel", "Phone"))
+	assert.Error(t, err)
+	_, err = decryptValue(c, enc, fieldAAD("otherModel", "Email"))
+	assert.Error(t, err)
+
+	// Equal values of different fields don't have the same ciphertext
+	other, err := encryptValue(c, []byte("foo@example.com"), true, fieldAAD("testEncryptedModel", "Phone"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, enc, other)
+}
+
+func TestDeriveKey(t *testing.T) {
+	key := testKeys.Keys["v2"]
+	enc, nonce := deriveKey(key, "encryption"), deriveKey(key, "nonce")
+	assert.Len(t, enc, len(key))
+	assert.NotEqual(t, key, enc)
+	assert.NotEqual(t, enc, nonce)
+	assert.Equal(t, enc, deriveKey(key, "encryption"))
+}
+
+func TestDecryptRotatedKey(t *testing.T) {
+	defer withTestKeys()()
+	c := context.Background()
+	testKeys.Current = "v1"
+	enc, err := encryptValue(c, []byte("old"), false, testAAD)
+	testKeys.Current = "v2"
+	assert.NoError(t, err)
+	dec, err := decryptValue(c, enc, testAAD)
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(dec))
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	defer withTestKeys()()
+	c := context.Background()
+	dec, err := decryptValue(c, "plain text", testAAD)
+	assert.NoError(t, err)
+	assert.Equal(t, "plain text", string(dec))
+
+	_, err = decryptValue(c, "enc:v2", testAAD)
+	assert.Equal(t, ErrInvalidEncrypted, err)
+	_, err = decryptValue(c, "enc:v2:!!!", testAAD)
+	assert.Equal(t, ErrInvalidEncrypted, err)
+	_, err = decryptValue(c, "enc:v3:AAAA", testAAD)
+	assert.EqualError(t, err, `Unknown encryption key "v3"`)
+}
+
+func TestEncryptModel(t *testing.T) {
+	defer withTestKeys()()
+	c := context.Background()
+	tm := &testEncryptedModel{Email: "foo@example.com", Phone: "555-1234", Secret: []byte("s3cr3t"), Name: "Foo"}
+	enc, err := encryptModel(c, tm)
+	assert.NoError(t, err)
+
+	em := enc.(*testEncryptedModel)
+	assert.Equal(t, "foo@example.com", tm.Email)
+	assert.True(t, strings.HasPrefix(em.Email, encryptedPrefix))
+	assert.True(t, strings.HasPrefix(em.Phone, encryptedPrefix))
+	assert.True(t, strings.HasPrefix(string(em.Secret), encryptedPrefix))
+	assert.Equal(t, "Foo", em.Name)
+
+	assert.NoError(t, decryptModel(c, em))
+	assert.Equal(t, tm, em)
+}
+
+func TestEncryptModelWithoutFields(t *testing.T) {
+	tm := &testModel{}
+	enc, err := encryptModel(context.Background(), tm)
+	assert.NoError(t, err)
+	assert.True(t, tm == enc)
+}
+
+func TestEncryptModelInvalidField(t *testing.T) {
+	_, err := encryptModel(context.Background(), &testBadEncryptedModel{})
+	assert.EqualError(t, err, "Encrypted field Age of type testBadEncryptedModel must be a string or []byte")
+}
+
+func TestDeterministicProperty(t *testing.T) {
+	typ := reflect.TypeOf(testEncryptedModel{})
+	assert.True(t, deterministicProperty(typ, "Email"))
+	assert.False(t, deterministicProperty(typ, "Phone"))
+	assert.False(t, deterministicProperty(typ, "Name"))
+}
+
+func TestQueryEncryptedFilter(t *testing.T) {
+	q := NewQuery(&testEncryptedModel{}).Filter("Email =", "foo@example.com")
+	assert.Len(t, q.encryptedFilters, 1)
+	q = NewQuery(&testEncryptedModel{}).Filter("Name =", "Foo")
+	assert.Len(t, q.encryptedFilters, 0)
+}
+
+func TestSaveEncrypted(t *testing.T) {
+	defer withTestKeys()()
+	tm := &testEncryptedModel{Email: "foo@example.com", Phone: "555-1234"}
+	dm := NewModel(tm).WithContext(ctx)
+	assert.NoError(t, dm.Save())
+	assert.Equal(t, "foo@example.com", tm.Email)
+
+	var found []testEncryptedModel
+	_, err := NewQuery(&testEncryptedModel{}).Filter("Email =", "foo@example.com").GetAll(ctx, &found)
+	assert.NoError(t, err)
+
+	loaded := &testEncryptedModel{ID: tm.ID}
+	assert.NoError(t, NewModel(loaded).WithContext(ctx).Load())
+	assert.Equal(t, "555-1234", loaded.Phone)
+}
+
+func TestQueryEncryptedEmptyString(t *testing.T) {
+	defer withTestKeys()()
+	mctx := NewMemoryContext(context.Background())
+	assert.NoError(t, NewModel(&testEncryptedModel{ID: "a", Email: "foo@example.com"}).WithContext(mctx).Save())
+	assert.NoError(t, NewModel(&testEncryptedModel{ID: "b"}).WithContext(mctx).Save())
+
+	var found []testEncryptedModel
+	_, err := NewQuery(&testEncryptedModel{}).Filter("Email =", "").GetAll(mctx, &found)
+	assert.NoError(t, err)
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, "b", found[0].ID)
+		assert.Equal(t, "", found[0].Email)
+	}
+}
@@ -0,0 +1,115 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrNotFound is returned by First() when the query has no results
+type ErrNotFound struct {
+	Kind string
+}
+
+func (e *ErrNotFound) Error() string {
+	return fmt.Sprintf("No %s entity matches the query", e.Kind)
+}
+
+// IsNotFound returns true if err is an *ErrNotFound or
+// datastore.ErrNoSuchEntity, so a missing entity is handled the same way for
+// queries and models.
+func IsNotFound(err error) bool {
+	if _, ok := err.(*ErrNotFound); ok {
+		return true
+	}
+	return err == datastore.ErrNoSuchEntity
+}
+
+// First loads the first result of the query into dst, which is a struct
+// pointer or a *datastore.PropertyList, and returns its key. dst can be nil
+// for keys only queries. If there are no results, an *ErrNotFound is
+// returned. The query itself isn't changed.
+func (q *Query) First(ctx context.Context, dst interface{}) (*datastore.Key, error) {
+	fq := *q
+	fq.Limit(1).mockedBy(mockRegistry)
+	if fq.keysOnly {
+		keys, err := fq.GetAll(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, &ErrNotFound{q.entity}
+		}
+		return keys[0], nil
+	}
+
+	if pl, ok := dst.(*datastore.PropertyList); ok {
+		var lists []datastore.PropertyList
+		keys, err := fq.GetAll(ctx, &lists)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, &ErrNotFound{q.entity}
+		}
+		*pl = lists[0]
+		return keys[0], nil
+	}
+
+	t := reflect.TypeOf(dst)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("First needs a struct pointer or a *datastore.PropertyList, not %T", dst)
+	}
+	// Results are loaded into a slice of structs, which is also what mocked
+	// results are set as
+	out := reflect.New(reflect.SliceOf(t.Elem()))
+	keys, err := fq.GetAll(ctx, out.Interface())
+	if err != nil {
+		return nil, err
+	}
+	if out.Elem().Len() == 0 {
+		return nil, &ErrNotFound{q.entity}
+	}
+	reflect.ValueOf(dst).Elem().Set(out.Elem().Index(0))
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return keys[0], nil
+}
+
+// Exists returns true if the query has any results. It runs as a keys only
+// query, so no entities are loaded.
+func (q *Query) Exists(ctx context.Context) (bool, error) {
+	eq := *q
+	keys, err := eq.KeysOnly().Limit(1).mockedBy(mockRegistry).GetAll(ctx, nil)
+	return len(keys) > 0, err
+}
+
+// Exists returns true if the entity is saved. The cache is checked first, and
+// the datastore with a keys only query on the entity's key after that, so the
+// entity isn't loaded. The query is an ancestor query, which is strongly
+// consistent. Like with Load(), soft deleted entities don't exist unless
+// WithDeleted() is used. Models without an ID return ErrNoID.
+func (dm *DataModel) Exists() (bool, error) {
+	if err := dm.verify(); err != nil {
+		return false, err
+	}
+	if !dm.hasID() {
+		return false, ErrNoID
+	}
+
+	t := reflect.TypeOf(dm.model).Elem()
+	cached := reflect.New(t).Interface()
+	if err := cacheGet(dm.Context(), dm.cacheKey(), cached); err == nil {
+		return dm.withDeleted || !NewModel(cached).IsDeleted(), nil
+	}
+
+	key := dm.Key()
+	q := NewQuery(dm.model).Ancestor(key).Filter("__key__ =", key).mockedBy(mockNone)
+	if dm.withDeleted {
+		q = q.WithDeleted()
+	}
+	return q.Exists(dm.Context())
+}
@@ -0,0 +1,130 @@
+package aedstorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestQueryFirst(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	var m testMemoryModel
+	q := NewQuery(&testMemoryModel{}).Filter("Age <", 30).Order("Name")
+	key, err := q.First(mctx, &m)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", key.StringID())
+	assert.Equal(t, "bob", m.Name)
+
+	// The query itself isn't limited
+	var all []testMemoryModel
+	_, err = q.GetAll(mctx, &all)
+	assert.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	var props datastore.PropertyList
+	key, err = NewQuery(&testMemoryModel{}).Order("-Age").First(mctx, &props)
+	assert.NoError(t, err)
+	assert.Equal(t, "c", key.StringID())
+	assert.NotEmpty(t, props)
+
+	key, err = NewQuery(&testMemoryModel{}).Order("Age").KeysOnly().First(mctx, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, []string{"b", "d"}, key.StringID())
+
+	_, err = NewQuery(&testMemoryModel{}).Filter("Age >", 100).First(mctx, &m)
+	assert.Equal(t, &ErrNotFound{"testMemoryModel"}, err)
+	assert.True(t, IsNotFound(err))
+
+	_, err = NewQuery(&testMemoryModel{}).First(mctx, []testMemoryModel{})
+	assert.Error(t, err)
+}
+
+func TestQueryFirstMocked(t *testing.T) {
+	m := NewMock()
+	m.Expect(&testMemoryModel{}).Return([]testMemoryModel{{ID: "a", Name: "alice"}}, nil, nil)
+	mctx := WithMock(context.Background(), m)
+
+	var out testMemoryModel
+	_, err := NewQuery(&testMemoryModel{}).First(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", out.Name)
+	m.Verify(t)
+}
+
+func TestQueryExists(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	ok, err := NewQuery(&testMemoryModel{}).Filter("Name =", "carol").Exists(mctx)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = NewQuery(&testMemoryModel{}).Filter("Name =", "nobody").Exists(mctx)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestModelExists(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	ok, err := NewModel(&testMemoryModel{ID: "a"}).WithContext(mctx).Exists()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Without the cache, the entity is looked up with a keys only query, which
+	// mocks don't answer since aedstorm runs it itself
+	assert.NoError(t, NewModel(&testMemoryModel{ID: "a"}).WithContext(mctx).Uncache())
+	mock := NewMock()
+	ok, err = NewModel(&testMemoryModel{ID: "a"}).WithContext(WithMock(mctx, mock)).Exists()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	mock.Verify(t)
+
+	ok, err = NewModel(&testMemoryModel{ID: "missing"}).WithContext(mctx).Exists()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = NewModel(&testMemoryModel{ID: "a"}).Exists()
+	assert.Equal(t, ErrNoContext, err)
+}
+
+func TestModelExistsWithoutID(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	m := &testMemoryModel{}
+	ok, err := NewModel(m).WithContext(mctx).Exists()
+	assert.Equal(t, ErrNoID, err)
+	assert.False(t, ok)
+	assert.Empty(t, m.ID)
+}
+
+func TestModelExistsSoftDeleted(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	m := &testSoftDeleteModel{ID: "a"}
+	assert.NoError(t, NewModel(m).WithContext(mctx).Save())
+	assert.NoError(t, NewModel(m).WithContext(mctx).Delete())
+
+	ok, err := NewModel(&testSoftDeleteModel{ID: "a"}).WithContext(mctx).Exists()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = NewModel(&testSoftDeleteModel{ID: "a"}).WithContext(mctx).WithDeleted().Exists()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.NoError(t, NewModel(&testSoftDeleteModel{ID: "a"}).WithContext(mctx).Uncache())
+	ok, err = NewModel(&testSoftDeleteModel{ID: "a"}).WithContext(mctx).Exists()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = NewModel(&testSoftDeleteModel{ID: "a"}).WithContext(mctx).WithDeleted().Exists()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestIsNotFound(t *testing.T) {
+	assert.True(t, IsNotFound(datastore.ErrNoSuchEntity))
+	assert.True(t, IsNotFound(&ErrNotFound{"Kind"}))
+	assert.False(t, IsNotFound(datastore.ErrInvalidKey))
+	assert.False(t, IsNotFound(nil))
+}
@@ -0,0 +1,183 @@
+package aedstorm
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strconv"
+	"sync"
+
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	typeOfUUID   = reflect.TypeOf(UUID{})
+	typeOfKeyPtr = reflect.TypeOf(&datastore.Key{})
+
+	// deprecatedIDTagWarned holds the types which were already warned about using the deprecated ID tag
+	deprecatedIDTagWarned sync.Map
+)
+
+// isIDTagged returns true if the field is explicitly marked as the ID field,
+// either with `aedstorm:"id"` or the deprecated `datastore:"id"`.
+func isIDTagged(field reflect.StructField) bool {
+	return parseTagOptions(field).Has("id") || isDeprecatedIDTagged(field)
+}
+
+func isDeprecatedIDTagged(field reflect.StructField) bool {
+	return field.Tag.Get(TagName) == "id"
+}
+
+// warnDeprecatedIDTag logs a warning the first time a type with a
+// `datastore:"id"` ID field is used, since that also renames the property.
+func warnDeprecatedIDTag(t reflect.Type, field reflect.StructField) {
+	if !isDeprecatedIDTagged(field) || parseTagOptions(field).Has("id") {
+		return
+	}
+	if _, warned := deprecatedIDTagWarned.LoadOrStore(t, true); !warned {
+		log.Printf("aedstorm: field %s of type %s uses the deprecated `datastore:\"id\"` tag, which also stores it as \"id\". Use `aedstorm:\"id\"` instead.", field.Name, t.Name())
+	}
+}
+
+// findIDField returns the struct field of type t which serves as an ID. Fields
+// tagged as the ID take precedence over fields named ID, and fields of
+// embedded structs are searched too, with shallower fields hiding deeper ones
+// the same way Go does. If no field is found, ok is false. An error is
+// returned if the ID field is ambiguous or has an unsupported type.
+func findIDField(t reflect.Type) (field reflect.StructField, ok bool, err error) {
+	for _, match := range []func(reflect.StructField) bool{
+		isIDTagged,
+		func(f reflect.StructField) bool { return f.Name == "ID" },
+	} {
+		level := []reflect.StructField{{Type: t}}
+		for len(level) > 0 {
+			var found, next []reflect.StructField
+			for _, parent := range level {
+				for i := 0; i < parent.Type.NumField(); i++ {
+					f := parent.Type.Field(i)
+					f.Index = append(append([]int{}, parent.Index...), i)
+					if f.Anonymous && f.Type.Kind() == reflect.Struct {
+						next = append(next, f)
+						continue
+					}
+					if f.PkgPath == "" && match(f) {
+						found = append(found, f)
+					}
+				}
+			}
+			if len(found) > 1 {
+				return field, false, fmt.Errorf("Type %s has more than one ID field: %s and %s", t.Name(), found[0].Name, found[1].Name)
+			}
+			if len(found) == 1 {
+				warnDeprecatedIDTag(t, found[0])
+				return found[0], true, checkIDFieldType(t, found[0])
+			}
+			level = next
+		}
+	}
+	return field, false, nil
+}
+
+// checkIDFieldType makes sure the ID field has one of the supported types
+func checkIDFieldType(t reflect.Type, field reflect.StructField) error {
+	switch field.Type {
+	case typeOfUUID, typeOfKeyPtr:
+		return nil
+	}
+	switch field.Type.Kind() {
+	case reflect.String, reflect.Int64:
+		return nil
+	}
+	return fmt.Errorf("ID field %s of type %s must be a string, int64, UUID or *datastore.Key", field.Name, t.Name())
+}
+
+// idString returns the string form of the ID field value v, or an empty
+// string if it isn't set.
+func idString(v reflect.Value) string {
+	switch id := v.Interface().(type) {
+	case UUID:
+		if id == (UUID{}) {
+			return ""
+		}
+		return id.String()
+	case *datastore.Key:
+		if id == nil {
+			return ""
+		}
+		if id.StringID() != "" {
+			return id.StringID()
+		}
+		return strconv.FormatInt(id.IntID(), 10)
+	}
+	if v.Kind() == reflect.Int64 {
+		if v.Int() == 0 {
+			return ""
+		}
+		return strconv.FormatInt(v.Int(), 10)
+	}
+	return v.String()
+}
+
+// idValue returns the value of the model's ID field, if it has a valid one.
+func (dm *DataModel) idValue() (reflect.Value, bool) {
+	field, ok, err := findIDField(reflect.TypeOf(dm.model).Elem())
+	if !ok || err != nil {
+		return reflect.Value{}, false
+	}
+	return reflect.ValueOf(dm.model).Elem().FieldByIndex(field.Index), true
+}
+
+// newID generates a new ID for the model and stores it in the ID field. Int64
+// IDs are allocated by the datastore, whose error is returned, all others are
+// random UUIDs.
+func (dm *DataModel) newID() (string, error) {
+	v, ok := dm.idValue()
+	if ok && v.Kind() == reflect.Int64 {
+		id, err := getDriver(dm.Context()).AllocateID(dm.Context(), dm.getEntityName(), nil)
+		if err != nil {
+			return "", err
+		}
+		v.SetInt(id)
+		return strconv.FormatInt(id, 10), nil
+	}
+
+	uuid, err := NewUUID()
+	if err != nil {
+		panic(err)
+	}
+	if !ok {
+		return uuid.String(), nil
+	}
+
+	switch v.Type() {
+	case typeOfUUID:
+		v.Set(reflect.ValueOf(*uuid))
+	case typeOfKeyPtr:
+		v.Set(reflect.ValueOf(NewKey(dm.Context(), dm.getEntityName(), uuid.String(), 0, nil)))
+	default:
+		v.SetString(uuid.String())
+	}
+	return uuid.String(), nil
+}
+
+// ensureID makes sure the model has an ID, and returns the error of
+// allocating one if that failed.
+func (dm *DataModel) ensureID() error {
+	dm.idErr = nil
+	if dm.ID() == "" && dm.idErr != nil {
+		return dm.idErr
+	}
+	return nil
+}
+
+// hasID reports whether the model already has an ID, without generating one
+func (dm *DataModel) hasID() bool {
+	if dm.uid != "" {
+		return true
+	}
+	if obj, ok := dm.model.(EntityID); ok && obj.GetID() != "" {
+		return true
+	}
+	v, ok := dm.idValue()
+	return ok && idString(v) != ""
+}
@@ -0,0 +1,222 @@
+package aedstorm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type testIDBase struct {
+	ID string
+}
+
+type testModelWithEmbeddedID struct {
+	testIDBase
+	Name string
+}
+
+type testModelWithShadowedID struct {
+	testIDBase
+	ID int64
+}
+
+type testModelWithTaggedEmbeddedID struct {
+	testIDBase
+	Email string `datastore:"id"`
+}
+
+type testIDBase2 struct {
+	ID string
+}
+
+type testModelWithAmbiguousID struct {
+	testIDBase
+	testIDBase2
+}
+
+type testModelWithInvalidID struct {
+	ID float64
+}
+
+type testModelWithUUID struct {
+	ID UUID
+}
+
+type testModelWithKeyID struct {
+	ID *datastore.Key
+}
+
+func TestFindIDFieldEmbedded(t *testing.T) {
+	field, ok, err := findIDField(reflect.TypeOf(testModelWithEmbeddedID{}))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []int{0, 0}, field.Index)
+}
+
+func TestFindIDFieldShadowed(t *testing.T) {
+	field, ok, err := findIDField(reflect.TypeOf(testModelWithShadowedID{}))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []int{1}, field.Index)
+}
+
+func TestFindIDFieldTagPrecedence(t *testing.T) {
+	field, ok, err := findIDField(reflect.TypeOf(testModelWithTaggedEmbeddedID{}))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "Email", field.Name)
+}
+
+func TestFindIDFieldAmbiguous(t *testing.T) {
+	_, _, err := findIDField(reflect.TypeOf(testModelWithAmbiguousID{}))
+	assert.EqualError(t, err, "Type testModelWithAmbiguousID has more than one ID field: ID and ID")
+
+	dm := NewModel(&testModelWithAmbiguousID{}).WithContext(ctx)
+	assert.EqualError(t, dm.verify(), "Type testModelWithAmbiguousID has more than one ID field: ID and ID")
+}
+
+func TestFindIDFieldInvalidType(t *testing.T) {
+	_, _, err := findIDField(reflect.TypeOf(testModelWithInvalidID{}))
+	assert.EqualError(t, err, "ID field ID of type testModelWithInvalidID must be a string, int64, UUID or *datastore.Key")
+	assert.NotPanics(t, func() {
+		NewModel(&testModelWithInvalidID{}).ID()
+	})
+}
+
+func TestFindIDFieldMissing(t *testing.T) {
+	_, ok, err := findIDField(reflect.TypeOf(testModelWithNoID{}))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestIDFromField(t *testing.T) {
+	tm := &testModelWithEmbeddedID{testIDBase{ID: "foo"}, "bar"}
+	assert.Equal(t, "foo", NewModel(tm).ID())
+}
+
+func TestIDSetsEmbeddedField(t *testing.T) {
+	tm := &testModelWithEmbeddedID{}
+	id := NewModel(tm).ID()
+	assert.NotEmpty(t, id)
+	assert.Equal(t, id, tm.ID)
+}
+
+func TestIDWithUUID(t *testing.T) {
+	tm := &testModelWithUUID{}
+	id := NewModel(tm).ID()
+	assert.Len(t, id, 36)
+	assert.Equal(t, id, tm.ID.String())
+	assert.Equal(t, id, NewModel(&testModelWithUUID{ID: tm.ID}).ID())
+}
+
+func TestIDWithInt64(t *testing.T) {
+	tm := &testModelWithShadowedID{ID: 42}
+	dm := NewModel(tm).WithContext(ctx)
+	assert.Equal(t, "42", dm.ID())
+	assert.Equal(t, int64(42), dm.Key().IntID())
+	assert.Equal(t, "", dm.Key().StringID())
+}
+
+func TestIDWithInt64Allocated(t *testing.T) {
+	tm := &testModelWithShadowedID{}
+	dm := NewModel(tm).WithContext(ctx)
+	assert.NotEmpty(t, dm.ID())
+	assert.NotZero(t, tm.ID)
+	assert.NoError(t, dm.Save())
+}
+
+func TestIDWithKey(t *testing.T) {
+	k := datastore.NewKey(ctx, "testModelWithKeyID", "foo", 0, nil)
+	tm := &testModelWithKeyID{ID: k}
+	dm := NewModel(tm).WithContext(ctx)
+	assert.Equal(t, "foo", dm.ID())
+	assert.True(t, k.Equal(dm.Key()))
+
+	tm = &testModelWithKeyID{}
+	dm = NewModel(tm).WithContext(ctx)
+	assert.NotEmpty(t, dm.ID())
+	assert.Equal(t, dm.ID(), tm.ID.StringID())
+}
+
+type testModelWithAedstormIDTag struct {
+	Email string `aedstorm:"id"`
+	Name  string
+}
+
+func TestFindIDFieldAedstormTag(t *testing.T) {
+	field, ok, err := findIDField(reflect.TypeOf(testModelWithAedstormIDTag{}))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "Email", field.Name)
+}
+
+func TestAedstormIDTagKeepsPropertyName(t *testing.T) {
+	props, err := datastore.SaveStruct(&testModelWithAedstormIDTag{Email: "foo@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Email", props[0].Name)
+
+	props, err = datastore.SaveStruct(&testModelWithIDTag{Email: "foo@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "id", props[0].Name)
+}
+
+func TestDeprecatedIDTagWarning(t *testing.T) {
+	typ := reflect.TypeOf(testModelWithIDTag{})
+	deprecatedIDTagWarned.Delete(typ)
+	_, _, err := findIDField(typ)
+	assert.NoError(t, err)
+	_, warned := deprecatedIDTagWarned.Load(typ)
+	assert.True(t, warned)
+
+	typ = reflect.TypeOf(testModelWithAedstormIDTag{})
+	_, _, err = findIDField(typ)
+	assert.NoError(t, err)
+	_, warned = deprecatedIDTagWarned.Load(typ)
+	assert.False(t, warned)
+}
+
+type testUserID int64
+
+type testModelWithNamedIntID struct {
+	ID   testUserID
+	Name string
+}
+
+func TestKeyWithNamedIntID(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	k := NewModel(&testModelWithNamedIntID{ID: 5}).WithContext(mctx).Key()
+	assert.Equal(t, int64(5), k.IntID())
+	assert.Equal(t, "", k.StringID())
+
+	tm := &testModelWithNamedIntID{Name: "foo"}
+	assert.NoError(t, NewModel(tm).WithContext(mctx).Save())
+	assert.NotZero(t, tm.ID)
+	loaded := &testModelWithNamedIntID{ID: tm.ID}
+	assert.NoError(t, NewModel(loaded).WithContext(mctx).Load())
+	assert.Equal(t, "foo", loaded.Name)
+}
+
+// testAllocateErrDriver fails to allocate IDs
+type testAllocateErrDriver struct {
+	driver.Driver
+}
+
+func (testAllocateErrDriver) AllocateID(ctx context.Context, kind string, parent *datastore.Key) (int64, error) {
+	return 0, errors.New("allocate failed")
+}
+
+func TestSaveAllocateIDError(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	mctx = withDriver(mctx, testAllocateErrDriver{getDriver(mctx)})
+
+	tm := &testModelWithShadowedID{}
+	dm := NewModel(tm).WithContext(mctx)
+	assert.Equal(t, "", dm.ID())
+	assert.EqualError(t, dm.Save(), "allocate failed")
+	assert.Zero(t, tm.ID)
+}
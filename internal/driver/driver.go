@@ -0,0 +1,155 @@
+// Package driver is the interface between aedstorm and the datastores it
+// runs on. It's internal, so the drivers of aedstorm are the only ones: the
+// datastore of App Engine, the in-memory driver and the record and replay
+// drivers of the aedstorm package, and the Cloud Datastore driver of the
+// clouddatastore package.
+package driver
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrInvalidCursor is returned when a cursor wasn't created by the driver it's used with
+var ErrInvalidCursor = errors.New("Cursor isn't one of the driver")
+
+// Driver is where entities are read from and written to.
+//
+// Keys and entities are always those of the App Engine datastore package, so
+// models work the same with any driver. Drivers which don't run on App Engine
+// create their keys with MakeKey(). Cursors are opaque strings which only
+// mean something to the driver which returned them; drivers return
+// ErrInvalidCursor for those they can't decode. Errors of GetMulti, PutMulti
+// and DeleteMulti are appengine.MultiError values when single entities fail,
+// and missing entities are datastore.ErrNoSuchEntity.
+type Driver interface {
+	NewKey(ctx context.Context, kind, stringID string, intID int64, parent *datastore.Key) *datastore.Key
+	AllocateID(ctx context.Context, kind string, parent *datastore.Key) (int64, error)
+	GetMulti(ctx context.Context, keys []*datastore.Key, dst []datastore.PropertyList) error
+	PutMulti(ctx context.Context, keys []*datastore.Key, src []datastore.PropertyList) ([]*datastore.Key, error)
+	DeleteMulti(ctx context.Context, keys []*datastore.Key) error
+	RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error
+	Run(ctx context.Context, q *Query) Iterator
+	Count(ctx context.Context, q *Query) (int, error)
+}
+
+// Iterator is the result of running a query on a driver. It returns
+// datastore.Done when there are no more results. For keys only queries, dst is
+// left untouched.
+type Iterator interface {
+	Next(dst *datastore.PropertyList) (*datastore.Key, error)
+	Cursor() (string, error)
+}
+
+// Query is a query as it's run on a driver, with the soft delete, encrypted
+// and disjunction filters of the aedstorm query already applied.
+type Query struct {
+	Kind       string
+	Ancestor   *datastore.Key
+	Filters    []Filter
+	Orders     []string
+	Projection []string
+	Distinct   bool
+	DistinctOn []string
+	KeysOnly   bool
+	// Limit is the maximum number of results, a negative value means unlimited
+	Limit  int
+	Offset int
+	// Start and End are cursors of the driver, empty for none
+	Start               string
+	End                 string
+	EventualConsistency bool
+	BatchSize           int
+}
+
+// WithFilter returns a copy of the query with the filter added
+func (q *Query) WithFilter(filterStr string, value interface{}) *Query {
+	c := *q
+	c.Filters = append(append([]Filter(nil), q.Filters...), Filter{filterStr, value})
+	return &c
+}
+
+// Filter is a filter of a Query, like "Age >=", which only ever has one of
+// the =, <, <=, > and >= operators.
+type Filter struct {
+	Filter string
+	Value  interface{}
+}
+
+// Property returns the property name and operator of the filter
+func (f Filter) Property() (name, op string, err error) {
+	return SplitFilter(f.Filter)
+}
+
+// SplitFilter returns the property name and operator of a filter string, the
+// same way the datastore parses them.
+func SplitFilter(filterStr string) (string, string, error) {
+	filterStr = strings.TrimSpace(filterStr)
+	name := strings.TrimRight(filterStr, " ><=!")
+	switch op := strings.TrimSpace(filterStr[len(name):]); op {
+	case "<=", ">=", "<", ">", "=":
+		if name != "" {
+			return name, op, nil
+		}
+	}
+	return "", "", fmt.Errorf("Invalid filter %q", filterStr)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context whose models and queries use the driver
+func NewContext(ctx context.Context, d Driver) context.Context {
+	return context.WithValue(ctx, contextKey{}, d)
+}
+
+// FromContext returns the driver of the context, if it has one
+func FromContext(ctx context.Context) (Driver, bool) {
+	d, ok := ctx.Value(contextKey{}).(Driver)
+	return d, ok
+}
+
+// gobKey has the fields of the gob encoding of *datastore.Key. Keys of the
+// datastore package are otherwise only created by datastore.NewKey(), which
+// takes the app ID from an App Engine context, so drivers running elsewhere
+// create them by decoding their gob encoding with Key.GobDecode().
+type gobKey struct {
+	Kind      string
+	StringID  string
+	IntID     int64
+	Parent    *gobKey
+	AppID     string
+	Namespace string
+}
+
+func toGobKey(k *datastore.Key) *gobKey {
+	if k == nil {
+		return nil
+	}
+	return &gobKey{k.Kind(), k.StringID(), k.IntID(), toGobKey(k.Parent()), k.AppID(), k.Namespace()}
+}
+
+// MakeKey returns a key with the given app ID and namespace, which unlike
+// datastore.NewKey() doesn't need an App Engine context. Keys with a parent
+// take the app ID and namespace of the parent.
+func MakeKey(appID, namespace, kind, stringID string, intID int64, parent *datastore.Key) *datastore.Key {
+	gk := &gobKey{Kind: kind, StringID: stringID, IntID: intID, AppID: appID, Namespace: namespace}
+	if parent != nil {
+		gk.Parent, gk.AppID, gk.Namespace = toGobKey(parent), parent.AppID(), parent.Namespace()
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gk); err != nil {
+		panic(err)
+	}
+	k := new(datastore.Key)
+	if err := k.GobDecode(buf.Bytes()); err != nil {
+		panic(err)
+	}
+	return k
+}
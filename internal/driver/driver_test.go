@@ -0,0 +1,42 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestMakeKey(t *testing.T) {
+	parent := MakeKey("app", "tenant", "Parent", "p", 0, nil)
+	assert.Equal(t, "app", parent.AppID())
+	assert.Equal(t, "tenant", parent.Namespace())
+	assert.Equal(t, "p", parent.StringID())
+
+	k := MakeKey("other", "", "Child", "", 7, parent)
+	assert.Equal(t, "app", k.AppID())
+	assert.Equal(t, "tenant", k.Namespace())
+	assert.Equal(t, int64(7), k.IntID())
+	assert.True(t, k.Parent().Equal(parent))
+
+	decoded, err := datastore.DecodeKey(k.Encode())
+	assert.NoError(t, err)
+	assert.True(t, decoded.Equal(k))
+}
+
+func TestFilterProperty(t *testing.T) {
+	name, op, err := Filter{"Age >=", 30}.Property()
+	assert.NoError(t, err)
+	assert.Equal(t, "Age", name)
+	assert.Equal(t, ">=", op)
+
+	_, _, err = Filter{"Age !=", 30}.Property()
+	assert.Error(t, err)
+}
+
+func TestWithFilter(t *testing.T) {
+	q := &Query{Kind: "Kind", Filters: []Filter{{"Age >=", 30}}}
+	c := q.WithFilter("Name =", "alice")
+	assert.Len(t, q.Filters, 1)
+	assert.Equal(t, []Filter{{"Age >=", 30}, {"Name =", "alice"}}, c.Filters)
+}
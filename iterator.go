@@ -0,0 +1,176 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Iterator is the result of running a query. Results are loaded one at a time
+// as Next() is called, so queries over any number of entities run in constant
+// memory. Iteration can be stopped at any point by not calling Next() again.
+type Iterator struct {
+	q   *Query
+	ctx context.Context
+	it  driver.Iterator
+	err error
+
+	// Set when the results are mocked
+	mocked    bool
+	mockData  reflect.Value
+	mockKeys  []*datastore.Key
+	mockError error
+	mockIndex int
+}
+
+// Run runs the query and returns an iterator over its results. Results are
+// loaded the same way GetAll() loads them, including migrations, decryption
+// and preloading. Queries with in, or and != conditions merge the
+// results of their sub-queries as they're read, keeping only the keys of the
+// results in memory to leave out duplicates.
+func (q *Query) Run(ctx context.Context) *Iterator {
+	t := &Iterator{q: q, ctx: ctx}
+
+	// For purposes of mocking, this allows the results to be set in advance
+	if res, err := q.mocked(ctx); res != nil || err != nil {
+		if err != nil {
+			t.err = err
+			return t
+		}
+		t.mocked = true
+		t.mockData = reflect.Indirect(reflect.ValueOf(res.data))
+		t.mockKeys = res.keys
+		t.mockError = res.err
+		return t
+	}
+
+	// Results of queries with in, or and != conditions are merged from
+	// sub-queries as they're read
+	if len(q.disjunctions) > 0 {
+		t.it, t.err = q.runMerged(ctx, q.keysOnly)
+		return t
+	}
+
+	spec, err := q.query(ctx)
+	if err != nil {
+		t.err = err
+		return t
+	}
+	t.it = getDriver(ctx).Run(ctx, spec)
+	return t
+}
+
+// Next loads the next result into dst and returns its key. It returns
+// datastore.Done when there are no more results, and the error of the context
+// if it's done. For keys only queries, dst can be nil. Like the datastore
+// does, an *datastore.ErrFieldMismatch is returned along with the key if the
+// entity was still loaded.
+func (t *Iterator) Next(dst interface{}) (*datastore.Key, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if err := t.ctx.Err(); err != nil {
+		return nil, err
+	}
+	if t.mocked {
+		return t.nextMock(dst)
+	}
+	if t.q.keysOnly {
+		return t.it.Next(nil)
+	}
+	if pl, ok := dst.(*datastore.PropertyList); ok {
+		return t.it.Next(pl)
+	}
+	if !isModel(dst) {
+		return nil, fmt.Errorf("Query needs a struct pointer or *datastore.PropertyList, not %T", dst)
+	}
+
+	var props datastore.PropertyList
+	key, err := t.it.Next(&props)
+	if err != nil {
+		return nil, err
+	}
+	return key, t.load(key, props, dst)
+}
+
+// load loads the properties of the entity with the given key into dst. Like
+// the datastore does, an *datastore.ErrFieldMismatch is returned if the
+// entity was still loaded.
+func (t *Iterator) load(key *datastore.Key, props datastore.PropertyList, dst Model) error {
+	props, migrated, err := t.q.migrate(t.ctx, dst, props)
+	if err != nil {
+		return err
+	}
+	var mismatch error
+	if err := loadProperties(dst, props); err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			return err
+		}
+		mismatch = err
+	}
+	if err := decryptModel(t.ctx, dst); err != nil {
+		return err
+	}
+	t.q.setLoaded(dst)
+	if migrated && migrationWriteBack(t.q.entity) {
+		if err := putProperties(t.ctx, []*datastore.Key{key}, []datastore.PropertyList{props}); err != nil {
+			return err
+		}
+	}
+	if len(t.q.preloads) > 0 {
+		if err := preload(t.ctx, []reflect.Value{reflect.ValueOf(dst)}, t.q.preloads, t.q.deleted != deletedExclude); err != nil {
+			return err
+		}
+	}
+	return mismatch
+}
+
+// nextMock returns the next of the mocked results, and then the mocked error
+func (t *Iterator) nextMock(dst interface{}) (*datastore.Key, error) {
+	n := len(t.mockKeys)
+	if t.mockData.IsValid() && t.mockData.Kind() == reflect.Slice {
+		n = t.mockData.Len()
+	}
+	if t.mockIndex >= n {
+		if t.mockError != nil {
+			return nil, t.mockError
+		}
+		return nil, datastore.Done
+	}
+	i := t.mockIndex
+	t.mockIndex++
+
+	var key *datastore.Key
+	if i < len(t.mockKeys) {
+		key = t.mockKeys[i]
+	}
+	if dst != nil && t.mockData.IsValid() && t.mockData.Kind() == reflect.Slice {
+		if err := Copy(t.mockData.Index(i).Interface(), dst); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// Cursor returns a cursor for the iterator's current location, which can be
+// passed to Query.Start() to continue from there. Cursors are opaque strings
+// which only work with the driver of the context they were returned by.
+func (t *Iterator) Cursor() (string, error) {
+	if t.err != nil {
+		return "", t.err
+	}
+	if t.mocked {
+		return "", nil
+	}
+	return t.it.Cursor()
+}
+
+// isModel returns true if dst is a pointer to a struct
+func isModel(dst interface{}) bool {
+	t := reflect.TypeOf(dst)
+	return t != nil && t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct
+}
@@ -0,0 +1,92 @@
+package aedstorm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestIteratorMock(t *testing.T) {
+	keys := []*datastore.Key{
+		datastore.NewKey(ctx, "testModel", "foo", 0, nil),
+		datastore.NewKey(ctx, "testModel", "bar", 0, nil),
+	}
+	mock := NewMock()
+	mock.Expect(&testModel{}).Return([]testModel{{ID: "foo"}, {ID: "bar"}}, keys, nil)
+
+	it := NewQuery(&testModel{}).Run(WithMock(ctx, mock))
+
+	var ids []string
+	for {
+		var m testModel
+		key, err := it.Next(&m)
+		if err == datastore.Done {
+			break
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, m.ID, key.StringID())
+		ids = append(ids, m.ID)
+	}
+	assert.Equal(t, []string{"foo", "bar"}, ids)
+
+	_, err := it.Cursor()
+	assert.NoError(t, err)
+	assert.True(t, mock.Verify(t))
+}
+
+func TestIteratorMockError(t *testing.T) {
+	mockErr := errors.New("Mock error")
+	mock := NewMock()
+	mock.Expect(&testModel{}).Return([]testModel{{ID: "foo"}}, nil, mockErr)
+
+	it := NewQuery(&testModel{}).Run(WithMock(ctx, mock))
+	var m testModel
+	_, err := it.Next(&m)
+	assert.NoError(t, err)
+	_, err = it.Next(&m)
+	assert.Equal(t, mockErr, err)
+}
+
+func TestIteratorCancel(t *testing.T) {
+	mock := NewMock()
+	mock.Expect(&testModel{}).Return([]testModel{{ID: "foo"}}, nil, nil)
+
+	cctx, cancel := context.WithCancel(WithMock(ctx, mock))
+	it := NewQuery(&testModel{}).Run(cctx)
+	cancel()
+
+	var m testModel
+	_, err := it.Next(&m)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestIsModel(t *testing.T) {
+	assert.True(t, isModel(&testModel{}))
+	assert.False(t, isModel(testModel{}))
+	assert.False(t, isModel(&datastore.PropertyList{}))
+	assert.False(t, isModel(nil))
+}
+
+func TestIteratorRun(t *testing.T) {
+	for _, id := range []string{"iter-1", "iter-2"} {
+		assert.NoError(t, NewModel(&testAuthor{ID: id, Name: "iterated"}).WithContext(ctx).Save())
+	}
+
+	it := NewQuery(&testAuthor{}).Filter("Name =", "iterated").Run(ctx)
+	var m testAuthor
+	key, err := it.Next(&m)
+	assert.NoError(t, err)
+	assert.Equal(t, m.ID, key.StringID())
+
+	// Stopping early and continuing from the cursor gets the rest
+	c, err := it.Cursor()
+	assert.NoError(t, err)
+	rest := NewQuery(&testAuthor{}).Filter("Name =", "iterated").Start(c).Run(ctx)
+	_, err = rest.Next(&m)
+	assert.NoError(t, err)
+	_, err = rest.Next(&m)
+	assert.Equal(t, datastore.Done, err)
+}
@@ -0,0 +1,680 @@
+package aedstorm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	gocache "github.com/bradberger/gocache/cache"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// MemoryAppID is the app ID of the keys of in-memory stores
+const MemoryAppID = "aedstorm-memory"
+
+var (
+	errNestedTransaction = errors.New("Nested transactions are not supported")
+)
+
+type memoryTxContextKey struct{}
+
+// NewMemoryContext returns a context whose models, queries and cache are kept
+// in a new, empty in-memory store instead of the datastore and memcache of App
+// Engine. It doesn't need an App Engine context, so tests using it run without
+// dev_appserver:
+//
+//	ctx := aedstorm.NewMemoryContext(context.Background())
+//	err := aedstorm.NewModel(&user).WithContext(ctx).Save()
+//
+// Keys of the store are created with NewKey(). Queries support filters,
+// orders, limits, offsets, ancestors, namespaces, projections and cursors.
+// Transactions are serialized, and their writes are applied when they commit.
+// There's no conflict detection, so unlike with the datastore, transactions
+// never fail with datastore.ErrConcurrentTransaction, even when entities they
+// read were written outside of them in the meantime. Like those of the
+// datastore, operations fail once the context is done.
+func NewMemoryContext(ctx context.Context) context.Context {
+	ctx = withDriver(ctx, &memoryDriver{entities: make(map[string]memoryEntity)})
+	return WithCache(ctx, &memoryCache{items: make(map[string][]byte)})
+}
+
+// memoryDriver is a driver which keeps its entities in memory
+type memoryDriver struct {
+	mu       sync.RWMutex
+	txMu     sync.Mutex
+	entities map[string]memoryEntity
+	lastID   int64
+}
+
+type memoryEntity struct {
+	key   *datastore.Key
+	props datastore.PropertyList
+}
+
+// memoryTx holds the writes of a transaction until it commits
+type memoryTx struct {
+	keys   []string
+	writes map[string]*memoryEntity
+}
+
+func (tx *memoryTx) write(k string, e *memoryEntity) {
+	if _, ok := tx.writes[k]; !ok {
+		tx.keys = append(tx.keys, k)
+	}
+	tx.writes[k] = e
+}
+
+func (s *memoryDriver) NewKey(ctx context.Context, kind, stringID string, intID int64, parent *datastore.Key) *datastore.Key {
+	return driver.MakeKey(MemoryAppID, NamespaceFromContext(ctx), kind, stringID, intID, parent)
+}
+
+func (s *memoryDriver) AllocateID(ctx context.Context, kind string, parent *datastore.Key) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if kind == "" {
+		return 0, errors.New("AllocateID needs a kind")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	return s.lastID, nil
+}
+
+func (s *memoryDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst []datastore.PropertyList) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(keys) != len(dst) {
+		return errors.New("Keys and destinations must have the same length")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	merr, failed := make(appengine.MultiError, len(keys)), false
+	for i, k := range keys {
+		if k == nil || k.Incomplete() {
+			merr[i], failed = datastore.ErrInvalidKey, true
+			continue
+		}
+		e, ok := s.entities[k.Encode()]
+		if !ok {
+			merr[i], failed = datastore.ErrNoSuchEntity, true
+			continue
+		}
+		dst[i] = copyProperties(e.props)
+	}
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+func (s *memoryDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src []datastore.PropertyList) ([]*datastore.Key, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) != len(src) {
+		return nil, errors.New("Keys and sources must have the same length")
+	}
+	out := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		if k == nil {
+			return nil, datastore.ErrInvalidKey
+		}
+		if k.Incomplete() {
+			id, err := s.AllocateID(ctx, k.Kind(), k.Parent())
+			if err != nil {
+				return nil, err
+			}
+			k = driver.MakeKey(k.AppID(), k.Namespace(), k.Kind(), "", id, k.Parent())
+		}
+		out[i] = k
+	}
+
+	tx, _ := ctx.Value(memoryTxContextKey{}).(*memoryTx)
+	if tx == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	for i, k := range out {
+		e := memoryEntity{k, normalizeProperties(src[i])}
+		if tx != nil {
+			tx.write(k.Encode(), &e)
+			continue
+		}
+		s.entities[k.Encode()] = e
+	}
+	return out, nil
+}
+
+func (s *memoryDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx, _ := ctx.Value(memoryTxContextKey{}).(*memoryTx)
+	if tx == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	}
+	for _, k := range keys {
+		if k == nil || k.Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+		if tx != nil {
+			tx.write(k.Encode(), nil)
+			continue
+		}
+		delete(s.entities, k.Encode())
+	}
+	return nil
+}
+
+// RunInTransaction runs f with a context whose writes are kept until f
+// returns, and only applied if it returns nil. Reads see the committed state
+// of the store, like those of the datastore don't see the writes of their own
+// transaction. Transactions are serialized with each other but not with
+// writes outside of them, which they don't detect conflicts with.
+func (s *memoryDriver) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Value(memoryTxContextKey{}) != nil {
+		return errNestedTransaction
+	}
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	tx := &memoryTx{writes: make(map[string]*memoryEntity)}
+	if err := f(context.WithValue(ctx, memoryTxContextKey{}, tx)); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range tx.keys {
+		if e := tx.writes[k]; e != nil {
+			s.entities[k] = *e
+		} else {
+			delete(s.entities, k)
+		}
+	}
+	return nil
+}
+
+func (s *memoryDriver) Run(ctx context.Context, spec *driver.Query) driver.Iterator {
+	return s.query(ctx, spec)
+}
+
+func (s *memoryDriver) Count(ctx context.Context, spec *driver.Query) (int, error) {
+	it := s.query(ctx, spec)
+	return len(it.results), it.err
+}
+
+// query returns an iterator over the results of the query spec
+func (s *memoryDriver) query(ctx context.Context, spec *driver.Query) *memoryIterator {
+	if err := ctx.Err(); err != nil {
+		return &memoryIterator{err: err}
+	}
+	type condition struct {
+		name, op string
+		value    interface{}
+	}
+	var (
+		conds      []condition
+		inequality string
+	)
+	for _, f := range spec.Filters {
+		name, op, err := driver.SplitFilter(f.Filter)
+		if err != nil {
+			return &memoryIterator{err: err}
+		}
+		if op != "=" {
+			if inequality != "" && inequality != name {
+				return &memoryIterator{err: fmt.Errorf("Inequality filters on %s and %s aren't supported in a single query", inequality, name)}
+			}
+			inequality = name
+		}
+		conds = append(conds, condition{name, op, normalizeValue(f.Value)})
+	}
+	orders := spec.Orders
+	if len(orders) == 0 && inequality != "" {
+		orders = []string{inequality}
+	}
+	start, err := decodeMemoryCursor(orders, spec.Start)
+	if err != nil {
+		return &memoryIterator{err: err}
+	}
+	end, err := decodeMemoryCursor(orders, spec.End)
+	if err != nil {
+		return &memoryIterator{err: err}
+	}
+
+	var results []mergedResult
+	s.mu.RLock()
+	ns := NamespaceFromContext(ctx)
+	for _, e := range s.entities {
+		k := e.key
+		if (spec.Kind != "" && k.Kind() != spec.Kind) || k.Namespace() != ns {
+			continue
+		}
+		if spec.Ancestor != nil && !k.Equal(spec.Ancestor) && !hasAncestor(k, spec.Ancestor) {
+			continue
+		}
+		matched := true
+		for _, c := range conds {
+			if !matchesFilter(k, e.props, c.name, c.op, c.value) {
+				matched = false
+				break
+			}
+		}
+		for _, o := range orders {
+			if name, _ := parseOrder(o); name != "__key__" && name != "__scatter__" && !hasIndexedValue(e.props, name) {
+				matched = false
+			}
+		}
+		if matched {
+			results = append(results, mergedResult{k, copyProperties(e.props)})
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return compareResults(orders, results[i], results[j]) < 0
+	})
+
+	// Cursors continue after the result they were returned for, wherever it
+	// is now, like those of the datastore
+	if start != nil {
+		results = results[sort.Search(len(results), func(i int) bool {
+			return compareResults(orders, results[i], *start) > 0
+		}):]
+	}
+	if end != nil {
+		results = results[:sort.Search(len(results), func(i int) bool {
+			return compareResults(orders, results[i], *end) > 0
+		})]
+	}
+	positions := make([]mergedResult, len(results))
+	for i, r := range results {
+		positions[i] = memoryPosition(orders, r)
+	}
+	if len(spec.Projection) > 0 {
+		var kept []int
+		results, kept = project(results, spec)
+		for i, j := range kept {
+			positions[i] = positions[j]
+		}
+		positions = positions[:len(kept)]
+	}
+
+	first, last := spec.Offset, len(results)
+	if first > last {
+		first = last
+	}
+	if spec.Limit >= 0 && first+spec.Limit < last {
+		last = first + spec.Limit
+	}
+	it := &memoryIterator{
+		results:   results[first:last],
+		positions: positions[first:last],
+		start:     spec.Start,
+		keysOnly:  spec.KeysOnly,
+	}
+	if first > 0 {
+		it.start, it.err = encodeMemoryCursor(positions[first-1])
+	}
+	if spec.KeysOnly {
+		for i := range it.results {
+			it.results[i].props = nil
+		}
+	}
+	return it
+}
+
+// project replaces the properties of the results with the projected ones,
+// leaving out entities which don't have all of them and the duplicates of
+// distinct queries. Multi-valued properties yield their first indexed value.
+// The indexes of the results which were kept are returned along with them.
+func project(results []mergedResult, spec *driver.Query) ([]mergedResult, []int) {
+	distinctOn := spec.DistinctOn
+	if spec.Distinct && len(distinctOn) == 0 {
+		distinctOn = spec.Projection
+	}
+	var (
+		projected []mergedResult
+		kept      []int
+		seen      = make(map[string]bool)
+	)
+	for i, r := range results {
+		var props datastore.PropertyList
+		for _, name := range spec.Projection {
+			for _, p := range r.props {
+				if p.Name == name && isIndexed(p) {
+					props = append(props, datastore.Property{Name: name, Value: p.Value})
+					break
+				}
+			}
+		}
+		if len(props) < len(spec.Projection) {
+			continue
+		}
+		if len(distinctOn) > 0 {
+			var values []string
+			for _, p := range props {
+				for _, name := range distinctOn {
+					if p.Name == name {
+						values = append(values, valueString(p.Value))
+					}
+				}
+			}
+			id := strings.Join(values, "\x00")
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		projected, kept = append(projected, mergedResult{r.key, props}), append(kept, i)
+	}
+	return projected, kept
+}
+
+// matchesFilter returns true if the entity with the given key and properties
+// has an indexed value of the property which matches the filter. Like in the
+// datastore, values only match values of the same type.
+func matchesFilter(key *datastore.Key, props datastore.PropertyList, name, op string, value interface{}) bool {
+	if name == "__key__" {
+		k, ok := value.(*datastore.Key)
+		return ok && compareOp(compareKeys(key, k), op)
+	}
+	for _, p := range props {
+		if p.Name != name || !isIndexed(p) || valueRank(p.Value) != valueRank(value) {
+			continue
+		}
+		if compareOp(compareValues(p.Value, value), op) {
+			return true
+		}
+	}
+	return false
+}
+
+func compareOp(c int, op string) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return c == 0
+}
+
+// isIndexed returns true if the property can be filtered and sorted on
+func isIndexed(p datastore.Property) bool {
+	_, isBlob := p.Value.([]byte)
+	return !p.NoIndex && !isBlob
+}
+
+func hasIndexedValue(props datastore.PropertyList, name string) bool {
+	for _, p := range props {
+		if p.Name == name && isIndexed(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// scatterValue is the __scatter__ property of the entity with the given key.
+// The datastore sets it on a random sample of entities, and the memory store
+// derives it from a hash of the key, so every entity has one and __scatter__
+// queries return the same sample each time.
+func scatterValue(k *datastore.Key) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(k.Encode()))
+	return int64(h.Sum64() >> 1)
+}
+
+// valueString returns a string which is equal for equal property values
+func valueString(v interface{}) string {
+	if k, ok := v.(*datastore.Key); ok {
+		return "key:" + k.Encode()
+	}
+	if t, ok := v.(time.Time); ok {
+		return "time:" + t.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%T:%v", v, v)
+}
+
+// normalizeValue converts a value to the type the datastore stores it as,
+// and truncates times to microseconds like the datastore does.
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, *datastore.Key, []byte, datastore.ByteString, appengine.GeoPoint:
+		return v
+	case time.Time:
+		micros := v.Unix()*1e6 + int64(v.Nanosecond()/1e3)
+		return time.Unix(micros/1e6, (micros%1e6)*1e3).UTC()
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	}
+	return v
+}
+
+func normalizeProperties(props datastore.PropertyList) datastore.PropertyList {
+	out := copyProperties(props)
+	for i := range out {
+		out[i].Value = normalizeValue(out[i].Value)
+	}
+	return out
+}
+
+// copyProperties returns a copy of the properties which shares no byte slices
+// with them.
+func copyProperties(props datastore.PropertyList) datastore.PropertyList {
+	if props == nil {
+		return nil
+	}
+	out := make(datastore.PropertyList, len(props))
+	copy(out, props)
+	for i, p := range out {
+		switch v := p.Value.(type) {
+		case []byte:
+			out[i].Value = append([]byte(nil), v...)
+		case datastore.ByteString:
+			out[i].Value = append(datastore.ByteString(nil), v...)
+		}
+	}
+	return out
+}
+
+// memoryIterator iterates over the results of a query of an in-memory store
+type memoryIterator struct {
+	results []mergedResult
+	// positions are those of the results in the sort order of the query, and
+	// start is the cursor of the position before the first result
+	positions []mergedResult
+	start     string
+	index     int
+	keysOnly  bool
+	err       error
+}
+
+func (t *memoryIterator) Next(dst *datastore.PropertyList) (*datastore.Key, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.index >= len(t.results) {
+		return nil, datastore.Done
+	}
+	r := t.results[t.index]
+	t.index++
+	if !t.keysOnly && dst != nil {
+		*dst = r.props
+	}
+	return r.key, nil
+}
+
+func (t *memoryIterator) Cursor() (string, error) {
+	if t.err != nil {
+		return "", t.err
+	}
+	if t.index == 0 {
+		return t.start, nil
+	}
+	return encodeMemoryCursor(t.positions[t.index-1])
+}
+
+// memoryCursor is the recorded form of a position in the results of a query.
+// Like the cursors of the datastore, it holds the values a result is sorted
+// by and its key rather than its index, so queries continue after the result
+// even when entities before it were written or deleted since.
+type memoryCursor struct {
+	Values []recordedValue `json:"values,omitempty"`
+	Key    *recordedKey    `json:"key"`
+}
+
+// memoryPosition returns the position of a result in the sort order of a
+// query, which is its key and a property for each of the orders.
+func memoryPosition(orders []string, r mergedResult) mergedResult {
+	pos := mergedResult{key: r.key}
+	for _, o := range orders {
+		name, desc := parseOrder(o)
+		if name == "__key__" || name == "__scatter__" {
+			continue
+		}
+		pos.props = append(pos.props, datastore.Property{Name: name, Value: sortValue(r.props, name, desc)})
+	}
+	return pos
+}
+
+func encodeMemoryCursor(pos mergedResult) (string, error) {
+	c := memoryCursor{Key: recordKey(pos.key)}
+	for _, p := range pos.props {
+		v, err := recordValue(p.Value)
+		if err != nil {
+			return "", err
+		}
+		c.Values = append(c.Values, v)
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeMemoryCursor returns the position held by a cursor of a query with
+// the given orders, or nil for an empty cursor
+func decodeMemoryCursor(orders []string, s string) (*mergedResult, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var c memoryCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Key == nil {
+		return nil, ErrInvalidCursor
+	}
+	pos := &mergedResult{key: c.Key.key()}
+	for _, o := range orders {
+		name, _ := parseOrder(o)
+		if name == "__key__" || name == "__scatter__" {
+			continue
+		}
+		if len(c.Values) == 0 {
+			return nil, ErrInvalidCursor
+		}
+		v, err := c.Values[0].value()
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		pos.props, c.Values = append(pos.props, datastore.Property{Name: name, Value: v}), c.Values[1:]
+	}
+	if len(c.Values) > 0 {
+		return nil, ErrInvalidCursor
+	}
+	return pos, nil
+}
+
+// memoryCache is a cache which keeps gob encoded copies of the values in
+// memory, separately for each namespace. Like memcache, it returns
+// cache.ErrCacheMiss when getting or deleting a missing value.
+type memoryCache struct {
+	mu    sync.RWMutex
+	items map[string][]byte
+}
+
+func memoryCacheKey(ctx context.Context, key string) string {
+	return NamespaceFromContext(ctx) + "\x00" + key
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string, dst interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.RLock()
+	b, ok := c.items[memoryCacheKey(ctx, key)]
+	c.mu.RUnlock()
+	if !ok {
+		return gocache.ErrCacheMiss
+	}
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(dst)
+}
+
+func (c *memoryCache) GetMulti(ctx context.Context, keys []string, dst []interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return multiError(len(keys), func(i int) error {
+		return c.Get(ctx, keys[i], dst[i])
+	})
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[memoryCacheKey(ctx, key)] = buf.Bytes()
+	return nil
+}
+
+func (c *memoryCache) Del(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[memoryCacheKey(ctx, key)]; !ok {
+		return gocache.ErrCacheMiss
+	}
+	delete(c.items, memoryCacheKey(ctx, key))
+	return nil
+}
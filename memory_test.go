@@ -0,0 +1,376 @@
+package aedstorm
+
+import (
+	"testing"
+
+	gocache "github.com/bradberger/gocache/cache"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type testMemoryModel struct {
+	ID   string
+	Name string
+	Age  int
+	Tags []string
+	Blob []byte
+}
+
+func newTestMemoryContext(t *testing.T) context.Context {
+	mctx := NewMemoryContext(context.Background())
+	for _, m := range []*testMemoryModel{
+		{ID: "a", Name: "alice", Age: 30, Tags: []string{"admin", "staff"}},
+		{ID: "b", Name: "bob", Age: 25, Tags: []string{"staff"}},
+		{ID: "c", Name: "carol", Age: 35},
+		{ID: "d", Name: "dave", Age: 25, Tags: []string{"guest"}},
+	} {
+		assert.NoError(t, NewModel(m).WithContext(mctx).Save())
+	}
+	return mctx
+}
+
+func memoryIDs(models []testMemoryModel) []string {
+	var ids []string
+	for _, m := range models {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestMemoryKey(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	parent := NewKey(mctx, "Parent", "p", 0, nil)
+	k := NewKey(mctx, "Child", "", 42, parent)
+	assert.Equal(t, "Child", k.Kind())
+	assert.Equal(t, int64(42), k.IntID())
+	assert.Equal(t, MemoryAppID, k.AppID())
+	assert.True(t, k.Parent().Equal(parent))
+
+	decoded, err := datastore.DecodeKey(k.Encode())
+	assert.NoError(t, err)
+	assert.True(t, decoded.Equal(k))
+
+	nsctx, err := WithNamespace(mctx, "tenant")
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant", NewKey(nsctx, "Kind", "x", 0, nil).Namespace())
+	assert.Equal(t, "tenant", NewKey(mctx, "Kind", "x", 0, NewKey(nsctx, "Parent", "p", 0, nil)).Namespace())
+}
+
+func TestMemoryModel(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	m := &testMemoryModel{ID: "a"}
+	assert.NoError(t, NewModel(m).WithContext(mctx).Load())
+	assert.Equal(t, "alice", m.Name)
+	assert.Equal(t, []string{"admin", "staff"}, m.Tags)
+
+	// Loading from the store instead of the cache gets the same
+	assert.NoError(t, NewModel(m).WithContext(mctx).Uncache())
+	m = &testMemoryModel{ID: "a"}
+	assert.NoError(t, NewModel(m).WithContext(mctx).Load())
+	assert.Equal(t, "alice", m.Name)
+
+	assert.NoError(t, NewModel(m).WithContext(mctx).Delete())
+	assert.Equal(t, datastore.ErrNoSuchEntity, NewModel(&testMemoryModel{ID: "a"}).WithContext(mctx).Load())
+
+	// Stores don't share entities
+	other := NewMemoryContext(context.Background())
+	assert.Equal(t, datastore.ErrNoSuchEntity, NewModel(&testMemoryModel{ID: "b"}).WithContext(other).Load())
+}
+
+func TestMemoryPutIncompleteKey(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	k1, err := driverPut(mctx, NewKey(mctx, "Kind", "", 0, nil), &testMemoryModel{Name: "first"})
+	assert.NoError(t, err)
+	k2, err := driverPut(mctx, NewKey(mctx, "Kind", "", 0, nil), &testMemoryModel{Name: "second"})
+	assert.NoError(t, err)
+	assert.False(t, k1.Incomplete())
+	assert.NotEqual(t, k1.IntID(), k2.IntID())
+
+	var m testMemoryModel
+	assert.NoError(t, driverGet(mctx, k2, &m))
+	assert.Equal(t, "second", m.Name)
+}
+
+func TestMemoryQueryFilters(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	var out []testMemoryModel
+	_, err := NewQuery(&testMemoryModel{}).Filter("Age =", 25).GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "d"}, memoryIDs(out))
+
+	// Multi-valued properties match if any value does
+	out = nil
+	_, err = NewQuery(&testMemoryModel{}).Filter("Tags =", "staff").GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, memoryIDs(out))
+
+	// Inequality filters sort by their property
+	out = nil
+	_, err = NewQuery(&testMemoryModel{}).Filter("Age >=", 30).GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, memoryIDs(out))
+
+	out = nil
+	_, err = NewQuery(&testMemoryModel{}).Where(In("Name", "bob", "carol")).GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, memoryIDs(out))
+
+	keys, err := NewQuery(&testMemoryModel{}).Filter("__key__ >", NewKey(mctx, "testMemoryModel", "b", 0, nil)).KeysOnly().GetAll(mctx, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, "c", keys[0].StringID())
+	}
+
+	// Values of other types and unindexed properties never match
+	n, err := NewQuery(&testMemoryModel{}).Filter("Age =", "25").Count(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = NewQuery(&testMemoryModel{}).Filter("Blob =", []byte{}).Count(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	_, err = NewQuery(&testMemoryModel{}).Filter("Age !", 1).Count(mctx)
+	assert.Error(t, err)
+}
+
+func TestMemoryQueryOrders(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	var out []testMemoryModel
+	_, err := NewQuery(&testMemoryModel{}).Order("Age").Order("-Name").GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d", "b", "a", "c"}, memoryIDs(out))
+
+	// Entities without the property are left out
+	out = nil
+	_, err = NewQuery(&testMemoryModel{}).Order("-Tags").GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "d"}, memoryIDs(out))
+
+	out = nil
+	_, err = NewQuery(&testMemoryModel{}).Order("Age").Offset(1).Limit(2).GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d", "a"}, memoryIDs(out))
+
+	n, err := NewQuery(&testMemoryModel{}).Offset(3).Count(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestMemoryQueryAncestor(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	parent := NewKey(mctx, "testMemoryModel", "parent", 0, nil)
+	for _, k := range []*datastore.Key{
+		parent,
+		NewKey(mctx, "testMemoryModel", "child", 0, parent),
+		NewKey(mctx, "testMemoryModel", "other", 0, nil),
+	} {
+		_, err := driverPut(mctx, k, &testMemoryModel{ID: k.StringID()})
+		assert.NoError(t, err)
+	}
+
+	keys, err := NewQuery(&testMemoryModel{}).Ancestor(parent).KeysOnly().GetAll(mctx, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, "parent", keys[0].StringID())
+		assert.Equal(t, "child", keys[1].StringID())
+	}
+}
+
+func TestMemoryNamespaces(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	nsctx, err := WithNamespace(mctx, "tenant")
+	assert.NoError(t, err)
+
+	assert.NoError(t, NewModel(&testMemoryModel{ID: "a", Name: "default"}).WithContext(mctx).Save())
+	assert.NoError(t, NewModel(&testMemoryModel{ID: "a", Name: "tenant"}).WithContext(nsctx).Save())
+
+	m := &testMemoryModel{ID: "a"}
+	assert.NoError(t, NewModel(m).WithContext(mctx).Load())
+	assert.Equal(t, "default", m.Name)
+	m = &testMemoryModel{ID: "a"}
+	assert.NoError(t, NewModel(m).WithContext(nsctx).Load())
+	assert.Equal(t, "tenant", m.Name)
+
+	var out []testMemoryModel
+	_, err = NewQuery(&testMemoryModel{}).GetAll(nsctx, &out)
+	assert.NoError(t, err)
+	if assert.Len(t, out, 1) {
+		assert.Equal(t, "tenant", out[0].Name)
+	}
+
+	_, err = WithNamespace(mctx, "not valid")
+	assert.Error(t, err)
+}
+
+func TestMemoryCursors(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	it := NewQuery(&testMemoryModel{}).Order("Name").Run(mctx)
+	var m testMemoryModel
+	_, err := it.Next(&m)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", m.ID)
+	c, err := it.Cursor()
+	assert.NoError(t, err)
+
+	var out []testMemoryModel
+	_, err = NewQuery(&testMemoryModel{}).Order("Name").Start(c).Limit(2).GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, memoryIDs(out))
+
+	out = nil
+	_, err = NewQuery(&testMemoryModel{}).Order("Name").End(c).GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, memoryIDs(out))
+
+	// Paging goes through all results
+	var (
+		ids   []string
+		token string
+	)
+	for {
+		var page []testMemoryModel
+		token, err = NewQuery(&testMemoryModel{}).Order("Name").Page(mctx, 3, token, &page)
+		assert.NoError(t, err)
+		ids = append(ids, memoryIDs(page)...)
+		if token == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d"}, ids)
+
+	// Cursors continue after their result when entities before it change
+	assert.NoError(t, NewModel(&testMemoryModel{ID: "a"}).WithContext(mctx).Delete())
+	assert.NoError(t, NewModel(&testMemoryModel{ID: "aa", Name: "aaron"}).WithContext(mctx).Save())
+	out = nil
+	_, err = NewQuery(&testMemoryModel{}).Order("Name").Start(c).GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c", "d"}, memoryIDs(out))
+}
+
+func TestMemoryCursorOffset(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	// The cursor before the first result is after those skipped by the offset
+	it := NewQuery(&testMemoryModel{}).Order("-Age").Offset(1).Run(mctx)
+	c, err := it.Cursor()
+	assert.NoError(t, err)
+	var out []testMemoryModel
+	_, err = NewQuery(&testMemoryModel{}).Order("-Age").Start(c).GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "d"}, memoryIDs(out))
+}
+
+func TestMemoryProjection(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	var out []testMemoryModel
+	_, err := NewQuery(&testMemoryModel{}).Project("Age").Distinct().Order("Age").GetAll(mctx, &out)
+	assert.NoError(t, err)
+	if assert.Len(t, out, 3) {
+		assert.Equal(t, 25, out[0].Age)
+		assert.Empty(t, out[0].Name)
+	}
+}
+
+func TestMemoryTransaction(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	key := NewKey(mctx, "testMemoryModel", "tx", 0, nil)
+
+	err := runInTransaction(mctx, func(tc context.Context) error {
+		if _, err := driverPut(tc, key, &testMemoryModel{Name: "uncommitted"}); err != nil {
+			return err
+		}
+		// Writes aren't visible until the transaction commits
+		assert.Equal(t, datastore.ErrNoSuchEntity, driverGet(tc, key, &testMemoryModel{}))
+		assert.Equal(t, errNestedTransaction, runInTransaction(tc, func(context.Context) error { return nil }, nil))
+		return datastore.ErrConcurrentTransaction
+	}, nil)
+	assert.Equal(t, datastore.ErrConcurrentTransaction, err)
+	assert.Equal(t, datastore.ErrNoSuchEntity, driverGet(mctx, key, &testMemoryModel{}))
+
+	assert.NoError(t, runInTransaction(mctx, func(tc context.Context) error {
+		_, err := driverPut(tc, key, &testMemoryModel{Name: "committed"})
+		return err
+	}, nil))
+	var m testMemoryModel
+	assert.NoError(t, driverGet(mctx, key, &m))
+	assert.Equal(t, "committed", m.Name)
+
+	// Unique fields use transactions
+	assert.NoError(t, NewModel(&testUniqueModel{ID: "1", Email: "memory@example.com"}).WithContext(mctx).Save())
+	err = NewModel(&testUniqueModel{ID: "2", Email: "memory@example.com"}).WithContext(mctx).Save()
+	assert.IsType(t, &ErrUniqueViolation{}, err)
+}
+
+func TestMemoryCache(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	assert.NoError(t, cacheSet(mctx, "key", &testMemoryModel{Name: "cached"}))
+
+	var m testMemoryModel
+	assert.NoError(t, cacheGet(mctx, "key", &m))
+	assert.Equal(t, "cached", m.Name)
+
+	nsctx, err := WithNamespace(mctx, "tenant")
+	assert.NoError(t, err)
+	assert.Error(t, cacheGet(nsctx, "key", &m))
+
+	assert.NoError(t, cacheDel(mctx, "key"))
+	assert.Equal(t, gocache.ErrCacheMiss, cacheGet(mctx, "key", &m))
+	assert.Equal(t, gocache.ErrCacheMiss, cacheDel(mctx, "key"))
+}
+
+func TestMemoryCacheGetMulti(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	assert.NoError(t, cacheSet(mctx, "a", &testMemoryModel{Name: "a"}))
+	assert.NoError(t, cacheSet(mctx, "c", &testMemoryModel{Name: "c"}))
+
+	dst := []interface{}{&testMemoryModel{}, &testMemoryModel{}, &testMemoryModel{}}
+	err := getCache(mctx).GetMulti(mctx, []string{"a", "b", "c"}, dst)
+	assert.Equal(t, appengine.MultiError{nil, gocache.ErrCacheMiss, nil}, err)
+	assert.Equal(t, "a", dst[0].(*testMemoryModel).Name)
+	assert.Equal(t, "c", dst[2].(*testMemoryModel).Name)
+
+	assert.NoError(t, getCache(mctx).GetMulti(mctx, []string{"a"}, dst[:1]))
+}
+
+func TestMemoryCursorDecode(t *testing.T) {
+	orders := []string{"-Age", "__key__"}
+	pos := memoryPosition(orders, mergedResult{NewKey(ctx, "Kind", "a", 0, nil), datastore.PropertyList{
+		{Name: "Age", Value: int64(30)},
+		{Name: "Age", Value: int64(35), Multiple: true},
+	}})
+	c, err := encodeMemoryCursor(pos)
+	assert.NoError(t, err)
+	got, err := decodeMemoryCursor(orders, c)
+	assert.NoError(t, err)
+	assert.True(t, got.key.Equal(pos.key))
+	assert.Equal(t, datastore.PropertyList{{Name: "Age", Value: int64(35)}}, got.props)
+
+	got, err = decodeMemoryCursor(orders, "")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	// Cursors only work with queries with the same orders
+	_, err = decodeMemoryCursor([]string{"Age", "Name"}, c)
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = decodeMemoryCursor(nil, c)
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = decodeMemoryCursor(orders, "not a cursor!")
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestMemoryContextDone(t *testing.T) {
+	mctx, cancel := context.WithCancel(NewMemoryContext(context.Background()))
+	cancel()
+	m := NewModel(&testMemoryModel{ID: "a"}).WithContext(mctx)
+	assert.Equal(t, context.Canceled, m.Save())
+	assert.Equal(t, context.Canceled, m.Load())
+	_, err := NewQuery(&testMemoryModel{}).Count(mctx)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,237 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	gocache "github.com/bradberger/gocache/cache"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// MaxBatchSize is the maximum number of entities the datastore accepts in a single batch operation
+const MaxBatchSize = 500
+
+// MigrationFunc upgrades the properties of a stored entity by one schema version
+type MigrationFunc func(ctx context.Context, props datastore.PropertyList) (datastore.PropertyList, error)
+
+var (
+	migrations          = map[string]map[int]MigrationFunc{}
+	migrationsWriteBack = map[string]bool{}
+	migrationsMu        sync.RWMutex
+)
+
+// RegisterMigration registers fn as the migration of the entities of model m
+// from schema version "from" to version "from+1". Models without a stored
+// version are at version 0.
+func RegisterMigration(m Model, from int, fn MigrationFunc) {
+	entityKind, err := getEntityName(m)
+	if err != nil {
+		panic(err)
+	}
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if migrations[entityKind] == nil {
+		migrations[entityKind] = make(map[int]MigrationFunc)
+	}
+	migrations[entityKind][from] = fn
+}
+
+// SetMigrationWriteBack sets whether entities of model m which were migrated
+// on load are written back to the datastore, so the migration only runs once.
+func SetMigrationWriteBack(m Model, enabled bool) {
+	entityKind, err := getEntityName(m)
+	if err != nil {
+		panic(err)
+	}
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	migrationsWriteBack[entityKind] = enabled
+}
+
+func migrationWriteBack(entityKind string) bool {
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+	return migrationsWriteBack[entityKind]
+}
+
+func getMigration(entityKind string, from int) MigrationFunc {
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+	return migrations[entityKind][from]
+}
+
+// versionField returns the index of the field of struct type t which holds
+// the schema version, which has to be an integer.
+func versionField(t reflect.Type) ([]int, error) {
+	found := fieldsWithOption(t, "version")
+	if len(found) == 0 {
+		return nil, fmt.Errorf("Type %s has no version field", t.Name())
+	}
+	switch field := t.FieldByIndex(found[0]); field.Type.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("Version field %s of type %s must be an integer", field.Name, t.Name())
+	}
+}
+
+// versionProperty returns the name of the property holding the schema version of model m.
+func versionProperty(m Model) (string, error) {
+	t := reflect.TypeOf(m).Elem()
+	idx, err := versionField(t)
+	if err != nil {
+		return "", err
+	}
+	return propertyName(t, idx), nil
+}
+
+// setSchemaVersion stores the current schema version of the model in its version field.
+func setSchemaVersion(m Model) error {
+	obj, ok := m.(SchemaVersion)
+	if !ok {
+		return nil
+	}
+	v := reflect.ValueOf(m).Elem()
+	idx, err := versionField(v.Type())
+	if err != nil {
+		return err
+	}
+	v.FieldByIndex(idx).SetInt(int64(obj.SchemaVersion()))
+	return nil
+}
+
+// migrate runs the registered migrations on props, which hold an entity of
+// model m, up to the current schema version of m. It returns whether any
+// migrations were run.
+func migrate(ctx context.Context, m Model, props datastore.PropertyList) (datastore.PropertyList, bool, error) {
+	obj, ok := m.(SchemaVersion)
+	if !ok {
+		return props, false, nil
+	}
+	entityKind, err := getEntityName(m)
+	if err != nil {
+		return nil, false, err
+	}
+	name, err := versionProperty(m)
+	if err != nil {
+		return nil, false, err
+	}
+
+	stored := 0
+	for _, p := range props {
+		if i, ok := p.Value.(int64); ok && p.Name == name {
+			stored = int(i)
+		}
+	}
+	current := obj.SchemaVersion()
+	if stored >= current {
+		return props, false, nil
+	}
+
+	for v := stored; v < current; v++ {
+		fn := getMigration(entityKind, v)
+		if fn == nil {
+			return nil, false, fmt.Errorf("No migration registered for %s from version %d", entityKind, v)
+		}
+		if props, err = fn(ctx, props); err != nil {
+			return nil, false, err
+		}
+	}
+
+	versionProp := datastore.Property{Name: name, Value: int64(current)}
+	for i := range props {
+		if props[i].Name == name {
+			props[i] = versionProp
+			return props, true, nil
+		}
+	}
+	return append(props, versionProp), true, nil
+}
+
+// isStale returns true if the model, which was loaded from somewhere other
+// than the datastore like the cache, has an older schema version than the
+// current one. The migrations work on the stored properties, which the
+// model no longer has, so stale models have to be loaded from the datastore
+// again.
+func isStale(m Model) (bool, error) {
+	obj, ok := m.(SchemaVersion)
+	if !ok {
+		return false, nil
+	}
+	v := reflect.ValueOf(m).Elem()
+	idx, err := versionField(v.Type())
+	if err != nil {
+		return false, err
+	}
+	return v.FieldByIndex(idx).Int() < int64(obj.SchemaVersion()), nil
+}
+
+// putProperties writes the entities in batches and removes them from cache.
+func putProperties(ctx context.Context, keys []*datastore.Key, lists []datastore.PropertyList) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > MaxBatchSize {
+			n = MaxBatchSize
+		}
+		if _, err := getDriver(ctx).PutMulti(ctx, keys[:n], lists[:n]); err != nil {
+			return err
+		}
+		for _, k := range keys[:n] {
+			if err := cacheDel(ctx, cacheKeyForKey(k)); err != nil && err != gocache.ErrCacheMiss {
+				return err
+			}
+		}
+		keys, lists = keys[n:], lists[n:]
+	}
+	return nil
+}
+
+// MigrateAll runs the migrations of model m on all stored entities of its
+// kind, writing back the upgraded ones. It returns the number of migrated
+// entities.
+func MigrateAll(ctx context.Context, m Model) (int, error) {
+	entityKind, err := getEntityName(m)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		count int
+		keys  []*datastore.Key
+		lists []datastore.PropertyList
+	)
+	it := getDriver(ctx).Run(ctx, &driver.Query{Kind: entityKind, Limit: -1})
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		props, migrated, err := migrate(ctx, m, props)
+		if err != nil {
+			return count, err
+		}
+		if !migrated {
+			continue
+		}
+		keys, lists = append(keys, key), append(lists, props)
+		if len(keys) == MaxBatchSize {
+			if err := putProperties(ctx, keys, lists); err != nil {
+				return count, err
+			}
+			count += len(keys)
+			keys, lists = nil, nil
+		}
+	}
+	if err := putProperties(ctx, keys, lists); err != nil {
+		return count, err
+	}
+	return count + len(keys), nil
+}
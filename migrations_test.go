@@ -0,0 +1,199 @@
+package aedstorm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type testVersionedModel struct {
+	ID       string
+	FullName string
+	Version  int `aedstorm:"version"`
+}
+
+func (m *testVersionedModel) GetID() string {
+	return m.ID
+}
+
+func (m *testVersionedModel) SchemaVersion() int {
+	return 2
+}
+
+type testVersionedModelNoField struct {
+	ID string
+}
+
+func (m *testVersionedModelNoField) SchemaVersion() int {
+	return 1
+}
+
+func init() {
+	// Version 0 had separate first and last names
+	RegisterMigration(&testVersionedModel{}, 0, func(ctx context.Context, props datastore.PropertyList) (datastore.PropertyList, error) {
+		var first, last string
+		var out datastore.PropertyList
+		for _, p := range props {
+			switch p.Name {
+			case "First":
+				first = p.Value.(string)
+			case "Last":
+				last = p.Value.(string)
+			default:
+				out = append(out, p)
+			}
+		}
+		return append(out, datastore.Property{Name: "FullName", Value: first + " " + last}), nil
+	})
+	// Version 1 used lower case names
+	RegisterMigration(&testVersionedModel{}, 1, func(ctx context.Context, props datastore.PropertyList) (datastore.PropertyList, error) {
+		for i := range props {
+			if props[i].Name == "FullName" {
+				props[i].Value = "Mr. " + props[i].Value.(string)
+			}
+		}
+		return props, nil
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	props := datastore.PropertyList{
+		{Name: "ID", Value: "foo"},
+		{Name: "First", Value: "John"},
+		{Name: "Last", Value: "Doe"},
+	}
+	props, migrated, err := migrate(context.Background(), &testVersionedModel{}, props)
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+
+	tm := &testVersionedModel{}
+	assert.NoError(t, loadProperties(tm, props))
+	assert.Equal(t, "Mr. John Doe", tm.FullName)
+	assert.Equal(t, 2, tm.Version)
+}
+
+func TestMigrateCurrent(t *testing.T) {
+	props := datastore.PropertyList{{Name: "Version", Value: int64(2)}}
+	_, migrated, err := migrate(context.Background(), &testVersionedModel{}, props)
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	_, migrated, err := migrate(context.Background(), &testModel{}, nil)
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+}
+
+func TestMigrateNoVersionField(t *testing.T) {
+	_, _, err := migrate(context.Background(), &testVersionedModelNoField{}, nil)
+	assert.EqualError(t, err, "Type testVersionedModelNoField has no version field")
+	assert.EqualError(t, setSchemaVersion(&testVersionedModelNoField{}), "Type testVersionedModelNoField has no version field")
+}
+
+func TestMigrateMissing(t *testing.T) {
+	props := datastore.PropertyList{{Name: "Version", Value: int64(-1)}}
+	_, _, err := migrate(context.Background(), &testVersionedModel{}, props)
+	assert.EqualError(t, err, "No migration registered for testVersionedModel from version -1")
+}
+
+func TestMigrateError(t *testing.T) {
+	type errModel struct {
+		testVersionedModel
+	}
+	RegisterMigration(&errModel{}, 0, func(ctx context.Context, props datastore.PropertyList) (datastore.PropertyList, error) {
+		return nil, errors.New("migration failed")
+	})
+	_, _, err := migrate(context.Background(), &errModel{}, nil)
+	assert.EqualError(t, err, "migration failed")
+}
+
+func TestIsStale(t *testing.T) {
+	stale, err := isStale(&testVersionedModel{Version: 1})
+	assert.NoError(t, err)
+	assert.True(t, stale)
+
+	stale, err = isStale(&testVersionedModel{Version: 2})
+	assert.NoError(t, err)
+	assert.False(t, stale)
+
+	stale, err = isStale(&testModel{})
+	assert.NoError(t, err)
+	assert.False(t, stale)
+}
+
+func TestLoadMigratesStaleCache(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	dm := NewModel(&testVersionedModel{ID: "stale"}).WithContext(mctx)
+	old := &datastore.PropertyList{
+		{Name: "ID", Value: "stale"},
+		{Name: "First", Value: "John"},
+		{Name: "Last", Value: "Doe"},
+	}
+	_, err := driverPut(mctx, dm.Key(), old)
+	assert.NoError(t, err)
+
+	// The version 0 entity was cached by an older release, which didn't have
+	// the First and Last fields anymore
+	assert.NoError(t, cacheSet(mctx, dm.cacheKey(), &testVersionedModel{ID: "stale"}))
+
+	tm := &testVersionedModel{ID: "stale"}
+	assert.NoError(t, NewModel(tm).WithContext(mctx).Load())
+	assert.Equal(t, "Mr. John Doe", tm.FullName)
+	assert.Equal(t, 2, tm.Version)
+
+	models, err := getMulti(mctx, []*datastore.Key{dm.Key()}, reflect.TypeOf(testVersionedModel{}))
+	assert.NoError(t, err)
+	assert.Equal(t, "Mr. John Doe", models[0].Interface().(*testVersionedModel).FullName)
+}
+
+func TestSetSchemaVersion(t *testing.T) {
+	tm := &testVersionedModel{}
+	assert.NoError(t, setSchemaVersion(tm))
+	assert.Equal(t, 2, tm.Version)
+
+	assert.EqualError(t, setSchemaVersion(&testStringVersionModel{}), "Version field Version of type testStringVersionModel must be an integer")
+}
+
+type testStringVersionModel struct {
+	ID      string
+	Version string `aedstorm:"version"`
+}
+
+func (m *testStringVersionModel) SchemaVersion() int {
+	return 1
+}
+
+func TestIsModelSlice(t *testing.T) {
+	assert.True(t, isModelSlice(&[]testVersionedModel{}))
+	assert.True(t, isModelSlice(&[]*testVersionedModel{}))
+	assert.False(t, isModelSlice(&[]datastore.PropertyList{}))
+	assert.False(t, isModelSlice([]testVersionedModel{}))
+	assert.False(t, isModelSlice(nil))
+}
+
+func TestLoadMigrates(t *testing.T) {
+	dm := NewModel(&testVersionedModel{ID: "migrate-me"}).WithContext(ctx)
+	old := &datastore.PropertyList{
+		{Name: "ID", Value: "migrate-me"},
+		{Name: "First", Value: "John"},
+		{Name: "Last", Value: "Doe"},
+	}
+	if _, err := datastore.Put(ctx, dm.Key(), old); !assert.NoError(t, err) {
+		return
+	}
+	dm.Uncache()
+
+	tm := &testVersionedModel{ID: "migrate-me"}
+	assert.NoError(t, NewModel(tm).WithContext(ctx).Load())
+	assert.Equal(t, "Mr. John Doe", tm.FullName)
+	assert.Equal(t, 2, tm.Version)
+
+	n, err := MigrateAll(ctx, &testVersionedModel{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
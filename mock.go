@@ -0,0 +1,318 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type mockContextKey struct{}
+
+// Mock is a registry of expected queries and their results. Queries run with
+// a context returned by WithMock() get their results from the first matching
+// expectation instead of the datastore, so tests using different contexts
+// don't interfere with each other. The queries aedstorm runs itself, like
+// those of preloads and cascading deletes, aren't mocked.
+//
+//	m := aedstorm.NewMock()
+//	m.Expect(&User{}).Where(aedstorm.Eq("Name", "foo")).Return([]User{{ID: "foo"}}, nil, nil)
+//	ctx = aedstorm.WithMock(ctx, m)
+//	...
+//	m.Verify(t)
+type Mock struct {
+	mu           sync.Mutex
+	expectations []*Expectation
+	unmatched    []string
+}
+
+// Expectation is an expected query and its result. Expectations only match
+// queries with the same filters and orders if any were given, and are used
+// once unless Times() says otherwise.
+type Expectation struct {
+	kind       string
+	conditions []Condition
+	orders     []string
+	keysOnly   *bool
+	times      int
+	used       int
+
+	data     interface{}
+	keys     []*datastore.Key
+	err      error
+	count    int
+	countErr error
+	hasCount bool
+}
+
+// TestingT is the subset of *testing.T which Verify() reports to
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// NewMock returns an empty mock registry
+func NewMock() *Mock {
+	return &Mock{}
+}
+
+// WithMock returns a context whose queries are answered by the mock registry
+func WithMock(ctx context.Context, m *Mock) context.Context {
+	return context.WithValue(ctx, mockContextKey{}, m)
+}
+
+func mockFromContext(ctx context.Context) *Mock {
+	m, _ := ctx.Value(mockContextKey{}).(*Mock)
+	return m
+}
+
+// Expect adds an expectation of a query of the kind of model m
+func (m *Mock) Expect(model interface{}) *Expectation {
+	entityKind, err := getEntityName(model)
+	if err != nil {
+		panic(err)
+	}
+	e := &Expectation{kind: entityKind, times: 1}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expectations = append(m.expectations, e)
+	return e
+}
+
+// Filter makes the expectation only match queries with the filter
+func (e *Expectation) Filter(filterStr string, value interface{}) *Expectation {
+	e.conditions = append(e.conditions, parseFilter(filterStr, value))
+	return e
+}
+
+// Where makes the expectation only match queries with the conditions
+func (e *Expectation) Where(conds ...Condition) *Expectation {
+	e.conditions = append(e.conditions, conds...)
+	return e
+}
+
+// Order makes the expectation only match queries with the orders
+func (e *Expectation) Order(fieldName string) *Expectation {
+	e.orders = append(e.orders, fieldName)
+	return e
+}
+
+// KeysOnly makes the expectation only match keys only queries
+func (e *Expectation) KeysOnly() *Expectation {
+	keysOnly := true
+	e.keysOnly = &keysOnly
+	return e
+}
+
+// Times sets how many queries the expectation matches. Zero or less means any
+// number of times.
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+// Return sets the result of the query. data is copied into the destination of
+// GetAll(), or yielded one element at a time by Run(). Count() returns the
+// length of data, or of keys if data is nil.
+func (e *Expectation) Return(data interface{}, keys []*datastore.Key, err error) *Expectation {
+	e.data, e.keys, e.err = data, keys, err
+	return e
+}
+
+// ReturnCount sets the result of Count(), separately from the error set with
+// Return()
+func (e *Expectation) ReturnCount(n int, err error) *Expectation {
+	e.count, e.hasCount, e.countErr = n, true, err
+	return e
+}
+
+// matches returns true if the expectation matches query q
+func (e *Expectation) matches(q *Query) bool {
+	if e.kind != q.entity || (e.times > 0 && e.used >= e.times) {
+		return false
+	}
+	if e.keysOnly != nil && *e.keysOnly != q.keysOnly {
+		return false
+	}
+	if e.orders != nil && !reflect.DeepEqual(e.orders, q.orders) {
+		return false
+	}
+	if e.conditions == nil {
+		return true
+	}
+	if len(e.conditions) != len(q.conditions) {
+		return false
+	}
+	used := make([]bool, len(q.conditions))
+	for _, want := range e.conditions {
+		found := false
+		for i, got := range q.conditions {
+			if !used[i] && reflect.DeepEqual(want, got) {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// match returns the first expectation which matches query q, and records q
+// as unmatched if there's none.
+func (m *Mock) match(q *Query) (*Expectation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.expectations {
+		if e.matches(q) {
+			e.used++
+			return e, nil
+		}
+	}
+	desc := q.describe()
+	m.unmatched = append(m.unmatched, desc)
+	return nil, fmt.Errorf("Unexpected query: %s", desc)
+}
+
+// Verify reports the expectations which weren't used as often as expected,
+// and the queries which didn't match any expectation. It returns true if
+// there were none.
+func (m *Mock) Verify(t TestingT) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ok := true
+	for _, e := range m.expectations {
+		if e.times > 0 && e.used < e.times {
+			t.Errorf("Expected query %s to run %d times, but it ran %d times", e.describe(), e.times, e.used)
+			ok = false
+		}
+	}
+	for _, desc := range m.unmatched {
+		t.Errorf("Unexpected query: %s", desc)
+		ok = false
+	}
+	return ok
+}
+
+// describe returns a readable description of the expected query
+func (e *Expectation) describe() string {
+	keysOnly := e.keysOnly != nil && *e.keysOnly
+	return describeQuery(e.kind, e.conditions, e.orders, keysOnly)
+}
+
+// describe returns a readable description of the query
+func (q *Query) describe() string {
+	return describeQuery(q.entity, q.conditions, q.orders, q.keysOnly)
+}
+
+func describeQuery(entityKind string, conds []Condition, orders []string, keysOnly bool) string {
+	parts := []string{entityKind}
+	for _, c := range conds {
+		parts = append(parts, fmt.Sprintf("Where(%s)", c))
+	}
+	for _, o := range orders {
+		parts = append(parts, fmt.Sprintf("Order(%s)", o))
+	}
+	if keysOnly {
+		parts = append(parts, "KeysOnly()")
+	}
+	return strings.Join(parts, " ")
+}
+
+// String returns the condition in the form "Property op value"
+func (c Condition) String() string {
+	if c.Op == "or" {
+		var subs []string
+		for _, sub := range c.Value.([]Condition) {
+			subs = append(subs, sub.String())
+		}
+		return strings.Join(subs, " or ")
+	}
+	return fmt.Sprintf("%s %s %v", c.Property, c.Op, c.Value)
+}
+
+// parseFilter returns the condition of a filter string and value
+func parseFilter(filterStr string, value interface{}) Condition {
+	fields := strings.Fields(filterStr)
+	c := Condition{Op: "=", Value: value}
+	if len(fields) > 0 {
+		c.Property = fields[0]
+	}
+	if len(fields) > 1 {
+		c.Op = fields[1]
+	}
+	return c
+}
+
+// mockResult is the result of a mocked query
+type mockResult struct {
+	data     interface{}
+	keys     []*datastore.Key
+	err      error
+	count    int
+	countErr error
+	hasCount bool
+}
+
+// mockedBy sets which mocks answer the query
+func (q *Query) mockedBy(scope mockScope) *Query {
+	if scope > q.mocks {
+		q.mocks = scope
+	}
+	return q
+}
+
+// mocked returns the mocked result of the query, if the context has a mock
+// registry. If it has no matching expectation, an error is returned.
+func (q *Query) mocked(ctx context.Context) (*mockResult, error) {
+	m := mockFromContext(ctx)
+	if m == nil || q.mocks == mockNone {
+		return nil, nil
+	}
+	e, err := m.match(q)
+	if err != nil {
+		return nil, err
+	}
+	return &mockResult{e.data, e.keys, e.err, e.count, e.countErr, e.hasCount}, nil
+}
+
+// mockedGetAll returns the mocked result of GetAll(), which without a mock
+// registry is the one set with SetMockQueryResult(), like it always was
+func (q *Query) mockedGetAll(ctx context.Context) (*mockResult, error) {
+	if mockFromContext(ctx) != nil || q.mocks != mockGlobal {
+		return q.mocked(ctx)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if nextResultData == nil && nextResultError == nil && nextResultKeys == nil {
+		return nil, nil
+	}
+	res := &mockResult{data: nextResultData, keys: nextResultKeys, err: nextResultError}
+	nextResultData, nextResultError, nextResultKeys = nil, nil, nil
+	return res, nil
+}
+
+// getAll copies the mocked data into out
+func (res *mockResult) getAll(out interface{}) ([]*datastore.Key, error) {
+	if res.data != nil && out != nil {
+		if err := Copy(res.data, out); err != nil {
+			return nil, err
+		}
+	}
+	return res.keys, res.err
+}
+
+// countResults returns the mocked number of results
+func (res *mockResult) countResults() (int, error) {
+	if res.hasCount {
+		return res.count, res.countErr
+	}
+	if v := reflect.Indirect(reflect.ValueOf(res.data)); v.IsValid() && v.Kind() == reflect.Slice {
+		return v.Len(), res.err
+	}
+	return len(res.keys), res.err
+}
@@ -0,0 +1,184 @@
+package aedstorm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// testRecorder records the errors Verify() reports
+type testRecorder struct {
+	errors []string
+}
+
+func (r *testRecorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestMockGetAll(t *testing.T) {
+	m := NewMock()
+	m.Expect(&testAuthor{}).Where(Eq("Name", "foo")).Return([]testAuthor{{ID: "foo"}}, nil, nil)
+	m.Expect(&testAuthor{}).Return([]testAuthor{{ID: "bar"}, {ID: "baz"}}, nil, nil)
+	mctx := WithMock(context.Background(), m)
+
+	var out []testAuthor
+	_, err := NewQuery(&testAuthor{}).Order("Name").GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+
+	out = nil
+	_, err = NewQuery(&testAuthor{}).Filter("Name =", "foo").GetAll(mctx, &out)
+	assert.NoError(t, err)
+	if assert.Len(t, out, 1) {
+		assert.Equal(t, "foo", out[0].ID)
+	}
+	assert.True(t, m.Verify(t))
+}
+
+func TestMockMatching(t *testing.T) {
+	m := NewMock()
+	m.Expect(&testAuthor{}).Filter("Name =", "foo").Order("-Name").KeysOnly().Return(nil, nil, nil)
+	mctx := WithMock(context.Background(), m)
+
+	// Different kind, filter, order or keys only setting doesn't match
+	for _, q := range []*Query{
+		NewQuery(&testModel{}).Filter("Name =", "foo").Order("-Name").KeysOnly(),
+		NewQuery(&testAuthor{}).Filter("Name =", "bar").Order("-Name").KeysOnly(),
+		NewQuery(&testAuthor{}).Filter("Name =", "foo").Order("Name").KeysOnly(),
+		NewQuery(&testAuthor{}).Filter("Name =", "foo").Order("-Name"),
+		NewQuery(&testAuthor{}).Filter("Name =", "foo").Filter("ID =", "foo").Order("-Name").KeysOnly(),
+	} {
+		_, err := q.GetAll(mctx, nil)
+		assert.Error(t, err)
+	}
+	_, err := NewQuery(&testAuthor{}).Filter("Name =", "foo").Order("-Name").KeysOnly().GetAll(mctx, nil)
+	assert.NoError(t, err)
+
+	// Each expectation is only used once by default
+	_, err = NewQuery(&testAuthor{}).Filter("Name =", "foo").Order("-Name").KeysOnly().GetAll(mctx, nil)
+	assert.EqualError(t, err, "Unexpected query: testAuthor Where(Name = foo) Order(-Name) KeysOnly()")
+
+	r := &testRecorder{}
+	assert.False(t, m.Verify(r))
+	assert.Len(t, r.errors, 6)
+}
+
+func TestMockUnused(t *testing.T) {
+	m := NewMock()
+	m.Expect(&testAuthor{}).Where(In("Name", "foo", "bar")).Times(2)
+	m.Expect(&testModel{}).Times(0)
+	mctx := WithMock(context.Background(), m)
+
+	_, err := NewQuery(&testAuthor{}).Where(In("Name", "foo", "bar")).GetAll(mctx, nil)
+	assert.NoError(t, err)
+
+	r := &testRecorder{}
+	assert.False(t, m.Verify(r))
+	assert.Equal(t, []string{"Expected query testAuthor Where(Name in [foo bar]) to run 2 times, but it ran 1 times"}, r.errors)
+}
+
+func TestMockCount(t *testing.T) {
+	m := NewMock()
+	m.Expect(&testAuthor{}).ReturnCount(42, nil)
+	m.Expect(&testAuthor{}).Return([]testAuthor{{}, {}}, nil, nil)
+	m.Expect(&testAuthor{}).KeysOnly().Return(nil, []*datastore.Key{nil, nil, nil}, nil)
+	mctx := WithMock(context.Background(), m)
+
+	for _, want := range []int{42, 2} {
+		n, err := NewQuery(&testAuthor{}).Count(mctx)
+		assert.NoError(t, err)
+		assert.Equal(t, want, n)
+	}
+	n, err := NewQuery(&testAuthor{}).KeysOnly().Count(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+}
+
+func TestMockRun(t *testing.T) {
+	mockErr := errors.New("Mock error")
+	m := NewMock()
+	m.Expect(&testAuthor{}).Return([]*testAuthor{{ID: "foo"}}, nil, mockErr)
+	mctx := WithMock(context.Background(), m)
+
+	it := NewQuery(&testAuthor{}).Run(mctx)
+	var a testAuthor
+	_, err := it.Next(&a)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", a.ID)
+	_, err = it.Next(&a)
+	assert.Equal(t, mockErr, err)
+
+	_, err = NewQuery(&testAuthor{}).Run(mctx).Next(&a)
+	assert.EqualError(t, err, "Unexpected query: testAuthor")
+}
+
+func TestMockParallel(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		i := i
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			t.Parallel()
+			m := NewMock()
+			m.Expect(&testAuthor{}).Return([]testAuthor{{ID: fmt.Sprintf("%d", i)}}, nil, nil)
+			var out []testAuthor
+			_, err := NewQuery(&testAuthor{}).GetAll(WithMock(context.Background(), m), &out)
+			assert.NoError(t, err)
+			if assert.Len(t, out, 1) {
+				assert.Equal(t, fmt.Sprintf("%d", i), out[0].ID)
+			}
+			m.Verify(t)
+		})
+	}
+}
+
+func TestMockReturnCount(t *testing.T) {
+	mockErr := errors.New("Mock error")
+	m := NewMock()
+	m.Expect(&testAuthor{}).Return(nil, nil, mockErr).ReturnCount(5, nil).Times(2)
+	mctx := WithMock(context.Background(), m)
+
+	n, err := NewQuery(&testAuthor{}).Count(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	_, err = NewQuery(&testAuthor{}).GetAll(mctx, nil)
+	assert.Equal(t, mockErr, err)
+	assert.True(t, m.Verify(t))
+}
+
+func TestMockInternalQueries(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	postModel := NewModel(&testPost{ID: "p1"}).WithContext(mctx)
+	assert.NoError(t, postModel.Save())
+	assert.NoError(t, NewModel(&testComment{ID: "c1", Post: postModel.Key()}).WithContext(mctx).Save())
+
+	// Preloads aren't answered by the mock registry
+	m := NewMock()
+	post := &testPost{ID: "p1"}
+	assert.NoError(t, NewModel(post).WithContext(WithMock(mctx, m)).Preload("Comments").Load())
+	assert.Len(t, post.Comments, 1)
+	assert.True(t, m.Verify(t))
+}
+
+func TestSetMockQueryResultOnlyGetAll(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+	SetMockQueryResult([]testMemoryModel{{ID: "mocked"}}, nil, nil)
+	defer SetMockQueryResult(nil, nil, nil)
+
+	n, err := NewQuery(&testMemoryModel{}).Count(mctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	var first testMemoryModel
+	_, err = NewQuery(&testMemoryModel{}).Order("Name").First(mctx, &first)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", first.ID)
+	assert.NotNil(t, nextResultData)
+
+	var out []testMemoryModel
+	_, err = NewQuery(&testMemoryModel{}).GetAll(mctx, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mocked"}, memoryIDs(out))
+	assert.Nil(t, nextResultData)
+}
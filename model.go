@@ -52,3 +52,18 @@ type OnDelete interface {
 type SetID interface {
 	SetID(string)
 }
+
+// SchemaVersion is an interface which returns the current schema version of the model. If defined, the
+// version is stored in the field tagged with `aedstorm:"version"` and migrations registered with
+// RegisterMigration are run on older entities when they're loaded.
+type SchemaVersion interface {
+	SchemaVersion() int
+}
+
+// PartialModel is an interface which, if defined, is told which properties were loaded when the model is
+// the result of a projection query. Partial models can't be saved, since that would overwrite the properties
+// which weren't loaded. Embedding the Partial type implements it.
+type PartialModel interface {
+	SetLoaded(properties []string)
+	IsPartial() bool
+}
@@ -0,0 +1,180 @@
+package aedstorm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrInvalidPageToken is returned by Page() when the page token is malformed
+// or its signature doesn't match.
+var ErrInvalidPageToken = errors.New("Page token is invalid")
+
+// ErrInvalidPageSize is returned by Page() when the page size isn't positive
+var ErrInvalidPageSize = errors.New("Page size must be greater than zero")
+
+// Start returns a derivative query which starts at the cursor, as returned
+// by Iterator.Cursor()
+func (q *Query) Start(cursor string) *Query {
+	q.start = cursor
+	return q
+}
+
+// End returns a derivative query which ends at the cursor, as returned by
+// Iterator.Cursor()
+func (q *Query) End(cursor string) *Query {
+	q.end = cursor
+	return q
+}
+
+// Offset returns a derivative query which skips the first num results
+func (q *Query) Offset(num int) *Query {
+	q.offset = num
+	return q
+}
+
+// SignWith makes Page() sign the page tokens it returns with an HMAC-SHA256
+// of key, and reject page tokens which weren't signed with it. Signed tokens
+// can be handed to API clients without them being able to forge cursors. The
+// signature covers the kind, filters, orders, ancestor and namespace of the
+// query, so a token is only accepted by the query it was issued for.
+func (q *Query) SignWith(key []byte) *Query {
+	q.pageKey = key
+	return q
+}
+
+// Page loads up to size results starting at the page token into out, which
+// must be a pointer to a slice of structs or struct pointers. An empty token
+// starts at the beginning. It returns the token of the next page, which is
+// empty once there are no more results. The offset of the query only applies
+// to the first page, since the cursor of the token already skips it.
+func (q *Query) Page(ctx context.Context, size int, token string, out interface{}) (string, error) {
+	if size <= 0 {
+		return "", ErrInvalidPageSize
+	}
+
+	// For purposes of mocking, this allows the results to be set in advance
+	if res, err := q.mocked(ctx); res != nil || err != nil {
+		if err != nil {
+			return "", err
+		}
+		_, err := res.getAll(out)
+		return "", err
+	}
+
+	if !isModelSlice(out) {
+		return "", fmt.Errorf("Page needs a pointer to a slice of structs, not %T", out)
+	}
+	if len(q.disjunctions) > 0 {
+		return "", ErrNoCursor
+	}
+	pq := *q
+	spec, err := pq.Limit(size).query(ctx)
+	if err != nil {
+		return "", err
+	}
+	scope, err := pageScope(ctx, spec)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		c, err := q.decodePageToken(scope, token)
+		if err != nil {
+			return "", err
+		}
+		spec.Start, spec.Offset = c, 0
+	}
+
+	var (
+		keys  []*datastore.Key
+		lists []datastore.PropertyList
+	)
+	it := getDriver(ctx).Run(ctx, spec)
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err == datastore.Done {
+			break
+		}
+		if err == ErrInvalidCursor && token != "" {
+			return "", ErrInvalidPageToken
+		}
+		if err != nil {
+			return "", err
+		}
+		keys, lists = append(keys, key), append(lists, props)
+	}
+	if err := q.loadResults(ctx, keys, lists, out); err != nil {
+		return "", err
+	}
+	if len(keys) < size {
+		return "", nil
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		return "", err
+	}
+	return q.encodePageToken(scope, c), nil
+}
+
+// pageScope returns what page tokens of the query are bound to: the
+// namespace and the recorded form of the query spec, without the start
+// cursor, limit and offset which change from page to page.
+func pageScope(ctx context.Context, spec *driver.Query) ([]byte, error) {
+	s := *spec
+	s.Start, s.Limit, s.Offset = "", 0, 0
+	rq, err := recordQuery(ctx, &s)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(rq)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(NamespaceFromContext(ctx)+"\x00"), b...), nil
+}
+
+// encodePageToken returns the page token of the cursor, which is signed if a
+// key was set with SignWith().
+func (q *Query) encodePageToken(scope []byte, cursor string) string {
+	if len(q.pageKey) == 0 {
+		return cursor
+	}
+	return cursor + "." + base64.RawURLEncoding.EncodeToString(q.signPageToken(scope, cursor))
+}
+
+// decodePageToken returns the cursor of the page token, checking its
+// signature if a key was set with SignWith().
+func (q *Query) decodePageToken(scope []byte, token string) (string, error) {
+	if len(q.pageKey) == 0 {
+		return token, nil
+	}
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", ErrInvalidPageToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, q.signPageToken(scope, token[:i])) {
+		return "", ErrInvalidPageToken
+	}
+	return token[:i], nil
+}
+
+// signPageToken returns the signature of the cursor of a page token of the
+// query with the given scope, see pageScope().
+func (q *Query) signPageToken(scope []byte, cursor string) []byte {
+	mac := hmac.New(sha256.New, q.pageKey)
+	mac.Write(scope)
+	mac.Write([]byte{0})
+	mac.Write([]byte(cursor))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,141 @@
+package aedstorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestPageTokenUnsigned(t *testing.T) {
+	q := NewQuery(&testModel{})
+	token := q.encodePageToken([]byte("scope"), "cursor")
+	assert.Equal(t, "cursor", token)
+
+	c, err := q.decodePageToken([]byte("scope"), token)
+	assert.NoError(t, err)
+	assert.Equal(t, "cursor", c)
+}
+
+func TestPageTokenSigned(t *testing.T) {
+	scope := []byte("scope")
+	q := NewQuery(&testModel{}).SignWith([]byte("secret"))
+	token := q.encodePageToken(scope, "cursor")
+	assert.Contains(t, token, ".")
+
+	c, err := q.decodePageToken(scope, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "cursor", c)
+
+	// Unsigned and tampered tokens are rejected
+	_, err = q.decodePageToken(scope, "cursor")
+	assert.Equal(t, ErrInvalidPageToken, err)
+	_, err = q.decodePageToken(scope, token+"x")
+	assert.Equal(t, ErrInvalidPageToken, err)
+
+	// So are tokens signed with another key or for another query
+	_, err = NewQuery(&testModel{}).SignWith([]byte("other")).decodePageToken(scope, token)
+	assert.Equal(t, ErrInvalidPageToken, err)
+	_, err = q.decodePageToken([]byte("other"), token)
+	assert.Equal(t, ErrInvalidPageToken, err)
+}
+
+func TestPageTokenBoundToQuery(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+	secret := []byte("secret")
+	var out []testMemoryModel
+	token, err := NewQuery(&testMemoryModel{}).Filter("Age >", 0).Order("Age").SignWith(secret).Page(mctx, 1, "", &out)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token)
+
+	// The same query takes the token, whatever the page size
+	_, err = NewQuery(&testMemoryModel{}).Filter("Age >", 0).Order("Age").SignWith(secret).Page(mctx, 2, token, &out)
+	assert.NoError(t, err)
+
+	nsCtx, err := WithNamespace(mctx, "other")
+	assert.NoError(t, err)
+	for _, tc := range []struct {
+		ctx context.Context
+		q   *Query
+	}{
+		{mctx, NewQuery(&testMemoryModel{}).Filter("Age >", 1).Order("Age")},
+		{mctx, NewQuery(&testMemoryModel{}).Filter("Age >", 0).Order("-Age")},
+		{mctx, NewQuery(&testMemoryModel{}).Filter("Age >", 0).Order("Age").Ancestor(NewKey(mctx, "Parent", "p", 0, nil))},
+		{mctx, NewQuery(&testAuthor{}).Filter("Age >", 0).Order("Age")},
+		{nsCtx, NewQuery(&testMemoryModel{}).Filter("Age >", 0).Order("Age")},
+	} {
+		_, err = tc.q.SignWith(secret).Page(tc.ctx, 2, token, &out)
+		assert.Equal(t, ErrInvalidPageToken, err)
+	}
+}
+
+func TestPageInvalidOut(t *testing.T) {
+	_, err := NewQuery(&testModel{}).Page(ctx, 10, "", []testModel{})
+	assert.Error(t, err)
+}
+
+func TestPageMock(t *testing.T) {
+	mock := NewMock()
+	mock.Expect(&testModel{}).Return([]testModel{{ID: "foo"}}, nil, nil)
+	var out []testModel
+	next, err := NewQuery(&testModel{}).Page(WithMock(ctx, mock), 10, "", &out)
+	assert.NoError(t, err)
+	assert.Empty(t, next)
+	assert.Len(t, out, 1)
+}
+
+func TestPage(t *testing.T) {
+	for _, id := range []string{"page-1", "page-2", "page-3"} {
+		assert.NoError(t, NewModel(&testAuthor{ID: id, Name: "paged"}).WithContext(ctx).Save())
+	}
+
+	var (
+		all   []testAuthor
+		token string
+		pages int
+	)
+	for {
+		var out []testAuthor
+		next, err := NewQuery(&testAuthor{}).Filter("Name =", "paged").SignWith([]byte("secret")).Page(ctx, 2, token, &out)
+		assert.NoError(t, err)
+		all = append(all, out...)
+		pages++
+		if next == "" || pages > 3 {
+			break
+		}
+		token = next
+	}
+	assert.Len(t, all, 3)
+	assert.Equal(t, 2, pages)
+}
+
+func TestPageInvalidToken(t *testing.T) {
+	var out []testMemoryModel
+	_, err := NewQuery(&testMemoryModel{}).Page(newTestMemoryContext(t), 2, "not a cursor!", &out)
+	assert.Equal(t, ErrInvalidPageToken, err)
+}
+
+func TestPageInvalidSize(t *testing.T) {
+	var out []testModel
+	for _, size := range []int{0, -1} {
+		_, err := NewQuery(&testModel{}).Page(ctx, size, "", &out)
+		assert.Equal(t, ErrInvalidPageSize, err)
+	}
+}
+
+func TestPageOffset(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+	q := NewQuery(&testMemoryModel{}).Order("Name").Offset(1)
+
+	var first []testMemoryModel
+	token, err := q.Page(mctx, 2, "", &first)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, memoryIDs(first))
+
+	// The offset isn't applied again after the cursor
+	var second []testMemoryModel
+	token, err = q.Page(mctx, 2, token, &second)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d"}, memoryIDs(second))
+	assert.Empty(t, token)
+}
@@ -0,0 +1,95 @@
+package aedstorm
+
+import (
+	"errors"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrPartialModel is returned when saving a model which was loaded by a projection query
+var ErrPartialModel = errors.New("Model was partially loaded by a projection query and can't be saved")
+
+// Partial can be embedded in models to keep track of which properties a
+// projection query loaded. It implements the PartialModel interface.
+type Partial struct {
+	// LoadedProperties holds the properties loaded by a projection query, or
+	// nil if the model was fully loaded.
+	LoadedProperties []string `datastore:"-" json:"-"`
+}
+
+// SetLoaded implements the PartialModel interface
+func (p *Partial) SetLoaded(properties []string) {
+	p.LoadedProperties = append([]string{}, properties...)
+}
+
+// IsPartial implements the PartialModel interface
+func (p *Partial) IsPartial() bool {
+	return p.LoadedProperties != nil
+}
+
+// IsLoaded returns true if the property was loaded. All properties of models
+// which weren't loaded by a projection query are loaded.
+func (p *Partial) IsLoaded(property string) bool {
+	if !p.IsPartial() {
+		return true
+	}
+	for _, name := range p.LoadedProperties {
+		if name == property {
+			return true
+		}
+	}
+	return false
+}
+
+// Project returns a derivative query which only loads the given properties.
+// Results which implement the PartialModel interface, for example by
+// embedding Partial, are told which properties were loaded.
+func (q *Query) Project(fieldNames ...string) *Query {
+	q.projection = append(q.projection, fieldNames...)
+	return q
+}
+
+// Distinct returns a derivative query which yields de-duplicated entities
+// with respect to the set of projected fields. It's only used for projection
+// queries.
+func (q *Query) Distinct() *Query {
+	q.distinct = true
+	return q
+}
+
+// DistinctOn returns a derivative query which yields de-duplicated entities
+// with respect to the given fields, which must also be projected.
+func (q *Query) DistinctOn(fieldNames ...string) *Query {
+	q.distinctOn = append(q.distinctOn, fieldNames...)
+	return q
+}
+
+// Ancestor returns a derivative query with an ancestor filter
+func (q *Query) Ancestor(ancestor *datastore.Key) *Query {
+	q.ancestor = ancestor
+	return q
+}
+
+// EventualConsistency returns a derivative query which returns eventually
+// consistent results. It only has an effect on ancestor queries.
+func (q *Query) EventualConsistency() *Query {
+	q.eventual = true
+	return q
+}
+
+// BatchSize returns a derivative query which fetches the given number of
+// results at once.
+func (q *Query) BatchSize(size int) *Query {
+	q.batchSize = size
+	return q
+}
+
+// setLoaded marks m as partially loaded if the query has a projection
+func (q *Query) setLoaded(m Model) {
+	if len(q.projection) == 0 {
+		return
+	}
+	if obj, ok := m.(PartialModel); ok {
+		obj.SetLoaded(q.projection)
+	}
+}
@@ -0,0 +1,79 @@
+package aedstorm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/datastore"
+)
+
+type testPartialModel struct {
+	Partial
+	ID    string
+	Name  string
+	Email string
+}
+
+func (m *testPartialModel) GetID() string {
+	return m.ID
+}
+
+func TestPartial(t *testing.T) {
+	var p Partial
+	assert.False(t, p.IsPartial())
+	assert.True(t, p.IsLoaded("Name"))
+
+	p.SetLoaded([]string{"Name"})
+	assert.True(t, p.IsPartial())
+	assert.True(t, p.IsLoaded("Name"))
+	assert.False(t, p.IsLoaded("Email"))
+}
+
+func TestPartialLoadProperties(t *testing.T) {
+	var m testPartialModel
+	props := datastore.PropertyList{{Name: "Name", Value: "Test"}}
+	assert.NoError(t, loadProperties(&m, props))
+	assert.Equal(t, "Test", m.Name)
+
+	saved, err := saveProperties(&m)
+	assert.NoError(t, err)
+	for _, p := range saved {
+		assert.NotEqual(t, "LoadedProperties", p.Name)
+	}
+}
+
+func TestQuerySetLoaded(t *testing.T) {
+	var m testPartialModel
+	NewQuery(&m).setLoaded(&m)
+	assert.False(t, m.IsPartial())
+
+	NewQuery(&m).Project("Name").setLoaded(&m)
+	assert.Equal(t, []string{"Name"}, m.LoadedProperties)
+}
+
+func TestQueryMigrateProjection(t *testing.T) {
+	props := datastore.PropertyList{{Name: "Name", Value: "Test"}}
+	out, migrated, err := NewQuery(&testVersionedModel{}).Project("Name").migrate(ctx, &testVersionedModel{}, props)
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+	assert.Equal(t, props, out)
+}
+
+func TestSavePartialModel(t *testing.T) {
+	m := &testPartialModel{ID: "partial"}
+	m.SetLoaded([]string{"Name"})
+	assert.Equal(t, ErrPartialModel, NewModel(m).WithContext(ctx).Save())
+}
+
+func TestQueryProject(t *testing.T) {
+	assert.NoError(t, NewModel(&testPartialModel{ID: "project", Name: "Projected", Email: "foo@example.com"}).WithContext(ctx).Save())
+
+	var out []testPartialModel
+	_, err := NewQuery(&testPartialModel{}).Project("Name").Filter("ID =", "project").EventualConsistency().BatchSize(10).GetAll(ctx, &out)
+	assert.NoError(t, err)
+	if assert.Len(t, out, 1) {
+		assert.Equal(t, "Projected", out[0].Name)
+		assert.Empty(t, out[0].Email)
+		assert.False(t, out[0].IsLoaded("Email"))
+	}
+}
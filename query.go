@@ -2,9 +2,13 @@ package aedstorm
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 
+	"github.com/bradberger/go-aedstorm/internal/driver"
+
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine/datastore"
@@ -17,7 +21,11 @@ var (
 	mu              sync.Mutex
 )
 
-// SetMockQueryResult sets the query GetAll() result to be the values given
+// SetMockQueryResult sets the result of the next GetAll() which is run with
+// a context without a mock registry.
+//
+// Deprecated: the result is shared by all queries of all kinds, including
+// those of parallel tests. Use NewMock and WithMock instead.
 func SetMockQueryResult(data interface{}, err error, keys []*datastore.Key) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -26,40 +34,144 @@ func SetMockQueryResult(data interface{}, err error, keys []*datastore.Key) {
 	nextResultKeys = keys
 }
 
-func clearNextResult() {
-	mu.Lock()
-	defer mu.Unlock()
-	nextResultData = nil
-	nextResultError = nil
-	nextResultKeys = nil
-}
+// deletedMode is how a query treats soft deleted entities
+type deletedMode int
 
-func hasNextResult() bool {
-	mu.Lock()
-	defer mu.Unlock()
-	return nextResultData != nil || nextResultError != nil || nextResultKeys != nil
-}
+const (
+	deletedExclude deletedMode = iota
+	deletedInclude
+	deletedOnly
+)
+
+// mockScope is which mocks answer a query
+type mockScope int
+
+const (
+	// mockGlobal queries are answered by the mock registry of the context,
+	// and GetAll() also by the result set with SetMockQueryResult()
+	mockGlobal mockScope = iota
+	// mockRegistry queries are only answered by the mock registry
+	mockRegistry
+	// mockNone queries are those aedstorm runs itself, like for preloads
+	// and cascades, which are never mocked
+	mockNone
+)
 
 // Query is a struct which implements a subset of the "datastore.Query" interface and is mockable
 type Query struct {
-	entity string
-	dq     *datastore.Query
+	entity           string
+	typ              reflect.Type
+	ancestor         *datastore.Key
+	filters          []filter
+	keysOnly         bool
+	deleted          deletedMode
+	deletedProperty  string
+	encryptedFilters []filter
+	preloads         []string
+	hooks            bool
+	shards           int
+	concurrency      int
+	pageKey          []byte
+	projection       []string
+	orders           []string
+	distinct         bool
+	distinctOn       []string
+	limit            int
+	limited          bool
+	offset           int
+	start            string
+	end              string
+	eventual         bool
+	mocks            mockScope
+	batchSize        int
+	disjunctions     [][]Condition
+	conditions       []Condition
+	err              error
 }
 
-func (q *Query) Limit(num int) *Query {
-	if q.dq == nil {
-		q.dq = datastore.NewQuery(q.entity)
+// filter is a filter of a query
+type filter struct {
+	filterStr string
+	value     interface{}
+}
+
+// query returns the query as it's run on the driver, with the soft
+// delete and encrypted filters applied. If building the query failed, the
+// error is returned instead.
+func (q *Query) query(ctx context.Context) (*driver.Query, error) {
+	spec, err := q.baseQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	spec.KeysOnly = q.keysOnly
+	if q.limited {
+		spec.Limit = q.limit
+	}
+	spec.Offset = q.offset
+	return spec, nil
+}
+
+// baseQuery returns the query spec without the limit, offset and keys only
+// settings, which are applied by query().
+func (q *Query) baseQuery(ctx context.Context) (*driver.Query, error) {
+	if q.err != nil {
+		return nil, q.err
 	}
-	q.dq = q.dq.Limit(num)
+	spec := &driver.Query{
+		Kind:                q.entity,
+		Ancestor:            q.ancestor,
+		Orders:              q.orders,
+		Projection:          q.projection,
+		Distinct:            q.distinct,
+		DistinctOn:          q.distinctOn,
+		Limit:               -1,
+		Start:               q.start,
+		End:                 q.end,
+		EventualConsistency: q.eventual,
+		BatchSize:           q.batchSize,
+	}
+	for _, f := range q.filters {
+		spec.Filters = append(spec.Filters, driver.Filter{Filter: f.filterStr, Value: f.value})
+	}
+	q.filterDeleted(spec)
+	for _, f := range q.encryptedFilters {
+		enc, err := f.encrypt(ctx, q.entity)
+		if err != nil {
+			return nil, err
+		}
+		spec.Filters = append(spec.Filters, driver.Filter{Filter: f.filterStr, Value: enc})
+	}
+	return spec, nil
+}
+
+// encrypt returns the encrypted value of a filter on a deterministically
+// encrypted field of the given kind
+func (f filter) encrypt(ctx context.Context, kind string) (string, error) {
+	str, ok := f.value.(string)
+	if !ok {
+		return "", fmt.Errorf("Filter %q on an encrypted field must have a string value", f.filterStr)
+	}
+	property := strings.Fields(f.filterStr)[0]
+	return encryptValue(ctx, []byte(str), true, fieldAAD(kind, property))
+}
+
+// Limit returns a derivative query that has a limit on the number of results
+// returned. A negative value means unlimited.
+func (q *Query) Limit(num int) *Query {
+	q.limit, q.limited = num, num >= 0
 	return q
 }
 
-// Filter implements the "datastore.Query".Filter interface
+// Filter implements the "datastore.Query".Filter interface. Values of
+// filters on fields tagged with `aedstorm:"encrypt,deterministic"` are
+// encrypted when the query is run.
 func (q *Query) Filter(filterStr string, value interface{}) *Query {
-	if q.dq == nil {
-		q.dq = datastore.NewQuery(q.entity)
+	q.conditions = append(q.conditions, parseFilter(filterStr, value))
+	if fields := strings.Fields(filterStr); len(fields) > 0 && q.typ != nil && deterministicProperty(q.typ, fields[0]) {
+		q.encryptedFilters = append(q.encryptedFilters, filter{filterStr, value})
+		return q
 	}
-	q.dq = q.dq.Filter(filterStr, value)
+	q.filters = append(q.filters, filter{filterStr, value})
 	return q
 }
 
@@ -67,55 +179,197 @@ func (q *Query) Filter(filterStr string, value interface{}) *Query {
 // applied in the order they are added. The default order is ascending; to sort
 // in descending order prefix the fieldName with a minus sign (-).
 func (q *Query) Order(fieldName string) *Query {
-	if q.dq == nil {
-		q.dq = datastore.NewQuery(q.entity)
-	}
-	q.dq = q.dq.Order(fieldName)
+	q.orders = append(q.orders, fieldName)
 	return q
 }
 
+// KeysOnly returns a derivative query that yields only keys, not keys and
+// entities.
 func (q *Query) KeysOnly() *Query {
-	if q.dq == nil {
-		q.dq = datastore.NewQuery(q.entity)
-	}
-	q.dq = q.dq.KeysOnly()
+	q.keysOnly = true
 	return q
 }
 
 // Count matches the "datastore.Query".Count interface
 func (q *Query) Count(ctx context.Context) (int, error) {
-	if q.dq == nil {
-		q.dq = datastore.NewQuery(q.entity)
+	if res, err := q.mocked(ctx); res != nil || err != nil {
+		if err != nil {
+			return 0, err
+		}
+		return res.countResults()
 	}
-	return q.dq.Count(ctx)
+	if len(q.disjunctions) > 0 {
+		keys, _, err := q.getAllMerged(ctx, true)
+		return len(keys), err
+	}
+	spec, err := q.query(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return getDriver(ctx).Count(ctx, spec)
 }
 
 // GetAll matches the "datastore.Query".GetAll interface
 func (q *Query) GetAll(ctx context.Context, out interface{}) ([]*datastore.Key, error) {
 
-	// For purposes of mocking, this allows a one-time return value to be preset in advance
-	if hasNextResult() {
-		defer clearNextResult()
-		if err := Copy(nextResultData, out); err != nil {
+	// For purposes of mocking, this allows the results to be set in advance
+	if res, err := q.mockedGetAll(ctx); res != nil || err != nil {
+		if err != nil {
 			return nil, err
 		}
-		return nextResultKeys, nextResultError
+		return res.getAll(out)
+	}
+
+	var (
+		keys  []*datastore.Key
+		lists []datastore.PropertyList
+		err   error
+	)
+	if len(q.disjunctions) > 0 {
+		keys, lists, err = q.getAllMerged(ctx, q.keysOnly)
+	} else {
+		var spec *driver.Query
+		if spec, err = q.query(ctx); err == nil {
+			keys, lists, err = runAll(ctx, spec)
+		}
+	}
+	if err != nil || q.keysOnly {
+		return keys, err
+	}
+	if pl, ok := out.(*[]datastore.PropertyList); ok {
+		*pl = append(*pl, lists...)
+		return keys, nil
+	}
+	if !isModelSlice(out) {
+		return nil, fmt.Errorf("Query needs a pointer to a slice of structs or property lists, not %T", out)
 	}
+	return keys, q.loadResults(ctx, keys, lists, out)
+}
 
-	if q.dq == nil {
-		q.dq = datastore.NewQuery(q.entity)
+// preloadSlice loads the relationships set with Preload() for each model in
+// the slice pointed to by out.
+func (q *Query) preloadSlice(ctx context.Context, out interface{}) error {
+	if len(q.preloads) == 0 || out == nil {
+		return nil
+	}
+	sv := reflect.ValueOf(out).Elem()
+	models := make([]reflect.Value, sv.Len())
+	for i := range models {
+		if models[i] = sv.Index(i); models[i].Kind() != reflect.Ptr {
+			models[i] = models[i].Addr()
+		}
 	}
-	return q.dq.GetAll(ctx, out)
+	return preload(ctx, models, q.preloads, q.deleted != deletedExclude)
+}
+
+// isModelSlice returns true if out is a pointer to a slice of structs or
+// struct pointers.
+func isModelSlice(out interface{}) bool {
+	t := reflect.TypeOf(out)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Slice {
+		return false
+	}
+	return structType(t.Elem()).Kind() == reflect.Struct
+}
+
+// loadResults loads the properties of the entities with the given keys and
+// appends them to the slice pointed to by out. Like the datastore does, an
+// *datastore.ErrFieldMismatch doesn't stop the results from being loaded, and
+// is returned at the end.
+func (q *Query) loadResults(ctx context.Context, keys []*datastore.Key, lists []datastore.PropertyList, out interface{}) error {
+	var (
+		writeKeys  []*datastore.Key
+		writeLists []datastore.PropertyList
+		mismatch   error
+	)
+	sv := reflect.ValueOf(out).Elem()
+	for i, props := range lists {
+		m := newSliceElem(sv.Type())
+		props, migrated, err := q.migrate(ctx, m.Interface(), props)
+		if err != nil {
+			return err
+		}
+		if err := loadProperties(m.Interface(), props); err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return err
+			}
+			if mismatch == nil {
+				mismatch = err
+			}
+		}
+		if err := decryptModel(ctx, m.Interface()); err != nil {
+			return err
+		}
+		q.setLoaded(m.Interface())
+		appendSliceElem(sv, m)
+		if migrated {
+			writeKeys, writeLists = append(writeKeys, keys[i]), append(writeLists, props)
+		}
+	}
+	if len(writeKeys) > 0 && migrationWriteBack(q.entity) {
+		if err := putProperties(ctx, writeKeys, writeLists); err != nil {
+			return err
+		}
+	}
+	if err := q.preloadSlice(ctx, out); err != nil {
+		return err
+	}
+	return mismatch
+}
+
+// migrate runs the schema migrations on the properties of a result. Results
+// of projection queries don't hold the schema version, so they're left as is.
+func (q *Query) migrate(ctx context.Context, m Model, props datastore.PropertyList) (datastore.PropertyList, bool, error) {
+	if len(q.projection) > 0 {
+		return props, false, nil
+	}
+	return migrate(ctx, m, props)
+}
+
+// newSliceElem returns a pointer to a new struct for the elements of the
+// slice type t, which can hold either structs or struct pointers.
+func newSliceElem(t reflect.Type) reflect.Value {
+	elemType := t.Elem()
+	if elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	return reflect.New(elemType)
+}
+
+// appendSliceElem appends the struct pointer m to the slice sv, dereferencing
+// it if the slice holds structs.
+func appendSliceElem(sv reflect.Value, m reflect.Value) {
+	if sv.Type().Elem().Kind() != reflect.Ptr {
+		m = m.Elem()
+	}
+	sv.Set(reflect.Append(sv, m))
 }
 
 // NewQuery returns a new query based off the type of m. If m implements the EntityName interface, it uses
-// that for an entity name, otherwise it uses the name of the struct itself
+// that for an entity name, otherwise it uses the name of the struct itself. If m has a soft delete marker,
+// soft deleted entities are left out of the results unless WithDeleted() or OnlyDeleted() is used.
 func NewQuery(m interface{}) *Query {
 	entityKind, err := getEntityName(m)
 	if err != nil {
 		panic(err)
 	}
-	return &Query{entity: entityKind}
+	t := reflect.TypeOf(m)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	q := &Query{entity: entityKind, typ: t, err: checkSoftDeleteField(t)}
+	if idx, ok := softDeleteField(t); ok {
+		q.deletedProperty = propertyName(t, idx)
+	}
+	return q
+}
+
+// Err returns the error of building the query, like that of a condition given
+// to Where() which can never match. Queries with an error aren't run, and
+// return it instead, so Err() is for checking conditions as they're built,
+// like those of user input, before running the query.
+func (q *Query) Err() error {
+	return q.err
 }
 
 // getEntityName returns the name of a struct type based on the EntityName interface value
@@ -0,0 +1,143 @@
+package aedstorm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrNilRef is returned when getting the target of a Ref which has no key
+var ErrNilRef = errors.New("Ref has no key")
+
+var (
+	typeOfRef      = reflect.TypeOf(Ref{})
+	typeOfRefSlice = reflect.TypeOf([]Ref(nil))
+)
+
+// Ref is a reference to another entity which is loaded on demand. Ref and
+// []Ref fields are stored as *datastore.Key properties named after the field,
+// so they can be queried and filtered on like any other key.
+//
+//	type Post struct {
+//		ID     string
+//		Author aedstorm.Ref
+//	}
+//
+//	var author User
+//	err := post.Author.Get(ctx, &author)
+type Ref struct {
+	Key *datastore.Key
+
+	// value is a copy of the loaded target, so it's only loaded once
+	value Model
+}
+
+// NewRef returns a reference to model m
+func NewRef(ctx context.Context, m Model) Ref {
+	return Ref{Key: NewModel(m).WithContext(ctx).Key()}
+}
+
+// IsNil returns true if the reference doesn't point to any entity
+func (r *Ref) IsNil() bool {
+	return r.Key == nil
+}
+
+// Get loads the referenced entity into dst, which must be a pointer to a
+// struct of the referenced kind. The entity is loaded with Load(), so the
+// cache is used, and the result is remembered for subsequent calls.
+func (r *Ref) Get(ctx context.Context, dst Model) error {
+	if r.Key == nil {
+		return ErrNilRef
+	}
+	entityKind, err := getEntityName(dst)
+	if err != nil {
+		return err
+	}
+	if entityKind != r.Key.Kind() {
+		return fmt.Errorf("Ref to %s can't be loaded into %s", r.Key.Kind(), entityKind)
+	}
+
+	dv := reflect.ValueOf(dst)
+	if r.value != nil {
+		rv := reflect.ValueOf(r.value)
+		if rv.Type() != dv.Type() {
+			return fmt.Errorf("Ref was loaded as %s, not %s", rv.Type().Elem().Name(), dv.Type().Elem().Name())
+		}
+		dv.Elem().Set(rv.Elem())
+		return nil
+	}
+
+	if err := newModelWithKey(dst, r.Key).WithContext(ctx).Load(); err != nil {
+		return err
+	}
+	cp := reflect.New(dv.Type().Elem())
+	cp.Elem().Set(dv.Elem())
+	r.value = cp.Interface()
+	return nil
+}
+
+// refProperties returns the names of the properties of struct type t which
+// hold Ref or []Ref fields.
+func refProperties(t reflect.Type) map[string]bool {
+	found := make(map[string]bool)
+	var walk func(st reflect.Type, parent []int)
+	walk = func(st reflect.Type, parent []int) {
+		for i := 0; i < st.NumField(); i++ {
+			field := st.Field(i)
+			index := append(append([]int{}, parent...), i)
+			if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Type != typeOfRef {
+				walk(field.Type, index)
+				continue
+			}
+			if field.PkgPath != "" || field.Tag.Get("datastore") == "-" {
+				continue
+			}
+			if field.Type == typeOfRef || field.Type == typeOfRefSlice {
+				found[propertyName(t, index)] = true
+			}
+		}
+	}
+	walk(t, nil)
+	return found
+}
+
+// saveProperties saves model m as properties, using its own Save() method if
+// it implements the datastore.PropertyLoadSaver interface. Ref fields are
+// stored as key properties named after the field.
+func saveProperties(m Model) (datastore.PropertyList, error) {
+	if pls, ok := m.(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	props, err := datastore.SaveStruct(m)
+	if err != nil {
+		return nil, err
+	}
+	refs := refProperties(reflect.TypeOf(m).Elem())
+	for i, p := range props {
+		if name := strings.TrimSuffix(p.Name, ".Key"); name != p.Name && refs[name] {
+			props[i].Name = name
+		}
+	}
+	return props, nil
+}
+
+// refPropertiesToFields renames the key properties of Ref fields back to the
+// names the datastore package loads them from.
+func refPropertiesToFields(m Model, props datastore.PropertyList) datastore.PropertyList {
+	refs := refProperties(reflect.TypeOf(m).Elem())
+	if len(refs) == 0 {
+		return props
+	}
+	renamed := make(datastore.PropertyList, len(props))
+	for i, p := range props {
+		if refs[p.Name] {
+			p.Name += ".Key"
+		}
+		renamed[i] = p
+	}
+	return renamed
+}
@@ -0,0 +1,104 @@
+package aedstorm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/appengine/datastore"
+)
+
+type testRefBase struct {
+	Owner Ref
+}
+
+type testRefModel struct {
+	testRefBase
+	ID      string
+	Author  Ref
+	Editors []Ref
+	Cached  Ref `datastore:"-"`
+	Name    string
+}
+
+func (m *testRefModel) GetID() string {
+	return m.ID
+}
+
+func TestRefProperties(t *testing.T) {
+	refs := refProperties(reflect.TypeOf(testRefModel{}))
+	assert.Equal(t, map[string]bool{"Owner": true, "Author": true, "Editors": true}, refs)
+	assert.Empty(t, refProperties(reflect.TypeOf(testModel{})))
+}
+
+func TestSaveLoadRefProperties(t *testing.T) {
+	author := datastore.NewKey(ctx, "testAuthor", "author", 0, nil)
+	editor := datastore.NewKey(ctx, "testAuthor", "editor", 0, nil)
+	m := &testRefModel{ID: "ref", Author: Ref{Key: author}, Editors: []Ref{{Key: editor}}, Name: "Test"}
+	m.Owner.Key = author
+
+	props, err := saveProperties(m)
+	assert.NoError(t, err)
+	byName := map[string]interface{}{}
+	for _, p := range props {
+		byName[p.Name] = p.Value
+	}
+	assert.Equal(t, author, byName["Author"])
+	assert.Equal(t, editor, byName["Editors"])
+	assert.Equal(t, author, byName["Owner"])
+	assert.NotContains(t, byName, "Author.Key")
+
+	var loaded testRefModel
+	assert.NoError(t, loadProperties(&loaded, props))
+	assert.True(t, loaded.Author.Key.Equal(author))
+	assert.True(t, loaded.Owner.Key.Equal(author))
+	if assert.Len(t, loaded.Editors, 1) {
+		assert.True(t, loaded.Editors[0].Key.Equal(editor))
+	}
+	assert.Equal(t, "Test", loaded.Name)
+}
+
+func TestRefGetErrors(t *testing.T) {
+	var r Ref
+	assert.True(t, r.IsNil())
+	assert.Equal(t, ErrNilRef, r.Get(ctx, &testAuthor{}))
+
+	r.Key = datastore.NewKey(ctx, "testPost", "post", 0, nil)
+	assert.False(t, r.IsNil())
+	assert.EqualError(t, r.Get(ctx, &testAuthor{}), "Ref to testPost can't be loaded into testAuthor")
+}
+
+func TestRefGetRemembered(t *testing.T) {
+	r := Ref{Key: datastore.NewKey(ctx, "testAuthor", "remembered", 0, nil), value: &testAuthor{ID: "remembered", Name: "Test"}}
+
+	var author testAuthor
+	assert.NoError(t, r.Get(ctx, &author))
+	assert.Equal(t, "Test", author.Name)
+
+	// Changing the result doesn't change the remembered value
+	author.Name = "Changed"
+	var again testAuthor
+	assert.NoError(t, r.Get(ctx, &again))
+	assert.Equal(t, "Test", again.Name)
+}
+
+func TestNewRef(t *testing.T) {
+	r := NewRef(ctx, &testAuthor{ID: "new-ref"})
+	assert.Equal(t, "testAuthor", r.Key.Kind())
+	assert.Equal(t, "new-ref", r.Key.StringID())
+}
+
+func TestRefLoad(t *testing.T) {
+	author := &testAuthor{ID: "ref-load", Name: "Author"}
+	assert.NoError(t, NewModel(author).WithContext(ctx).Save())
+
+	post := &testRefModel{ID: "ref-load-post", Author: NewRef(ctx, author)}
+	assert.NoError(t, NewModel(post).WithContext(ctx).Save())
+
+	loaded := &testRefModel{ID: "ref-load-post"}
+	assert.NoError(t, NewModel(loaded).WithContext(ctx).Load())
+
+	var got testAuthor
+	assert.NoError(t, loaded.Author.Get(ctx, &got))
+	assert.Equal(t, "Author", got.Name)
+}
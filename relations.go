@@ -0,0 +1,422 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Preload sets the relationships which are loaded along with the model by
+// Load(). Relationships are fields tagged with either:
+//
+//	`aedstorm:"belongs_to=AuthorKey"` on a struct or struct pointer field,
+//	which loads the entity whose *datastore.Key or ID is held by the AuthorKey
+//	field.
+//
+//	`aedstorm:"has_many=Post"` on a slice field, which loads the entities
+//	whose Post property holds the key or ID of the model.
+//
+// Relationship fields should also be tagged with `datastore:"-"`, so they're
+// not stored along with the model. Soft deleted entities aren't loaded into
+// relationships, unless WithDeleted() is used.
+func (dm *DataModel) Preload(names ...string) *DataModel {
+	dm.preloads = append(dm.preloads, names...)
+	return dm
+}
+
+// Preload sets the relationships which are loaded for each result of
+// GetAll(). See DataModel.Preload for how relationships are declared.
+func (q *Query) Preload(names ...string) *Query {
+	q.preloads = append(q.preloads, names...)
+	return q
+}
+
+// relationField returns the field of struct type t with the given name, which
+// must be a relationship.
+func relationField(t reflect.Type, name string) (reflect.StructField, tagOptions, error) {
+	field, ok := t.FieldByName(name)
+	if !ok {
+		return field, nil, fmt.Errorf("Type %s has no field %s", t.Name(), name)
+	}
+	opts := parseTagOptions(field)
+	if !opts.Has("belongs_to") && !opts.Has("has_many") {
+		return field, nil, fmt.Errorf("Field %s of type %s is not a relationship", name, t.Name())
+	}
+	return field, opts, nil
+}
+
+// structType returns the struct type of t, which can be a struct, struct
+// pointer, or slice of either.
+func structType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// preload loads the named relationships of models, which must be pointers to
+// structs of the same type. Soft deleted entities are left out unless
+// withDeleted is true.
+func preload(ctx context.Context, models []reflect.Value, names []string, withDeleted bool) error {
+	if len(models) == 0 {
+		return nil
+	}
+	t := models[0].Type().Elem()
+	for _, name := range names {
+		field, opts, err := relationField(t, name)
+		if err != nil {
+			return err
+		}
+		if fk, ok := opts.Value("belongs_to"); ok {
+			err = preloadBelongsTo(ctx, models, field, fk, withDeleted)
+		} else {
+			prop, _ := opts.Value("has_many")
+			err = preloadHasMany(ctx, models, field, prop, withDeleted)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refKey returns the key the value of a reference field points to, which can
+// either be the key itself or an ID of an entity of the given kind.
+func refKey(ctx context.Context, entityKind string, v reflect.Value) *datastore.Key {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if k, ok := v.Interface().(*datastore.Key); ok {
+			return k
+		}
+	case reflect.String:
+		if v.Len() > 0 {
+			return NewKey(ctx, entityKind, v.String(), 0, nil)
+		}
+	case reflect.Int64:
+		if v.Int() != 0 {
+			return NewKey(ctx, entityKind, "", v.Int(), nil)
+		}
+	}
+	return nil
+}
+
+// preloadBelongsTo loads the entities referenced by the fk field of the
+// models with a single batch get. Like with Load(), soft deleted entities are
+// treated as missing unless withDeleted is true.
+func preloadBelongsTo(ctx context.Context, models []reflect.Value, field reflect.StructField, fk string, withDeleted bool) error {
+	t := models[0].Type().Elem()
+	fkField, ok := t.FieldByName(fk)
+	if !ok {
+		return fmt.Errorf("Type %s has no field %s", t.Name(), fk)
+	}
+	target := structType(field.Type)
+	entityKind, err := getEntityName(reflect.New(target).Interface())
+	if err != nil {
+		return err
+	}
+
+	var keys []*datastore.Key
+	seen := make(map[string]bool)
+	refs := make([]*datastore.Key, len(models))
+	for i, m := range models {
+		refs[i] = refKey(ctx, entityKind, m.Elem().FieldByIndex(fkField.Index))
+		if refs[i] != nil && !seen[refs[i].Encode()] {
+			seen[refs[i].Encode()] = true
+			keys = append(keys, refs[i])
+		}
+	}
+
+	loaded, err := getMulti(ctx, keys, target)
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return err
+	}
+	mismatch := err
+	byKey := make(map[string]reflect.Value, len(keys))
+	for i, k := range keys {
+		if loaded[i].IsValid() && !withDeleted && NewModel(loaded[i].Interface()).IsDeleted() {
+			continue
+		}
+		byKey[k.Encode()] = loaded[i]
+	}
+
+	for i, m := range models {
+		dst := m.Elem().FieldByIndex(field.Index)
+		dst.Set(reflect.Zero(dst.Type()))
+		if refs[i] == nil {
+			continue
+		}
+		if v := byKey[refs[i].Encode()]; v.IsValid() {
+			if dst.Kind() != reflect.Ptr {
+				v = v.Elem()
+			}
+			dst.Set(v)
+		}
+	}
+	return mismatch
+}
+
+// hasManyChild returns the struct type of the children of a has-many
+// relationship, and the type of their prop property.
+func hasManyChild(field reflect.StructField, prop string) (reflect.Type, reflect.Type, error) {
+	if field.Type.Kind() != reflect.Slice {
+		return nil, nil, fmt.Errorf("Field %s must be a slice", field.Name)
+	}
+	child := structType(field.Type)
+	var propType reflect.Type
+	for i := 0; i < child.NumField(); i++ {
+		if propertyName(child, []int{i}) == prop {
+			propType = child.Field(i).Type
+		}
+	}
+	if propType == nil {
+		return nil, nil, fmt.Errorf("Type %s has no property %s", child.Name(), prop)
+	}
+	return child, propType, nil
+}
+
+// hasManyValue returns the value of the property of type propType by which
+// the children of model m refer to it, which is either its key or ID. Models
+// without an ID have no children, and return ErrNoID.
+func hasManyValue(ctx context.Context, m reflect.Value, propType reflect.Type) (interface{}, error) {
+	dm := NewModel(m.Interface()).WithContext(ctx)
+	if !dm.hasID() {
+		return nil, ErrNoID
+	}
+	switch propType.Kind() {
+	case reflect.String:
+		return dm.ID(), nil
+	case reflect.Int64:
+		return dm.Key().IntID(), nil
+	}
+	return dm.Key(), nil
+}
+
+// hasManyQuery returns the query for the children of model m in a has-many
+// relationship whose prop property holds the key or ID of m.
+func hasManyQuery(ctx context.Context, m reflect.Value, field reflect.StructField, prop string) (*Query, error) {
+	child, propType, err := hasManyChild(field, prop)
+	if err != nil {
+		return nil, err
+	}
+	value, err := hasManyValue(ctx, m, propType)
+	if err != nil {
+		return nil, err
+	}
+	return NewQuery(reflect.New(child).Interface()).Filter(prop+" =", value).mockedBy(mockNone), nil
+}
+
+// preloadHasMany loads the children of the models whose prop property holds
+// their key or ID. The children of up to MaxSubQueries models are loaded at
+// once, with an in condition on prop, so there's no query for each model.
+// Soft deleted children are left out unless withDeleted is true.
+func preloadHasMany(ctx context.Context, models []reflect.Value, field reflect.StructField, prop string, withDeleted bool) error {
+	child, propType, err := hasManyChild(field, prop)
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(models))
+	for i, m := range models {
+		if values[i], err = hasManyValue(ctx, m, propType); err != nil {
+			return err
+		}
+	}
+
+	var mismatch error
+	children := make(map[string]reflect.Value)
+	for start := 0; start < len(values); start += MaxSubQueries {
+		end := start + MaxSubQueries
+		if end > len(values) {
+			end = len(values)
+		}
+		var batch []interface{}
+		for _, v := range values[start:end] {
+			if id := valueString(normalizeValue(v)); !children[id].IsValid() {
+				children[id] = reflect.MakeSlice(field.Type, 0, 0)
+				batch = append(batch, v)
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		out := reflect.New(field.Type)
+		q := NewQuery(reflect.New(child).Interface()).Where(In(prop, batch...)).mockedBy(mockNone)
+		if withDeleted {
+			q = q.WithDeleted()
+		}
+		_, err := q.GetAll(ctx, out.Interface())
+		if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+			return err
+		} else if ok && mismatch == nil {
+			mismatch = err
+		}
+		for i := 0; i < out.Elem().Len(); i++ {
+			c := out.Elem().Index(i)
+			ptr := c
+			if ptr.Kind() != reflect.Ptr {
+				ptr = ptr.Addr()
+			}
+			props, err := saveProperties(ptr.Interface())
+			if err != nil {
+				return err
+			}
+			for _, p := range props {
+				id := valueString(normalizeValue(p.Value))
+				if p.Name == prop && children[id].IsValid() {
+					children[id] = reflect.Append(children[id], c)
+				}
+			}
+		}
+	}
+
+	for i, m := range models {
+		dst := m.Elem().FieldByIndex(field.Index)
+		dst.Set(reflect.Zero(dst.Type()))
+		if c := children[valueString(normalizeValue(values[i]))]; c.Len() > 0 {
+			dst.Set(c)
+		}
+	}
+	return mismatch
+}
+
+// cacheGetMulti gets the cached entities with the given keys into new
+// structs of type t, with a single call of the cache. Entities which aren't
+// cached, or can't be decoded, are returned as invalid values.
+func cacheGetMulti(ctx context.Context, keys []*datastore.Key, t reflect.Type) []reflect.Value {
+	cacheKeys := make([]string, len(keys))
+	dst := make([]interface{}, len(keys))
+	for i, k := range keys {
+		cacheKeys[i], dst[i] = cacheKeyForKey(k), reflect.New(t).Interface()
+	}
+	err := getCache(ctx).GetMulti(ctx, cacheKeys, dst)
+	merr, _ := err.(appengine.MultiError)
+
+	out := make([]reflect.Value, len(keys))
+	if err != nil && merr == nil {
+		return out
+	}
+	for i := range keys {
+		if merr == nil || merr[i] == nil {
+			out[i] = reflect.ValueOf(dst[i])
+		}
+	}
+	return out
+}
+
+// maxGetMulti is the maximum number of keys of a single GetMulti call of the
+// datastore
+const maxGetMulti = 1000
+
+// getMulti loads the entities with the given keys into new structs of type t,
+// trying the cache first and getting the rest from the datastore in batches of
+// up to maxGetMulti keys.
+// Entities which don't exist are returned as invalid values. Like with
+// GetAll(), an *datastore.ErrFieldMismatch is returned after all entities are
+// loaded.
+func getMulti(ctx context.Context, keys []*datastore.Key, t reflect.Type) ([]reflect.Value, error) {
+	out := make([]reflect.Value, len(keys))
+
+	var (
+		missKeys []*datastore.Key
+		missIdx  []int
+	)
+	cached := cacheGetMulti(ctx, keys, t)
+	for i, k := range keys {
+		m := cached[i]
+		if m.IsValid() {
+			// Entities cached with an older schema version are migrated from the datastore
+			stale, err := isStale(m.Interface())
+			if err != nil {
+				return nil, err
+			}
+			if stale {
+				m = reflect.Value{}
+			}
+		}
+		if !m.IsValid() {
+			missKeys, missIdx = append(missKeys, k), append(missIdx, i)
+			continue
+		}
+		if err := decryptModel(ctx, m.Interface()); err != nil {
+			return nil, err
+		}
+		out[i] = m
+	}
+	if len(missKeys) == 0 {
+		return out, nil
+	}
+
+	loaded, err := loadMulti(ctx, missKeys, t, true)
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return nil, err
+	}
+	for j, m := range loaded {
+		out[missIdx[j]] = m
+	}
+	return out, err
+}
+
+// loadMulti loads the entities with the given keys from the datastore into
+// new structs of type t, in batches of up to maxGetMulti keys. Entities which
+// don't exist are returned as invalid values. If cache is true, the loaded
+// entities are cached, except for those which were only partially loaded
+// because of an *datastore.ErrFieldMismatch, which is returned at the end.
+func loadMulti(ctx context.Context, keys []*datastore.Key, t reflect.Type, cache bool) ([]reflect.Value, error) {
+	lists := make([]datastore.PropertyList, len(keys))
+	errs := make([]error, len(keys))
+	for start := 0; start < len(keys); start += maxGetMulti {
+		end := start + maxGetMulti
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err := getDriver(ctx).GetMulti(ctx, keys[start:end], lists[start:end])
+		merr, _ := err.(appengine.MultiError)
+		if err != nil && merr == nil {
+			return nil, err
+		}
+		if merr != nil {
+			copy(errs[start:end], merr)
+		}
+	}
+
+	out := make([]reflect.Value, len(keys))
+	var mismatch error
+	for j, props := range lists {
+		if errs[j] != nil {
+			if errs[j] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, errs[j]
+		}
+		m := reflect.New(t)
+		props, _, err := migrate(ctx, m.Interface(), props)
+		if err != nil {
+			return nil, err
+		}
+		// Like with GetAll(), missing fields don't stop the entities from
+		// being loaded, but the partially loaded entities aren't cached
+		err = loadProperties(m.Interface(), props)
+		if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+			return nil, err
+		} else if ok && mismatch == nil {
+			mismatch = err
+		}
+		// Encrypted fields are still encrypted at this point, which is how they're cached
+		if cache && err == nil {
+			if err := cacheSet(ctx, cacheKeyForKey(keys[j]), m.Interface()); err != nil {
+				return nil, err
+			}
+		}
+		if err := decryptModel(ctx, m.Interface()); err != nil {
+			return nil, err
+		}
+		out[j] = m
+	}
+	return out, mismatch
+}
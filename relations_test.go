@@ -0,0 +1,181 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type testAuthor struct {
+	ID   string
+	Name string
+}
+
+func (m *testAuthor) GetID() string {
+	return m.ID
+}
+
+type testComment struct {
+	ID   string
+	Post *datastore.Key
+	Text string
+}
+
+type testPost struct {
+	ID        string
+	AuthorID  string
+	Author    *testAuthor    `datastore:"-" aedstorm:"belongs_to=AuthorID"`
+	Comments  []*testComment `datastore:"-" aedstorm:"has_many=Post"`
+	NotARel   string         `datastore:"-"`
+	BadTarget *testAuthor    `datastore:"-" aedstorm:"belongs_to=Missing"`
+}
+
+func (m *testPost) GetID() string {
+	return m.ID
+}
+
+func TestRelationField(t *testing.T) {
+	typ := reflect.TypeOf(testPost{})
+	_, opts, err := relationField(typ, "Author")
+	assert.NoError(t, err)
+	fk, _ := opts.Value("belongs_to")
+	assert.Equal(t, "AuthorID", fk)
+
+	_, _, err = relationField(typ, "Nope")
+	assert.EqualError(t, err, "Type testPost has no field Nope")
+	_, _, err = relationField(typ, "NotARel")
+	assert.EqualError(t, err, "Field NotARel of type testPost is not a relationship")
+}
+
+func TestStructType(t *testing.T) {
+	typ := reflect.TypeOf(testAuthor{})
+	assert.Equal(t, typ, structType(typ))
+	assert.Equal(t, typ, structType(reflect.TypeOf(&testAuthor{})))
+	assert.Equal(t, typ, structType(reflect.TypeOf([]testAuthor{})))
+	assert.Equal(t, typ, structType(reflect.TypeOf([]*testAuthor{})))
+}
+
+func TestRefKey(t *testing.T) {
+	c := context.Background()
+	k := datastore.NewKey(c, "testAuthor", "foo", 0, nil)
+	assert.Equal(t, k, refKey(c, "testAuthor", reflect.ValueOf(k)))
+	assert.True(t, k.Equal(refKey(c, "testAuthor", reflect.ValueOf("foo"))))
+	assert.Equal(t, int64(3), refKey(c, "testAuthor", reflect.ValueOf(int64(3))).IntID())
+	assert.Nil(t, refKey(c, "testAuthor", reflect.ValueOf("")))
+	assert.Nil(t, refKey(c, "testAuthor", reflect.ValueOf((*datastore.Key)(nil))))
+}
+
+func TestPreloadMissingForeignKey(t *testing.T) {
+	err := preload(context.Background(), []reflect.Value{reflect.ValueOf(&testPost{})}, []string{"BadTarget"}, false)
+	assert.EqualError(t, err, "Type testPost has no field Missing")
+}
+
+func TestPreload(t *testing.T) {
+	author := &testAuthor{Name: "Jane"}
+	assert.NoError(t, NewModel(author).WithContext(ctx).Save())
+	post := &testPost{AuthorID: author.ID}
+	postModel := NewModel(post).WithContext(ctx)
+	assert.NoError(t, postModel.Save())
+	for _, text := range []string{"first", "second"} {
+		assert.NoError(t, NewModel(&testComment{Post: postModel.Key(), Text: text}).WithContext(ctx).Save())
+	}
+
+	loaded := &testPost{ID: post.ID}
+	assert.NoError(t, NewModel(loaded).WithContext(ctx).Preload("Author", "Comments").Load())
+	if assert.NotNil(t, loaded.Author) {
+		assert.Equal(t, "Jane", loaded.Author.Name)
+	}
+	assert.Len(t, loaded.Comments, 2)
+}
+
+type testProjectTask struct {
+	ID      string
+	Project string
+	Parent  *testSoftProject `datastore:"-" aedstorm:"belongs_to=Project"`
+}
+
+func TestPreloadBelongsToSoftDeleted(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	project := NewModel(&testSoftProject{ID: "p"}).WithContext(mctx)
+	assert.NoError(t, project.Save())
+	assert.NoError(t, NewModel(&testProjectTask{ID: "t", Project: "p"}).WithContext(mctx).Save())
+	assert.NoError(t, project.Delete())
+
+	task := &testProjectTask{ID: "t"}
+	assert.NoError(t, NewModel(task).WithContext(mctx).Preload("Parent").Load())
+	assert.Nil(t, task.Parent)
+
+	var tasks []*testProjectTask
+	_, err := NewQuery(&testProjectTask{}).Preload("Parent").GetAll(mctx, &tasks)
+	assert.NoError(t, err)
+	if assert.Len(t, tasks, 1) {
+		assert.Nil(t, tasks[0].Parent)
+	}
+
+	task = &testProjectTask{ID: "t"}
+	assert.NoError(t, NewModel(task).WithContext(mctx).WithDeleted().Preload("Parent").Load())
+	if assert.NotNil(t, task.Parent) {
+		assert.True(t, NewModel(task.Parent).IsDeleted())
+	}
+}
+
+func TestPreloadHasManyUnsavedParent(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	post := &testPost{}
+	err := preload(mctx, []reflect.Value{reflect.ValueOf(post)}, []string{"Comments"}, false)
+	assert.Equal(t, ErrNoID, err)
+	assert.Equal(t, "", post.ID)
+}
+
+func TestPreloadHasManyBatches(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	n := MaxSubQueries*2 + 5
+	for i := 0; i < n; i++ {
+		post := &testPost{ID: fmt.Sprintf("p%03d", i)}
+		postModel := NewModel(post).WithContext(mctx)
+		assert.NoError(t, postModel.Save())
+		for j := 0; j < i%3; j++ {
+			c := &testComment{ID: fmt.Sprintf("c%03d-%d", i, j), Post: postModel.Key()}
+			assert.NoError(t, NewModel(c).WithContext(mctx).Save())
+		}
+	}
+
+	var posts []*testPost
+	_, err := NewQuery(&testPost{}).Preload("Comments").GetAll(mctx, &posts)
+	assert.NoError(t, err)
+	assert.Len(t, posts, n)
+	for i, p := range posts {
+		assert.Len(t, p.Comments, i%3, p.ID)
+		for _, c := range p.Comments {
+			assert.Equal(t, p.ID, c.Post.StringID())
+		}
+	}
+}
+
+func TestGetMultiFieldMismatch(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	keys := []*datastore.Key{
+		NewKey(mctx, "testAuthor", "a", 0, nil),
+		NewKey(mctx, "testAuthor", "b", 0, nil),
+	}
+	_, err := getDriver(mctx).PutMulti(mctx, keys, []datastore.PropertyList{
+		{{Name: "ID", Value: "a"}, {Name: "Name", Value: "Ann"}, {Name: "Removed", Value: "x"}},
+		{{Name: "ID", Value: "b"}, {Name: "Name", Value: "Bob"}},
+	})
+	assert.NoError(t, err)
+
+	models, err := getMulti(mctx, keys, reflect.TypeOf(testAuthor{}))
+	assert.IsType(t, &datastore.ErrFieldMismatch{}, err)
+	if assert.Len(t, models, 2) {
+		assert.Equal(t, "Ann", models[0].Interface().(*testAuthor).Name)
+		assert.Equal(t, "Bob", models[1].Interface().(*testAuthor).Name)
+	}
+
+	// The partially loaded entity isn't cached
+	assert.Error(t, cacheGet(mctx, cacheKeyForKey(keys[0]), &testAuthor{}))
+	assert.NoError(t, cacheGet(mctx, cacheKeyForKey(keys[1]), &testAuthor{}))
+}
@@ -0,0 +1,865 @@
+package aedstorm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+	gocache "github.com/bradberger/gocache/cache"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrNotRecorded is returned by replayed operations which aren't in the
+// recording.
+type ErrNotRecorded struct {
+	Operation string
+}
+
+func (e *ErrNotRecorded) Error() string {
+	return fmt.Sprintf("Operation wasn't recorded: %s", e.Operation)
+}
+
+// Recording is the datastore and cache traffic of a test: the keys, entities,
+// queries and results of every operation. It's recorded with Record(), saved
+// to a golden file, and replayed with Replay() without dev_appserver:
+//
+//	if *update {
+//		ctx, rec = aedstorm.Record(ctx)
+//		defer rec.Save("testdata/users.json")
+//	} else {
+//		rec, err := aedstorm.LoadRecording("testdata/users.json")
+//		...
+//		ctx = aedstorm.Replay(context.Background(), rec)
+//		defer rec.Verify(t)
+//	}
+//
+// Replayed operations are matched by their request, so concurrent operations
+// may run in any order, while operations which weren't recorded fail with
+// ErrNotRecorded. Requests have to be the same when replaying, so tests need
+// fixed IDs and a fixed clock, see WithClock().
+type Recording struct {
+	mu         sync.Mutex
+	appID      string
+	ops        []*recordedOp
+	used       []bool
+	unrecorded []string
+}
+
+// recordingFile is the JSON form of a recording
+type recordingFile struct {
+	AppID      string        `json:"appId,omitempty"`
+	Operations []*recordedOp `json:"operations"`
+}
+
+// recordedOp is a single operation of a driver or cache
+type recordedOp struct {
+	Op       string `json:"op"`
+	Request  opData `json:"request"`
+	Response opData `json:"response"`
+}
+
+// opData is the request or response of an operation
+type opData struct {
+	Namespace string           `json:"namespace,omitempty"`
+	Kind      string           `json:"kind,omitempty"`
+	Keys      []*recordedKey   `json:"keys,omitempty"`
+	Entities  []recordedEntity `json:"entities,omitempty"`
+	Query     *recordedQuery   `json:"query,omitempty"`
+	CacheKey  string           `json:"cacheKey,omitempty"`
+	Value     json.RawMessage  `json:"value,omitempty"`
+	ID        int64            `json:"id,omitempty"`
+	Count     int              `json:"count,omitempty"`
+	Cursors   map[int]string   `json:"cursors,omitempty"`
+	Done      bool             `json:"done,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Errors    []string         `json:"errors,omitempty"`
+}
+
+type recordedEntity struct {
+	Key        *recordedKey       `json:"key,omitempty"`
+	Properties []recordedProperty `json:"properties,omitempty"`
+}
+
+type recordedValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type recordedProperty struct {
+	Name string `json:"name"`
+	recordedValue
+	NoIndex  bool `json:"noIndex,omitempty"`
+	Multiple bool `json:"multiple,omitempty"`
+}
+
+type recordedFilter struct {
+	Filter string `json:"filter"`
+	recordedValue
+}
+
+type recordedQuery struct {
+	Kind                string           `json:"kind,omitempty"`
+	Ancestor            *recordedKey     `json:"ancestor,omitempty"`
+	Filters             []recordedFilter `json:"filters,omitempty"`
+	Orders              []string         `json:"orders,omitempty"`
+	Projection          []string         `json:"projection,omitempty"`
+	Distinct            bool             `json:"distinct,omitempty"`
+	DistinctOn          []string         `json:"distinctOn,omitempty"`
+	KeysOnly            bool             `json:"keysOnly,omitempty"`
+	Limit               int              `json:"limit"`
+	Offset              int              `json:"offset,omitempty"`
+	Start               string           `json:"start,omitempty"`
+	End                 string           `json:"end,omitempty"`
+	EventualConsistency bool             `json:"eventualConsistency,omitempty"`
+	BatchSize           int              `json:"batchSize,omitempty"`
+}
+
+// Record returns a context whose datastore and cache operations are run by
+// the driver and cache of ctx, and added to the returned recording.
+func Record(ctx context.Context) (context.Context, *Recording) {
+	r := &Recording{}
+	ctx = withDriver(ctx, &recordingDriver{r, getDriver(ctx)})
+	return WithCache(ctx, &recordingCache{r, getCache(ctx)}), r
+}
+
+// Replay returns a context whose datastore and cache operations are answered
+// from the recording.
+func Replay(ctx context.Context, r *Recording) context.Context {
+	return WithCache(withDriver(ctx, &replayDriver{r}), &replayCache{r})
+}
+
+// LoadRecording reads a recording saved with Save()
+func LoadRecording(filename string) (*Recording, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var f recordingFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	return &Recording{appID: f.AppID, ops: f.Operations, used: make([]bool, len(f.Operations))}, nil
+}
+
+// Save writes the recording to a file as indented JSON, so changes of the
+// traffic are easily reviewed.
+func (r *Recording) Save(filename string) error {
+	r.mu.Lock()
+	b, err := json.MarshalIndent(recordingFile{r.appID, r.ops}, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(b, '\n'), 0644)
+}
+
+// Verify reports the recorded operations which weren't replayed, and the
+// operations which weren't recorded. It returns true if there were none.
+func (r *Recording) Verify(t TestingT) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ok := true
+	for i, op := range r.ops {
+		if i >= len(r.used) || !r.used[i] {
+			t.Errorf("Recorded operation wasn't replayed: %s", op.describe())
+			ok = false
+		}
+	}
+	for _, desc := range r.unrecorded {
+		t.Errorf("Operation wasn't recorded: %s", desc)
+		ok = false
+	}
+	return ok
+}
+
+// record adds an operation to the recording
+func (r *Recording) record(op string, req, res opData) *recordedOp {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, keys := range [][]*recordedKey{req.Keys, res.Keys} {
+		for _, k := range keys {
+			if r.appID == "" {
+				r.appID = k.AppID
+			}
+		}
+	}
+	o := &recordedOp{op, req, res}
+	r.ops = append(r.ops, o)
+	return o
+}
+
+// replay returns the first recorded operation with the same request which
+// wasn't replayed yet.
+func (r *Recording) replay(op string, req opData) (*recordedOp, error) {
+	want, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.used) < len(r.ops) {
+		r.used = append(r.used, false)
+	}
+	for i, o := range r.ops {
+		if r.used[i] || o.Op != op {
+			continue
+		}
+		if got, err := json.Marshal(o.Request); err == nil && string(got) == string(want) {
+			r.used[i] = true
+			return o, nil
+		}
+	}
+	desc := (&recordedOp{Op: op, Request: req}).describe()
+	r.unrecorded = append(r.unrecorded, desc)
+	return nil, &ErrNotRecorded{desc}
+}
+
+// describe returns the operation and its request
+func (o *recordedOp) describe() string {
+	b, _ := json.Marshal(o.Request)
+	return o.Op + " " + string(b)
+}
+
+// recordingDriver runs the operations of its driver and records them
+type recordingDriver struct {
+	r    *Recording
+	next driver.Driver
+}
+
+func (d *recordingDriver) NewKey(ctx context.Context, kind, stringID string, intID int64, parent *datastore.Key) *datastore.Key {
+	k := d.next.NewKey(ctx, kind, stringID, intID, parent)
+	d.r.mu.Lock()
+	if d.r.appID == "" {
+		d.r.appID = k.AppID()
+	}
+	d.r.mu.Unlock()
+	return k
+}
+
+func (d *recordingDriver) AllocateID(ctx context.Context, kind string, parent *datastore.Key) (int64, error) {
+	id, err := d.next.AllocateID(ctx, kind, parent)
+	res := opData{ID: id}
+	setRecordedError(&res, err)
+	d.r.record("allocateId", opData{Namespace: NamespaceFromContext(ctx), Kind: kind, Keys: recordKeys(parent)}, res)
+	return id, err
+}
+
+func (d *recordingDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst []datastore.PropertyList) error {
+	err := d.next.GetMulti(ctx, keys, dst)
+	merr, _ := err.(appengine.MultiError)
+	res := opData{Entities: make([]recordedEntity, len(keys))}
+	if err == nil || merr != nil {
+		for i := range keys {
+			if merr != nil && merr[i] != nil {
+				continue
+			}
+			props, rerr := recordProperties(dst[i])
+			if rerr != nil {
+				return rerr
+			}
+			res.Entities[i].Properties = props
+		}
+	}
+	setRecordedError(&res, err)
+	d.r.record("get", opData{Keys: recordKeys(keys...)}, res)
+	return err
+}
+
+func (d *recordingDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src []datastore.PropertyList) ([]*datastore.Key, error) {
+	req := opData{Keys: recordKeys(keys...), Entities: make([]recordedEntity, len(src))}
+	for i := range src {
+		props, err := recordProperties(src[i])
+		if err != nil {
+			return nil, err
+		}
+		req.Entities[i].Properties = props
+	}
+	out, err := d.next.PutMulti(ctx, keys, src)
+	res := opData{Keys: recordKeys(out...)}
+	setRecordedError(&res, err)
+	d.r.record("put", req, res)
+	return out, err
+}
+
+func (d *recordingDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	err := d.next.DeleteMulti(ctx, keys)
+	var res opData
+	setRecordedError(&res, err)
+	d.r.record("delete", opData{Keys: recordKeys(keys...)}, res)
+	return err
+}
+
+func (d *recordingDriver) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	op := d.r.record("transaction", opData{}, opData{})
+	err := d.next.RunInTransaction(ctx, f, opts)
+	d.r.mu.Lock()
+	setRecordedError(&op.Response, err)
+	d.r.mu.Unlock()
+	return err
+}
+
+func (d *recordingDriver) Run(ctx context.Context, q *driver.Query) driver.Iterator {
+	rq, err := recordQuery(ctx, q)
+	if err != nil {
+		return &replayIterator{err: err}
+	}
+	op := d.r.record("run", opData{Namespace: NamespaceFromContext(ctx), Query: rq}, opData{})
+	return &recordingIterator{d.r, op, d.next.Run(ctx, q)}
+}
+
+func (d *recordingDriver) Count(ctx context.Context, q *driver.Query) (int, error) {
+	rq, err := recordQuery(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	n, err := d.next.Count(ctx, q)
+	res := opData{Count: n}
+	setRecordedError(&res, err)
+	d.r.record("count", opData{Namespace: NamespaceFromContext(ctx), Query: rq}, res)
+	return n, err
+}
+
+// recordingIterator records the results of a query as they're read
+type recordingIterator struct {
+	r  *Recording
+	op *recordedOp
+	it driver.Iterator
+}
+
+func (t *recordingIterator) Next(dst *datastore.PropertyList) (*datastore.Key, error) {
+	var props datastore.PropertyList
+	key, err := t.it.Next(&props)
+	e := recordedEntity{Key: recordKey(key)}
+	if err == nil {
+		if e.Properties, err = recordProperties(props); err != nil {
+			return nil, err
+		}
+		if dst != nil {
+			*dst = props
+		}
+	}
+
+	t.r.mu.Lock()
+	defer t.r.mu.Unlock()
+	switch err {
+	case nil:
+		t.op.Response.Entities = append(t.op.Response.Entities, e)
+	case datastore.Done:
+		t.op.Response.Done = true
+	default:
+		setRecordedError(&t.op.Response, err)
+	}
+	return key, err
+}
+
+func (t *recordingIterator) Cursor() (string, error) {
+	c, err := t.it.Cursor()
+	if err != nil {
+		return c, err
+	}
+	t.r.mu.Lock()
+	defer t.r.mu.Unlock()
+	if t.op.Response.Cursors == nil {
+		t.op.Response.Cursors = make(map[int]string)
+	}
+	t.op.Response.Cursors[len(t.op.Response.Entities)] = c
+	return c, nil
+}
+
+// recordingCache runs the operations of its cache and records them
+type recordingCache struct {
+	r    *Recording
+	next Cache
+}
+
+func (c *recordingCache) Get(ctx context.Context, key string, dst interface{}) error {
+	err := c.next.Get(ctx, key, dst)
+	var res opData
+	if err == nil {
+		b, jerr := json.Marshal(dst)
+		if jerr != nil {
+			return jerr
+		}
+		res.Value = b
+	}
+	setRecordedError(&res, err)
+	c.r.record("cache.get", opData{Namespace: NamespaceFromContext(ctx), CacheKey: key}, res)
+	return err
+}
+
+// GetMulti runs a single GetMulti of its cache, and records it as a get of
+// each key, so recordings don't depend on how the keys are batched.
+func (c *recordingCache) GetMulti(ctx context.Context, keys []string, dst []interface{}) error {
+	err := c.next.GetMulti(ctx, keys, dst)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return err
+	}
+	for i, key := range keys {
+		var (
+			res  opData
+			kerr error
+		)
+		if merr != nil {
+			kerr = merr[i]
+		}
+		if kerr == nil {
+			b, jerr := json.Marshal(dst[i])
+			if jerr != nil {
+				return jerr
+			}
+			res.Value = b
+		}
+		setRecordedError(&res, kerr)
+		c.r.record("cache.get", opData{Namespace: NamespaceFromContext(ctx), CacheKey: key}, res)
+	}
+	return err
+}
+
+func (c *recordingCache) Set(ctx context.Context, key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	err = c.next.Set(ctx, key, value)
+	var res opData
+	setRecordedError(&res, err)
+	c.r.record("cache.set", opData{Namespace: NamespaceFromContext(ctx), CacheKey: key, Value: b}, res)
+	return err
+}
+
+func (c *recordingCache) Del(ctx context.Context, key string) error {
+	err := c.next.Del(ctx, key)
+	var res opData
+	setRecordedError(&res, err)
+	c.r.record("cache.del", opData{Namespace: NamespaceFromContext(ctx), CacheKey: key}, res)
+	return err
+}
+
+// replayDriver answers operations from a recording
+type replayDriver struct {
+	r *Recording
+}
+
+func (d *replayDriver) NewKey(ctx context.Context, kind, stringID string, intID int64, parent *datastore.Key) *datastore.Key {
+	d.r.mu.Lock()
+	appID := d.r.appID
+	d.r.mu.Unlock()
+	return driver.MakeKey(appID, NamespaceFromContext(ctx), kind, stringID, intID, parent)
+}
+
+func (d *replayDriver) AllocateID(ctx context.Context, kind string, parent *datastore.Key) (int64, error) {
+	op, err := d.r.replay("allocateId", opData{Namespace: NamespaceFromContext(ctx), Kind: kind, Keys: recordKeys(parent)})
+	if err != nil {
+		return 0, err
+	}
+	return op.Response.ID, replayedError(op.Response)
+}
+
+func (d *replayDriver) GetMulti(ctx context.Context, keys []*datastore.Key, dst []datastore.PropertyList) error {
+	op, err := d.r.replay("get", opData{Keys: recordKeys(keys...)})
+	if err != nil {
+		return err
+	}
+	for i := range dst {
+		if i >= len(op.Response.Entities) {
+			break
+		}
+		if dst[i], err = replayProperties(op.Response.Entities[i].Properties); err != nil {
+			return err
+		}
+	}
+	return replayedError(op.Response)
+}
+
+func (d *replayDriver) PutMulti(ctx context.Context, keys []*datastore.Key, src []datastore.PropertyList) ([]*datastore.Key, error) {
+	req := opData{Keys: recordKeys(keys...), Entities: make([]recordedEntity, len(src))}
+	for i := range src {
+		props, err := recordProperties(src[i])
+		if err != nil {
+			return nil, err
+		}
+		req.Entities[i].Properties = props
+	}
+	op, err := d.r.replay("put", req)
+	if err != nil {
+		return nil, err
+	}
+	if err := replayedError(op.Response); err != nil {
+		return nil, err
+	}
+	return replayKeys(op.Response.Keys), nil
+}
+
+func (d *replayDriver) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	op, err := d.r.replay("delete", opData{Keys: recordKeys(keys...)})
+	if err != nil {
+		return err
+	}
+	return replayedError(op.Response)
+}
+
+// RunInTransaction runs f with the operations of the transaction replayed
+// like any others. If f succeeds, the recorded result of the transaction is
+// returned.
+func (d *replayDriver) RunInTransaction(ctx context.Context, f func(tc context.Context) error, opts *datastore.TransactionOptions) error {
+	op, err := d.r.replay("transaction", opData{})
+	if err != nil {
+		return err
+	}
+	if err := f(ctx); err != nil {
+		return err
+	}
+	return replayedError(op.Response)
+}
+
+func (d *replayDriver) Run(ctx context.Context, q *driver.Query) driver.Iterator {
+	rq, err := recordQuery(ctx, q)
+	if err != nil {
+		return &replayIterator{err: err}
+	}
+	op, err := d.r.replay("run", opData{Namespace: NamespaceFromContext(ctx), Query: rq})
+	if err != nil {
+		return &replayIterator{err: err}
+	}
+	return &replayIterator{op: op, keysOnly: q.KeysOnly}
+}
+
+func (d *replayDriver) Count(ctx context.Context, q *driver.Query) (int, error) {
+	rq, err := recordQuery(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	op, err := d.r.replay("count", opData{Namespace: NamespaceFromContext(ctx), Query: rq})
+	if err != nil {
+		return 0, err
+	}
+	return op.Response.Count, replayedError(op.Response)
+}
+
+// replayIterator yields the recorded results of a query. Reading past the
+// results which were read when recording fails with ErrNotRecorded.
+type replayIterator struct {
+	op       *recordedOp
+	index    int
+	keysOnly bool
+	err      error
+}
+
+func (t *replayIterator) Next(dst *datastore.PropertyList) (*datastore.Key, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	res := t.op.Response
+	if t.index >= len(res.Entities) {
+		if err := replayedError(res); err != nil {
+			return nil, err
+		}
+		if res.Done {
+			return nil, datastore.Done
+		}
+		return nil, &ErrNotRecorded{fmt.Sprintf("result %d of %s", t.index, t.op.describe())}
+	}
+	e := res.Entities[t.index]
+	t.index++
+	if !t.keysOnly && dst != nil {
+		props, err := replayProperties(e.Properties)
+		if err != nil {
+			return nil, err
+		}
+		*dst = props
+	}
+	return e.Key.key(), nil
+}
+
+func (t *replayIterator) Cursor() (string, error) {
+	if t.err != nil {
+		return "", t.err
+	}
+	c, ok := t.op.Response.Cursors[t.index]
+	if !ok {
+		return "", &ErrNotRecorded{fmt.Sprintf("cursor %d of %s", t.index, t.op.describe())}
+	}
+	return c, nil
+}
+
+// replayCache answers cache operations from a recording
+type replayCache struct {
+	r *Recording
+}
+
+func (c *replayCache) Get(ctx context.Context, key string, dst interface{}) error {
+	op, err := c.r.replay("cache.get", opData{Namespace: NamespaceFromContext(ctx), CacheKey: key})
+	if err != nil {
+		return err
+	}
+	if err := replayedError(op.Response); err != nil {
+		return err
+	}
+	return json.Unmarshal(op.Response.Value, dst)
+}
+
+func (c *replayCache) GetMulti(ctx context.Context, keys []string, dst []interface{}) error {
+	return multiError(len(keys), func(i int) error {
+		return c.Get(ctx, keys[i], dst[i])
+	})
+}
+
+func (c *replayCache) Set(ctx context.Context, key string, value interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	op, err := c.r.replay("cache.set", opData{Namespace: NamespaceFromContext(ctx), CacheKey: key, Value: b})
+	if err != nil {
+		return err
+	}
+	return replayedError(op.Response)
+}
+
+func (c *replayCache) Del(ctx context.Context, key string) error {
+	op, err := c.r.replay("cache.del", opData{Namespace: NamespaceFromContext(ctx), CacheKey: key})
+	if err != nil {
+		return err
+	}
+	return replayedError(op.Response)
+}
+
+// recordedKey is the recorded form of a key
+type recordedKey struct {
+	Kind      string       `json:"kind"`
+	StringID  string       `json:"stringId,omitempty"`
+	IntID     int64        `json:"intId,omitempty"`
+	Parent    *recordedKey `json:"parent,omitempty"`
+	AppID     string       `json:"appId,omitempty"`
+	Namespace string       `json:"namespace,omitempty"`
+}
+
+func recordKey(k *datastore.Key) *recordedKey {
+	if k == nil {
+		return nil
+	}
+	return &recordedKey{k.Kind(), k.StringID(), k.IntID(), recordKey(k.Parent()), k.AppID(), k.Namespace()}
+}
+
+// key returns the recorded key
+func (rk *recordedKey) key() *datastore.Key {
+	if rk == nil {
+		return nil
+	}
+	return driver.MakeKey(rk.AppID, rk.Namespace, rk.Kind, rk.StringID, rk.IntID, rk.Parent.key())
+}
+
+func recordKeys(keys ...*datastore.Key) []*recordedKey {
+	var out []*recordedKey
+	for _, k := range keys {
+		if k != nil {
+			out = append(out, recordKey(k))
+		}
+	}
+	return out
+}
+
+func replayKeys(keys []*recordedKey) []*datastore.Key {
+	out := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		out[i] = k.key()
+	}
+	return out
+}
+
+// recordQuery returns the recorded form of a query
+func recordQuery(ctx context.Context, q *driver.Query) (*recordedQuery, error) {
+	rq := &recordedQuery{
+		Kind:                q.Kind,
+		Ancestor:            recordKey(q.Ancestor),
+		Orders:              q.Orders,
+		Projection:          q.Projection,
+		Distinct:            q.Distinct,
+		DistinctOn:          q.DistinctOn,
+		KeysOnly:            q.KeysOnly,
+		Limit:               q.Limit,
+		Offset:              q.Offset,
+		EventualConsistency: q.EventualConsistency,
+		BatchSize:           q.BatchSize,
+	}
+	for _, f := range q.Filters {
+		v, err := recordValue(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		rq.Filters = append(rq.Filters, recordedFilter{f.Filter, v})
+	}
+	rq.Start, rq.End = q.Start, q.End
+	return rq, nil
+}
+
+// recordProperties returns the recorded form of the properties, sorted by
+// name since their order doesn't matter to the datastore.
+func recordProperties(props datastore.PropertyList) ([]recordedProperty, error) {
+	out := make([]recordedProperty, len(props))
+	for i, p := range props {
+		v, err := recordValue(p.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Property %s: %v", p.Name, err)
+		}
+		out[i] = recordedProperty{p.Name, v, p.NoIndex, p.Multiple}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func replayProperties(props []recordedProperty) (datastore.PropertyList, error) {
+	out := make(datastore.PropertyList, len(props))
+	for i, p := range props {
+		v, err := p.value()
+		if err != nil {
+			return nil, fmt.Errorf("Property %s: %v", p.Name, err)
+		}
+		out[i] = datastore.Property{Name: p.Name, Value: v, NoIndex: p.NoIndex, Multiple: p.Multiple}
+	}
+	return out, nil
+}
+
+// recordValue returns the recorded form of a property or filter value, which
+// is converted to the type the datastore stores it as first.
+func recordValue(v interface{}) (recordedValue, error) {
+	var (
+		typ string
+		n   = normalizeValue(v)
+		val = n
+	)
+	switch n := n.(type) {
+	case nil:
+		return recordedValue{Type: "null"}, nil
+	case int64:
+		typ = "int"
+	case bool:
+		typ = "bool"
+	case string:
+		typ = "string"
+	case float64:
+		typ = "float"
+	case time.Time:
+		typ = "time"
+	case *datastore.Key:
+		typ, val = "key", recordKey(n)
+	case appengine.GeoPoint:
+		typ = "geopoint"
+	case datastore.ByteString:
+		typ, val = "bytestring", []byte(n)
+	case []byte:
+		typ = "bytes"
+	default:
+		return recordedValue{}, fmt.Errorf("Unsupported value type %T", v)
+	}
+	b, err := json.Marshal(val)
+	return recordedValue{typ, b}, err
+}
+
+// value returns the recorded value
+func (rv recordedValue) value() (interface{}, error) {
+	var err error
+	switch rv.Type {
+	case "null":
+		return nil, nil
+	case "int":
+		var v int64
+		err = json.Unmarshal(rv.Value, &v)
+		return v, err
+	case "bool":
+		var v bool
+		err = json.Unmarshal(rv.Value, &v)
+		return v, err
+	case "string":
+		var v string
+		err = json.Unmarshal(rv.Value, &v)
+		return v, err
+	case "float":
+		var v float64
+		err = json.Unmarshal(rv.Value, &v)
+		return v, err
+	case "time":
+		var v time.Time
+		err = json.Unmarshal(rv.Value, &v)
+		return v, err
+	case "key":
+		var v recordedKey
+		if err = json.Unmarshal(rv.Value, &v); err != nil {
+			return nil, err
+		}
+		return v.key(), nil
+	case "geopoint":
+		var v appengine.GeoPoint
+		err = json.Unmarshal(rv.Value, &v)
+		return v, err
+	case "bytestring":
+		var v []byte
+		err = json.Unmarshal(rv.Value, &v)
+		return datastore.ByteString(v), err
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(rv.Value, &v)
+		return v, err
+	}
+	return nil, fmt.Errorf("Unknown value type %q", rv.Type)
+}
+
+// knownErrors are the errors which are replayed as themselves, so they can
+// still be compared with ==.
+var knownErrors = []error{
+	datastore.ErrNoSuchEntity,
+	datastore.ErrInvalidKey,
+	datastore.ErrInvalidEntityType,
+	datastore.ErrConcurrentTransaction,
+	gocache.ErrCacheMiss,
+	context.Canceled,
+	context.DeadlineExceeded,
+	ErrInvalidCursor,
+}
+
+func setRecordedError(res *opData, err error) {
+	if merr, ok := err.(appengine.MultiError); ok {
+		res.Errors = make([]string, len(merr))
+		for i, e := range merr {
+			if e != nil {
+				res.Errors[i] = e.Error()
+			}
+		}
+		return
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+}
+
+func replayedError(res opData) error {
+	if res.Errors != nil {
+		merr := make(appengine.MultiError, len(res.Errors))
+		for i, msg := range res.Errors {
+			merr[i] = replayedErrorMessage(msg)
+		}
+		return merr
+	}
+	return replayedErrorMessage(res.Error)
+}
+
+func replayedErrorMessage(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, err := range knownErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
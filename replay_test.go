@@ -0,0 +1,133 @@
+package aedstorm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gocache "github.com/bradberger/gocache/cache"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type testReplayModel struct {
+	ID      string
+	Name    string
+	Age     int
+	Tags    []string
+	Blob    []byte
+	Short   datastore.ByteString
+	Where   appengine.GeoPoint
+	Born    time.Time
+	Ratio   float64
+	Friend  *datastore.Key
+	Created time.Time `aedstorm:"created"`
+}
+
+// runReplayTraffic saves, loads, queries and deletes models with a fixed
+// clock, so recording and replaying it results in the same requests.
+func runReplayTraffic(t *testing.T, rctx context.Context) {
+	clock := func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC) }
+	friend := NewKey(rctx, "testReplayModel", "b", 0, nil)
+	for _, m := range []*testReplayModel{
+		{ID: "a", Name: "alice", Age: 30, Tags: []string{"admin", "staff"}, Blob: []byte{1, 2}, Short: datastore.ByteString("s"), Where: appengine.GeoPoint{Lat: 1.5, Lng: -2}, Born: clock(), Ratio: 0.1, Friend: friend},
+		{ID: "b", Name: "bob", Age: 25},
+	} {
+		assert.NoError(t, NewModel(m).WithContext(rctx).WithClock(clock).Save())
+	}
+
+	loaded := &testReplayModel{ID: "a"}
+	assert.NoError(t, NewModel(loaded).WithContext(rctx).Load())
+	assert.Equal(t, "alice", loaded.Name)
+	assert.NoError(t, NewModel(loaded).WithContext(rctx).Uncache())
+	uncached := &testReplayModel{ID: "a"}
+	assert.NoError(t, NewModel(uncached).WithContext(rctx).Load())
+	assert.Equal(t, []string{"admin", "staff"}, uncached.Tags)
+	assert.Equal(t, datastore.ByteString("s"), uncached.Short)
+	assert.True(t, uncached.Friend.Equal(friend))
+	assert.Equal(t, 0.1, uncached.Ratio)
+	assert.True(t, clock().Equal(uncached.Born))
+
+	var models []testReplayModel
+	keys, err := NewQuery(&testReplayModel{}).Filter("Age >", 20).Order("-Age").GetAll(rctx, &models)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+	assert.Equal(t, "alice", models[0].Name)
+
+	n, err := NewQuery(&testReplayModel{}).Filter("Friend =", friend).Count(rctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	assert.Equal(t, datastore.ErrNoSuchEntity, NewModel(&testReplayModel{ID: "missing"}).WithContext(rctx).Load())
+	assert.NoError(t, NewModel(&testReplayModel{ID: "b"}).WithContext(rctx).Delete())
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aedstorm")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "traffic.json")
+
+	rctx, rec := Record(NewMemoryContext(context.Background()))
+	runReplayTraffic(t, rctx)
+	assert.NoError(t, rec.Save(filename))
+
+	loaded, err := LoadRecording(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, MemoryAppID, loaded.appID)
+	runReplayTraffic(t, Replay(context.Background(), loaded))
+	assert.True(t, loaded.Verify(t))
+}
+
+func TestReplayNotRecorded(t *testing.T) {
+	rctx, rec := Record(NewMemoryContext(context.Background()))
+	assert.NoError(t, NewModel(&testReplayModel{ID: "a", Name: "alice"}).WithContext(rctx).Save())
+
+	pctx := Replay(context.Background(), rec)
+	err := NewModel(&testReplayModel{ID: "a", Name: "changed"}).WithContext(pctx).Save()
+	assert.IsType(t, &ErrNotRecorded{}, err)
+
+	_, err = NewQuery(&testReplayModel{}).Filter("Name =", "alice").GetAll(pctx, &[]testReplayModel{})
+	assert.IsType(t, &ErrNotRecorded{}, err)
+
+	tr := &testRecorder{}
+	assert.False(t, rec.Verify(tr))
+	assert.Len(t, tr.errors, 4)
+}
+
+func TestReplayErrors(t *testing.T) {
+	rctx, rec := Record(NewMemoryContext(context.Background()))
+	var m testReplayModel
+	assert.Equal(t, gocache.ErrCacheMiss, cacheGet(rctx, "missing", &m))
+	err := getDriver(rctx).GetMulti(rctx, []*datastore.Key{NewKey(rctx, "testReplayModel", "x", 0, nil)}, make([]datastore.PropertyList, 1))
+	assert.Equal(t, appengine.MultiError{datastore.ErrNoSuchEntity}, err)
+
+	pctx := Replay(context.Background(), rec)
+	assert.Equal(t, gocache.ErrCacheMiss, cacheGet(pctx, "missing", &m))
+	err = getDriver(pctx).GetMulti(pctx, []*datastore.Key{NewKey(pctx, "testReplayModel", "x", 0, nil)}, make([]datastore.PropertyList, 1))
+	assert.Equal(t, appengine.MultiError{datastore.ErrNoSuchEntity}, err)
+	assert.True(t, rec.Verify(t))
+}
+
+func TestRecordValue(t *testing.T) {
+	for _, v := range []interface{}{nil, int64(1), true, "s", 1.5, []byte{1}, datastore.ByteString("b"), appengine.GeoPoint{Lat: 1, Lng: 2}} {
+		rv, err := recordValue(v)
+		assert.NoError(t, err)
+		got, err := rv.value()
+		assert.NoError(t, err)
+		assert.Equal(t, v, got)
+	}
+
+	rv, err := recordValue(42)
+	assert.NoError(t, err)
+	assert.Equal(t, "int", rv.Type)
+
+	_, err = recordValue(struct{}{})
+	assert.Error(t, err)
+	_, err = recordedValue{Type: "unknown"}.value()
+	assert.Error(t, err)
+}
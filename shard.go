@@ -0,0 +1,333 @@
+package aedstorm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// DefaultConcurrency is the number of shards Scan() runs at once, unless the
+// query sets it with Concurrency()
+const DefaultConcurrency = 8
+
+// scatterOversampling is the number of keys sampled for each shard. The
+// more keys are sampled, the more even the shards are.
+const scatterOversampling = 32
+
+var (
+	// ErrShardQuery is returned by Scan() for sharded queries which can't be
+	// split by key range: queries with orders, inequality filters on other
+	// properties than __key__, cursors, limits, offsets or Or() conditions.
+	// Inequality filters on __key__ are intersected with the key ranges of
+	// the shards.
+	ErrShardQuery = errors.New("Sharded queries can only have equality filters, inequality filters on __key__ and no orders, cursors, limits, offsets or conditions")
+)
+
+// ShardError is the error which stopped one of the shards of Scan()
+type ShardError struct {
+	Shard      int
+	Start, End *datastore.Key
+	Err        error
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("Shard %d failed: %v", e.Shard, e.Err)
+}
+
+// ErrShardsFailed is returned by Scan() when some of the shards failed
+type ErrShardsFailed struct {
+	Shards int
+	Failed []*ShardError
+}
+
+func (e *ErrShardsFailed) Error() string {
+	return fmt.Sprintf("%d of %d shards failed, the first with: %v", len(e.Failed), e.Shards, e.Failed[0].Err)
+}
+
+// Shard makes Scan() split the key space of the query into n ranges, which
+// are scanned concurrently.
+func (q *Query) Shard(n int) *Query {
+	q.shards = n
+	return q
+}
+
+// Concurrency sets the maximum number of shards Scan() runs at once. The
+// default is DefaultConcurrency.
+func (q *Query) Concurrency(n int) *Query {
+	q.concurrency = n
+	return q
+}
+
+// Scan runs the query and calls fn with the key and model of each result.
+// Models are pointers to new structs of the query's model type, loaded like
+// with GetAll(), and nil for keys only queries.
+//
+// If Shard() is used, the key space is split into ranges at keys sampled
+// with a __scatter__ query, and the ranges are scanned concurrently, so fn
+// has to be safe for concurrent use. Each shard stops at the first error of
+// fn or the datastore, while the others go on; the errors are returned in an
+// *ErrShardsFailed. Sharded queries can't have orders or inequality filters
+// other than on __key__, since they filter on __key__ themselves.
+func (q *Query) Scan(ctx context.Context, fn func(key *datastore.Key, m Model) error) error {
+	if q.err != nil {
+		return q.err
+	}
+	if q.typ == nil {
+		return ErrModelInvalid
+	}
+	if res, err := q.mocked(ctx); res != nil || err != nil {
+		if err != nil {
+			return err
+		}
+		return q.scanMocked(res, fn)
+	}
+	if q.shards <= 1 {
+		return q.scan(ctx, fn)
+	}
+	if err := q.verifyShardable(); err != nil {
+		return err
+	}
+
+	splits, err := q.splitKeys(ctx)
+	if err != nil {
+		return err
+	}
+	concurrency := q.concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	var (
+		wg   sync.WaitGroup
+		sem  = make(chan struct{}, concurrency)
+		errs = make([]*ShardError, len(splits)+1)
+	)
+	for i := 0; i <= len(splits); i++ {
+		var start, end *datastore.Key
+		if i > 0 {
+			start = splits[i-1]
+		}
+		if i < len(splits) {
+			end = splits[i]
+		}
+		wg.Add(1)
+		go func(i int, start, end *datastore.Key) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := ctx.Err(); err != nil {
+				errs[i] = &ShardError{i, start, end, err}
+				return
+			}
+			if err := q.keyRange(start, end).scan(ctx, fn); err != nil {
+				errs[i] = &ShardError{i, start, end, err}
+			}
+		}(i, start, end)
+	}
+	wg.Wait()
+
+	var failed []*ShardError
+	for _, e := range errs {
+		if e != nil {
+			failed = append(failed, e)
+		}
+	}
+	if len(failed) > 0 {
+		return &ErrShardsFailed{Shards: len(errs), Failed: failed}
+	}
+	return nil
+}
+
+// verifyShardable returns ErrShardQuery if the query can't be split into key
+// ranges.
+func (q *Query) verifyShardable() error {
+	if len(q.orders) > 0 || len(q.disjunctions) > 0 || q.limited || q.offset > 0 || q.start != "" || q.end != "" || q.deleted == deletedOnly {
+		return ErrShardQuery
+	}
+	for _, f := range q.filters {
+		if name, op, err := driver.SplitFilter(f.filterStr); err != nil {
+			return err
+		} else if op != "=" && name != "__key__" {
+			return ErrShardQuery
+		}
+	}
+	return nil
+}
+
+// inKeyRange returns the keys which match the __key__ filters of the query
+func (q *Query) inKeyRange(keys []*datastore.Key) []*datastore.Key {
+	var out []*datastore.Key
+	for _, k := range keys {
+		matched := true
+		for _, f := range q.filters {
+			name, op, err := driver.SplitFilter(f.filterStr)
+			if v, ok := f.value.(*datastore.Key); err == nil && ok && name == "__key__" && !compareOp(compareKeys(k, v), op) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// splitKeys samples keys of the query's kind with a __scatter__ query, and
+// returns the sorted keys at which the key space is split. There are fewer
+// than n-1 of them if there aren't enough entities.
+func (q *Query) splitKeys(ctx context.Context) ([]*datastore.Key, error) {
+	sample, _, err := runAll(ctx, &driver.Query{
+		Kind:     q.entity,
+		Ancestor: q.ancestor,
+		Orders:   []string{"__scatter__"},
+		KeysOnly: true,
+		Limit:    q.shards * scatterOversampling,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys outside of the __key__ filters of the query would only split off
+	// empty shards. They can't be filtered by the sampling query itself, since
+	// it's sorted by __scatter__.
+	sample = q.inKeyRange(sample)
+	sort.Slice(sample, func(i, j int) bool {
+		return compareKeys(sample[i], sample[j]) < 0
+	})
+
+	n := q.shards
+	if len(sample) < n {
+		n = len(sample) + 1
+	}
+	var splits []*datastore.Key
+	for i := 1; i < n; i++ {
+		k := sample[i*len(sample)/n]
+		if len(splits) == 0 || !splits[len(splits)-1].Equal(k) {
+			splits = append(splits, k)
+		}
+	}
+	return splits, nil
+}
+
+// keyRange returns a copy of the query limited to keys from start, up to but
+// not including end. A nil key leaves the range open on that side.
+func (q *Query) keyRange(start, end *datastore.Key) *Query {
+	rq := *q
+	rq.filters = append([]filter(nil), q.filters...)
+	rq.conditions = append([]Condition(nil), q.conditions...)
+	if start != nil {
+		rq.Filter("__key__ >=", start)
+	}
+	if end != nil {
+		rq.Filter("__key__ <", end)
+	}
+	return &rq
+}
+
+// scan runs the query and calls fn with each result. The results are loaded
+// in batches, so they're migrated, decrypted and preloaded like with
+// GetAll(). An *datastore.ErrFieldMismatch doesn't stop the scan, and is
+// returned at the end.
+func (q *Query) scan(ctx context.Context, fn func(key *datastore.Key, m Model) error) error {
+	spec, err := q.query(ctx)
+	if err != nil {
+		return err
+	}
+	batchSize := q.batchSize
+	if batchSize <= 0 || batchSize > MaxBatchSize {
+		batchSize = MaxBatchSize
+	}
+
+	var (
+		keys     []*datastore.Key
+		lists    []datastore.PropertyList
+		mismatch error
+	)
+	it := getDriver(ctx).Run(ctx, spec)
+	for {
+		var props datastore.PropertyList
+		key, err := it.Next(&props)
+		if err != nil && err != datastore.Done {
+			return err
+		}
+		if err == nil {
+			keys, lists = append(keys, key), append(lists, props)
+		}
+		if len(keys) == batchSize || (err == datastore.Done && len(keys) > 0) {
+			if err := q.scanBatch(ctx, keys, lists, fn); err != nil {
+				if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+					return err
+				}
+				if mismatch == nil {
+					mismatch = err
+				}
+			}
+			keys, lists = nil, nil
+		}
+		if err == datastore.Done {
+			return mismatch
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// scanBatch loads a batch of results and calls fn with each of them. Like
+// with GetAll(), an *datastore.ErrFieldMismatch is returned after all results
+// are handled.
+func (q *Query) scanBatch(ctx context.Context, keys []*datastore.Key, lists []datastore.PropertyList, fn func(key *datastore.Key, m Model) error) error {
+	if q.keysOnly {
+		for _, k := range keys {
+			if err := fn(k, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	out := reflect.New(reflect.SliceOf(reflect.PtrTo(q.typ)))
+	err := q.loadResults(ctx, keys, lists, out.Interface())
+	if _, ok := err.(*datastore.ErrFieldMismatch); err != nil && !ok {
+		return err
+	}
+	if err := scanSlice(keys, out.Elem(), fn); err != nil {
+		return err
+	}
+	return err
+}
+
+// scanMocked calls fn with each of the mocked results
+func (q *Query) scanMocked(res *mockResult, fn func(key *datastore.Key, m Model) error) error {
+	out := reflect.New(reflect.SliceOf(q.typ))
+	keys, err := res.getAll(out.Interface())
+	if err != nil {
+		return err
+	}
+	return scanSlice(keys, out.Elem(), fn)
+}
+
+// scanSlice calls fn with a pointer to each model of the slice sv, which
+// holds structs or struct pointers, and its key if there is one.
+func scanSlice(keys []*datastore.Key, sv reflect.Value, fn func(key *datastore.Key, m Model) error) error {
+	for i := 0; i < sv.Len(); i++ {
+		var key *datastore.Key
+		if i < len(keys) {
+			key = keys[i]
+		}
+		m := sv.Index(i)
+		if m.Kind() != reflect.Ptr {
+			m = m.Addr()
+		}
+		if err := fn(key, m.Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
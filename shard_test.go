@@ -0,0 +1,217 @@
+package aedstorm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func newTestShardContext(t *testing.T, n int) context.Context {
+	mctx := NewMemoryContext(context.Background())
+	for i := 0; i < n; i++ {
+		m := &testMemoryModel{ID: fmt.Sprintf("m%04d", i), Age: i % 3}
+		assert.NoError(t, NewModel(m).WithContext(mctx).Save())
+	}
+	return mctx
+}
+
+func TestScanSharded(t *testing.T) {
+	mctx := newTestShardContext(t, 1000)
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[string]int)
+	)
+	err := NewQuery(&testMemoryModel{}).Filter("Age =", 1).Shard(8).Scan(mctx, func(key *datastore.Key, m Model) error {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, key.StringID(), m.(*testMemoryModel).ID)
+		assert.Equal(t, 1, m.(*testMemoryModel).Age)
+		seen[key.StringID()]++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, seen, 333)
+	for id, n := range seen {
+		assert.Equal(t, 1, n, id)
+	}
+}
+
+func TestScanConcurrency(t *testing.T) {
+	mctx := newTestShardContext(t, 200)
+
+	var running, max, count int32
+	err := NewQuery(&testMemoryModel{}).KeysOnly().Shard(10).Concurrency(2).Scan(mctx, func(key *datastore.Key, m Model) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			old := atomic.LoadInt32(&max)
+			if n <= old || atomic.CompareAndSwapInt32(&max, old, n) {
+				break
+			}
+		}
+		assert.Nil(t, m)
+		atomic.AddInt32(&count, 1)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(200), count)
+	assert.True(t, max <= 2)
+}
+
+func TestScanShardErrors(t *testing.T) {
+	mctx := newTestShardContext(t, 100)
+
+	errStop := errors.New("stop")
+	var count int32
+	err := NewQuery(&testMemoryModel{}).Shard(4).Scan(mctx, func(key *datastore.Key, m Model) error {
+		atomic.AddInt32(&count, 1)
+		if key.StringID() == "m0000" {
+			return errStop
+		}
+		return nil
+	})
+	assert.IsType(t, &ErrShardsFailed{}, err)
+	failed := err.(*ErrShardsFailed)
+	assert.Equal(t, 4, failed.Shards)
+	assert.Len(t, failed.Failed, 1)
+	assert.Equal(t, 0, failed.Failed[0].Shard)
+	assert.Nil(t, failed.Failed[0].Start)
+	assert.Equal(t, errStop, failed.Failed[0].Err)
+
+	// The other shards aren't stopped by the failed one
+	assert.True(t, count > 1)
+	assert.True(t, count < 100)
+}
+
+func TestScanFewEntities(t *testing.T) {
+	for _, n := range []int{0, 1, 3} {
+		mctx := newTestShardContext(t, n)
+		var ids []string
+		var mu sync.Mutex
+		err := NewQuery(&testMemoryModel{}).Shard(8).Scan(mctx, func(key *datastore.Key, m Model) error {
+			mu.Lock()
+			defer mu.Unlock()
+			ids = append(ids, key.StringID())
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Len(t, ids, n)
+	}
+}
+
+func TestScanUnsharded(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+
+	var ids []string
+	err := NewQuery(&testMemoryModel{}).Filter("Age <", 35).Order("-Age").Scan(mctx, func(key *datastore.Key, m Model) error {
+		ids = append(ids, m.(*testMemoryModel).ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "d"}, ids)
+}
+
+func TestScanNotShardable(t *testing.T) {
+	mctx := newTestMemoryContext(t)
+	fn := func(key *datastore.Key, m Model) error { return nil }
+
+	for _, q := range []*Query{
+		NewQuery(&testMemoryModel{}).Order("Age"),
+		NewQuery(&testMemoryModel{}).Filter("Age >", 30),
+		NewQuery(&testMemoryModel{}).Limit(10),
+		NewQuery(&testMemoryModel{}).Offset(1),
+	} {
+		assert.Equal(t, ErrShardQuery, q.Shard(2).Scan(mctx, fn))
+	}
+}
+
+func TestScanInvalidCondition(t *testing.T) {
+	mctx := newTestShardContext(t, 50)
+	called := false
+	fn := func(key *datastore.Key, m Model) error {
+		called = true
+		return nil
+	}
+
+	for _, shards := range []int{0, 4} {
+		q := NewQuery(&testMemoryModel{}).Where(Eq("Missing", 1)).Shard(shards)
+		err := q.Scan(mctx, fn)
+		assert.EqualError(t, err, "Type testMemoryModel has no property Missing")
+		assert.Equal(t, q.Err(), err)
+	}
+	assert.False(t, called)
+}
+
+func TestScanShardedKeyRange(t *testing.T) {
+	mctx := newTestShardContext(t, 200)
+
+	var (
+		mu  sync.Mutex
+		ids []string
+	)
+	start, end := NewKey(mctx, "testMemoryModel", "m0050", 0, nil), NewKey(mctx, "testMemoryModel", "m0150", 0, nil)
+	q := NewQuery(&testMemoryModel{}).Filter("__key__ >", start).Filter("__key__ <=", end).KeysOnly()
+	err := q.Shard(4).Scan(mctx, func(key *datastore.Key, m Model) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, key.StringID())
+		return nil
+	})
+	assert.NoError(t, err)
+	sort.Strings(ids)
+	if assert.Len(t, ids, 100) {
+		assert.Equal(t, "m0051", ids[0])
+		assert.Equal(t, "m0150", ids[99])
+	}
+
+	// The shards are split within the range
+	splits, err := q.splitKeys(mctx)
+	assert.NoError(t, err)
+	for _, k := range splits {
+		assert.True(t, compareKeys(k, start) > 0 && compareKeys(k, end) <= 0, k.StringID())
+	}
+}
+
+func TestSplitKeys(t *testing.T) {
+	mctx := newTestShardContext(t, 100)
+
+	splits, err := NewQuery(&testMemoryModel{}).Shard(4).splitKeys(mctx)
+	assert.NoError(t, err)
+	assert.Len(t, splits, 3)
+	assert.True(t, sort.SliceIsSorted(splits, func(i, j int) bool {
+		return compareKeys(splits[i], splits[j]) < 0
+	}))
+
+	// Each range has some of the entities
+	bounds := append([]*datastore.Key{nil}, append(splits, nil)...)
+	total := 0
+	for i := 0; i < len(bounds)-1; i++ {
+		n, err := NewQuery(&testMemoryModel{}).keyRange(bounds[i], bounds[i+1]).Count(mctx)
+		assert.NoError(t, err)
+		assert.True(t, n > 0)
+		total += n
+	}
+	assert.Equal(t, 100, total)
+}
+
+func TestScanMocked(t *testing.T) {
+	m := NewMock()
+	m.Expect(&testMemoryModel{}).Return([]testMemoryModel{{ID: "a"}, {ID: "b"}}, nil, nil)
+	mctx := WithMock(context.Background(), m)
+
+	var ids []string
+	err := NewQuery(&testMemoryModel{}).Shard(4).Scan(mctx, func(key *datastore.Key, m Model) error {
+		ids = append(ids, m.(*testMemoryModel).ID)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, ids)
+}
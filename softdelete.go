@@ -0,0 +1,126 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/bradberger/go-aedstorm/internal/driver"
+)
+
+// SoftDeleteFieldName is the name of the field which marks a model as soft
+// deleted. A time.Time field can also be marked with the `aedstorm:"deleted"`
+// tag instead.
+const SoftDeleteFieldName = "DeletedAt"
+
+// softDeleteField returns the index of the soft delete marker of struct type
+// t, if it has one. Tagged fields which aren't a time.Time are ignored, and
+// reported by checkSoftDeleteField.
+func softDeleteField(t reflect.Type) ([]int, bool) {
+	if found := fieldsWithOption(t, "deleted"); len(found) > 0 {
+		if t.FieldByIndex(found[0]).Type != typeOfTime {
+			return nil, false
+		}
+		return found[0], true
+	}
+	if field, ok := t.FieldByName(SoftDeleteFieldName); ok && field.Type == typeOfTime {
+		return field.Index, true
+	}
+	return nil, false
+}
+
+// checkSoftDeleteField returns an error if a field of struct type t is
+// tagged with `aedstorm:"deleted"` but isn't a time.Time.
+func checkSoftDeleteField(t reflect.Type) error {
+	for _, idx := range fieldsWithOption(t, "deleted") {
+		if field := t.FieldByIndex(idx); field.Type != typeOfTime {
+			return fmt.Errorf("Field %s of type %s must be a time.Time", field.Name, t.Name())
+		}
+	}
+	return nil
+}
+
+// softDeleteValue returns the soft delete marker of the model, if it has one.
+func (dm *DataModel) softDeleteValue() (reflect.Value, bool) {
+	v := reflect.ValueOf(dm.model).Elem()
+	idx, ok := softDeleteField(v.Type())
+	if !ok {
+		return reflect.Value{}, false
+	}
+	return v.FieldByIndex(idx), true
+}
+
+// IsSoftDeletable returns true if the model has a soft delete marker, in which
+// case Delete() only marks it as deleted.
+func (dm *DataModel) IsSoftDeletable() bool {
+	_, ok := dm.softDeleteValue()
+	return ok
+}
+
+// IsDeleted returns true if the model has been soft deleted.
+func (dm *DataModel) IsDeleted() bool {
+	field, ok := dm.softDeleteValue()
+	return ok && !field.Interface().(time.Time).IsZero()
+}
+
+// WithDeleted makes Load() return soft deleted entities instead of treating
+// them as not found.
+func (dm *DataModel) WithDeleted() *DataModel {
+	dm.withDeleted = true
+	return dm
+}
+
+// Restore clears the soft delete marker and saves the model.
+func (dm *DataModel) Restore() error {
+	if err := dm.verify(); err != nil {
+		return err
+	}
+	field, ok := dm.softDeleteValue()
+	if !ok {
+		return ErrNotSoftDeletable
+	}
+	field.Set(reflect.ValueOf(time.Time{}))
+	return dm.Save()
+}
+
+// softDelete sets the soft delete marker and saves the model.
+func (dm *DataModel) softDelete(field reflect.Value) error {
+	if err := dm.verify(); err != nil {
+		return err
+	}
+	field.Set(reflect.ValueOf(dm.now()))
+	if err := dm.Save(); err != nil {
+		return err
+	}
+	if obj, ok := dm.model.(OnDelete); ok && !dm.noHooks {
+		return obj.Delete()
+	}
+	return nil
+}
+
+// WithDeleted includes soft deleted entities in the query results.
+func (q *Query) WithDeleted() *Query {
+	q.deleted = deletedInclude
+	return q
+}
+
+// OnlyDeleted limits the query results to soft deleted entities. Since it
+// uses an inequality filter on the soft delete marker, any sort orders must
+// start with that property.
+func (q *Query) OnlyDeleted() *Query {
+	q.deleted = deletedOnly
+	return q
+}
+
+// filterDeleted adds the soft delete filter of the query to spec.
+func (q *Query) filterDeleted(spec *driver.Query) {
+	if q.deletedProperty == "" {
+		return
+	}
+	switch q.deleted {
+	case deletedExclude:
+		spec.Filters = append(spec.Filters, driver.Filter{Filter: q.deletedProperty + " =", Value: time.Time{}})
+	case deletedOnly:
+		spec.Filters = append(spec.Filters, driver.Filter{Filter: q.deletedProperty + " >", Value: time.Time{}})
+	}
+}
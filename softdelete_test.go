@@ -0,0 +1,93 @@
+package aedstorm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type testSoftDeleteModel struct {
+	ID        string
+	DeletedAt time.Time
+}
+
+func (m *testSoftDeleteModel) GetID() string {
+	return m.ID
+}
+
+type testSoftDeleteTagModel struct {
+	ID      string
+	Removed time.Time `datastore:"removed" aedstorm:"deleted"`
+}
+
+func TestSoftDeleteField(t *testing.T) {
+	idx, ok := softDeleteField(reflect.TypeOf(testSoftDeleteModel{}))
+	assert.True(t, ok)
+	assert.Equal(t, []int{1}, idx)
+
+	idx, ok = softDeleteField(reflect.TypeOf(testSoftDeleteTagModel{}))
+	assert.True(t, ok)
+	assert.Equal(t, []int{1}, idx)
+
+	_, ok = softDeleteField(reflect.TypeOf(testModel{}))
+	assert.False(t, ok)
+}
+
+type testSoftDeleteStringModel struct {
+	ID      string
+	Removed string `aedstorm:"deleted"`
+}
+
+func TestSoftDeleteFieldType(t *testing.T) {
+	_, ok := softDeleteField(reflect.TypeOf(testSoftDeleteStringModel{}))
+	assert.False(t, ok)
+	assert.Error(t, checkSoftDeleteField(reflect.TypeOf(testSoftDeleteStringModel{})))
+
+	mctx := NewMemoryContext(context.Background())
+	m := &testSoftDeleteStringModel{ID: "a"}
+	assert.Error(t, NewModel(m).WithContext(mctx).Save())
+	assert.Error(t, NewModel(m).WithContext(mctx).Load())
+	assert.Error(t, NewModel(m).WithContext(mctx).Delete())
+	assert.Error(t, NewModel(m).WithContext(mctx).Restore())
+	assert.False(t, NewModel(m).IsDeleted())
+
+	_, err := NewQuery(&testSoftDeleteStringModel{}).GetAll(mctx, &[]testSoftDeleteStringModel{})
+	assert.Error(t, err)
+}
+
+func TestQueryDeletedProperty(t *testing.T) {
+	assert.Equal(t, "DeletedAt", NewQuery(&testSoftDeleteModel{}).deletedProperty)
+	assert.Equal(t, "removed", NewQuery(&testSoftDeleteTagModel{}).deletedProperty)
+	assert.Equal(t, "", NewQuery(&testModel{}).deletedProperty)
+}
+
+func TestRestoreNotSoftDeletable(t *testing.T) {
+	dm := NewModel(&testModel{}).WithContext(ctx)
+	assert.False(t, dm.IsSoftDeletable())
+	assert.Equal(t, ErrNotSoftDeletable, dm.Restore())
+}
+
+func TestSoftDelete(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	tm := &testSoftDeleteModel{}
+	dm := NewModel(tm).WithContext(ctx).WithClock(fixedClock(now))
+	assert.True(t, dm.IsSoftDeletable())
+	assert.NoError(t, dm.Save())
+	assert.NoError(t, dm.Delete())
+	assert.Equal(t, now, tm.DeletedAt)
+	assert.True(t, dm.IsDeleted())
+
+	assert.Equal(t, datastore.ErrNoSuchEntity, NewModel(&testSoftDeleteModel{ID: tm.ID}).WithContext(ctx).Load())
+	assert.NoError(t, NewModel(&testSoftDeleteModel{ID: tm.ID}).WithContext(ctx).WithDeleted().Load())
+
+	assert.NoError(t, dm.Restore())
+	assert.False(t, dm.IsDeleted())
+	assert.NoError(t, NewModel(&testSoftDeleteModel{ID: tm.ID}).WithContext(ctx).Load())
+
+	assert.NoError(t, dm.HardDelete())
+	assert.Equal(t, datastore.ErrNoSuchEntity, NewModel(&testSoftDeleteModel{ID: tm.ID}).WithContext(ctx).WithDeleted().Load())
+}
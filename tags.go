@@ -0,0 +1,104 @@
+package aedstorm
+
+import (
+	"reflect"
+	"strings"
+)
+
+const (
+	// OptionTagName is the tag name where we look for aedstorm field options. Options are comma
+	// separated, and never change the name a field is stored under in the datastore, which is
+	// still set with the datastore tag. Available options are:
+	//
+	//	id             the field holds the ID of the entity
+	//	created        set to the current time when the entity is first saved
+	//	updated        set to the current time each time the entity is saved
+	//	deleted        the soft delete marker
+	//	version        holds the schema version of the stored entity
+	//	default=value  the value of the field if it's zero
+	//	encrypt        encrypt the value before it's stored or cached
+	//	deterministic  use deterministic encryption, so equality filters work
+	//	unique         no two entities of the kind can have the same value
+	//	               (at most about a dozen per model, see ErrTooManyEntityGroups)
+	//	belongs_to=F   the entity referred to by field F, see DataModel.Preload
+	//	has_many=P     the entities whose property P refers to this one
+	//	cascade=rule   what Delete() does with has_many children: delete, nullify or restrict
+	OptionTagName = "aedstorm"
+)
+
+// tagOptions holds the comma separated options of a field's aedstorm tag.
+type tagOptions []string
+
+// parseTagOptions reads the aedstorm tag of the given field.
+func parseTagOptions(field reflect.StructField) tagOptions {
+	tag := field.Tag.Get(OptionTagName)
+	if tag == "" {
+		return nil
+	}
+	opts := strings.Split(tag, ",")
+	for i := range opts {
+		opts[i] = strings.TrimSpace(opts[i])
+	}
+	return tagOptions(opts)
+}
+
+// Has returns true if the option is present, either by itself or in the "name=value" form.
+func (o tagOptions) Has(name string) bool {
+	_, ok := o.Value(name)
+	return ok
+}
+
+// Value returns the value of a "name=value" option. Options without a value
+// return an empty string.
+func (o tagOptions) Value(name string) (string, bool) {
+	for _, opt := range o {
+		if opt == name {
+			return "", true
+		}
+		if strings.HasPrefix(opt, name+"=") {
+			return opt[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// fieldsWithOption returns the index of each field of struct type t which has
+// the given aedstorm option. Fields of embedded structs are included.
+func fieldsWithOption(t reflect.Type, name string) [][]int {
+	var found [][]int
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for _, sub := range fieldsWithOption(field.Type, name) {
+				found = append(found, append([]int{i}, sub...))
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if parseTagOptions(field).Has(name) {
+			found = append(found, field.Index)
+		}
+	}
+	return found
+}
+
+// propertyName returns the datastore property name of the struct field at
+// index, taking the datastore tag names of the field and of any structs it's
+// embedded in into account.
+func propertyName(t reflect.Type, index []int) string {
+	var names []string
+	for _, i := range index {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("datastore"), ",")[0]
+		if name == "" && !field.Anonymous {
+			name = field.Name
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+		t = field.Type
+	}
+	return strings.Join(names, ".")
+}
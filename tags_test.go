@@ -0,0 +1,42 @@
+package aedstorm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tagOptionsBase struct {
+	Created string `aedstorm:"created"`
+}
+
+type tagOptionsModel struct {
+	tagOptionsBase
+	ID      string
+	Value   string `aedstorm:"updated, default=foo"`
+	private string `aedstorm:"updated"`
+}
+
+func TestParseTagOptions(t *testing.T) {
+	field, _ := reflect.TypeOf(tagOptionsModel{}).FieldByName("Value")
+	opts := parseTagOptions(field)
+	assert.True(t, opts.Has("updated"))
+	assert.True(t, opts.Has("default"))
+	assert.False(t, opts.Has("created"))
+	v, ok := opts.Value("default")
+	assert.True(t, ok)
+	assert.Equal(t, "foo", v)
+}
+
+func TestParseTagOptionsEmpty(t *testing.T) {
+	field, _ := reflect.TypeOf(tagOptionsModel{}).FieldByName("ID")
+	assert.Nil(t, parseTagOptions(field))
+}
+
+func TestFieldsWithOption(t *testing.T) {
+	typ := reflect.TypeOf(tagOptionsModel{})
+	assert.Equal(t, [][]int{{0, 0}}, fieldsWithOption(typ, "created"))
+	assert.Equal(t, [][]int{{2}}, fieldsWithOption(typ, "updated"))
+	assert.Empty(t, fieldsWithOption(typ, "unique"))
+}
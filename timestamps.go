@@ -0,0 +1,76 @@
+package aedstorm
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var typeOfTime = reflect.TypeOf(time.Time{})
+
+type clockContextKey struct{}
+
+// Clock returns the current time. It's used to fill in automatic timestamps,
+// and can be swapped out with WithClock to keep tests deterministic.
+type Clock func() time.Time
+
+// WithClock returns a context whose operations use clock c, unless a model
+// sets its own with DataModel.WithClock().
+func WithClock(ctx context.Context, c Clock) context.Context {
+	return context.WithValue(ctx, clockContextKey{}, c)
+}
+
+// contextNow returns the current time of the clock of the context, truncated
+// to microseconds like the times stored in the datastore.
+func contextNow(ctx context.Context) time.Time {
+	if c, ok := ctx.Value(clockContextKey{}).(Clock); ok && c != nil {
+		return c().Truncate(time.Microsecond)
+	}
+	return time.Now().Truncate(time.Microsecond)
+}
+
+// WithClock sets the clock used for automatic timestamps in future operations
+func (dm *DataModel) WithClock(c Clock) *DataModel {
+	dm.clock = c
+	return dm
+}
+
+// now returns the current time of the model's clock, or that of its context.
+// The datastore only stores microseconds, so the time is truncated to make
+// sure the cached model matches the stored one.
+func (dm *DataModel) now() time.Time {
+	if dm.clock != nil {
+		return dm.clock().Truncate(time.Microsecond)
+	}
+	if dm.Context() != nil {
+		return contextNow(dm.Context())
+	}
+	return time.Now().Truncate(time.Microsecond)
+}
+
+// setTimestamps fills in the fields tagged with `aedstorm:"created"` and
+// `aedstorm:"updated"`. The created field is only set if it's zero, the
+// updated one is set on every call.
+func (dm *DataModel) setTimestamps() error {
+	v := reflect.ValueOf(dm.model).Elem()
+	now := reflect.ValueOf(dm.now())
+	for _, idx := range fieldsWithOption(v.Type(), "created") {
+		field := v.FieldByIndex(idx)
+		if field.Type() != typeOfTime {
+			return fmt.Errorf("Field %s of type %s must be a time.Time", v.Type().FieldByIndex(idx).Name, v.Type().Name())
+		}
+		if field.Interface().(time.Time).IsZero() {
+			field.Set(now)
+		}
+	}
+	for _, idx := range fieldsWithOption(v.Type(), "updated") {
+		field := v.FieldByIndex(idx)
+		if field.Type() != typeOfTime {
+			return fmt.Errorf("Field %s of type %s must be a time.Time", v.Type().FieldByIndex(idx).Name, v.Type().Name())
+		}
+		field.Set(now)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package aedstorm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type testModelWithTimestamps struct {
+	ID        string
+	CreatedAt time.Time `aedstorm:"created"`
+	UpdatedAt time.Time `aedstorm:"updated"`
+}
+
+type testModelWithBadTimestamp struct {
+	ID        string
+	CreatedAt string `aedstorm:"created"`
+}
+
+func fixedClock(t time.Time) Clock {
+	return func() time.Time {
+		return t
+	}
+}
+
+func TestSetTimestamps(t *testing.T) {
+	first := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	tm := &testModelWithTimestamps{}
+	dm := NewModel(tm).WithClock(fixedClock(first))
+	assert.NoError(t, dm.setTimestamps())
+	assert.Equal(t, first, tm.CreatedAt)
+	assert.Equal(t, first, tm.UpdatedAt)
+
+	second := first.Add(time.Hour)
+	dm.WithClock(fixedClock(second))
+	assert.NoError(t, dm.setTimestamps())
+	assert.Equal(t, first, tm.CreatedAt)
+	assert.Equal(t, second, tm.UpdatedAt)
+}
+
+func TestSetTimestampsContextClock(t *testing.T) {
+	contextTime := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := WithClock(context.Background(), fixedClock(contextTime.Add(999)))
+
+	// Without a clock of its own, the model uses that of its context
+	tm := &testModelWithTimestamps{}
+	assert.NoError(t, NewModel(tm).WithContext(c).setTimestamps())
+	assert.Equal(t, contextTime, tm.CreatedAt)
+	assert.Equal(t, contextTime, tm.UpdatedAt)
+
+	// The model's own clock takes priority over it
+	modelTime := contextTime.Add(time.Hour)
+	tm = &testModelWithTimestamps{}
+	assert.NoError(t, NewModel(tm).WithContext(c).WithClock(fixedClock(modelTime)).setTimestamps())
+	assert.Equal(t, modelTime, tm.CreatedAt)
+	assert.Equal(t, modelTime, tm.UpdatedAt)
+}
+
+func TestContextNow(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 1001, time.UTC)
+	assert.Equal(t, now.Add(-1), contextNow(WithClock(context.Background(), fixedClock(now))))
+
+	before := time.Now().Truncate(time.Microsecond)
+	got := contextNow(context.Background())
+	assert.False(t, got.Before(before))
+	assert.Equal(t, got, got.Truncate(time.Microsecond))
+}
+
+func TestSetTimestampsTruncates(t *testing.T) {
+	tm := &testModelWithTimestamps{}
+	dm := NewModel(tm).WithClock(fixedClock(time.Unix(0, 1001)))
+	assert.NoError(t, dm.setTimestamps())
+	assert.Equal(t, time.Unix(0, 1000), tm.CreatedAt)
+}
+
+func TestSetTimestampsInvalidField(t *testing.T) {
+	dm := NewModel(&testModelWithBadTimestamp{})
+	assert.EqualError(t, dm.setTimestamps(), "Field CreatedAt of type testModelWithBadTimestamp must be a time.Time")
+}
+
+func TestSaveSetsTimestamps(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	tm := &testModelWithTimestamps{}
+	dm := NewModel(tm).WithContext(ctx).WithClock(fixedClock(now))
+	assert.NoError(t, dm.Save())
+	assert.Equal(t, now, tm.CreatedAt)
+	assert.Equal(t, now, tm.UpdatedAt)
+}
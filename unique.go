@@ -0,0 +1,261 @@
+package aedstorm
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// UniqueKind is the entity kind of the markers which enforce fields tagged
+// with `aedstorm:"unique"`. Each marker is keyed by "<Kind>/<property>/<value>"
+// and points at the entity which owns the value. Markers are written in the
+// same cross-group transaction as the entity, which limits the number of
+// unique fields a model can have, see ErrTooManyEntityGroups.
+const UniqueKind = "_unique"
+
+// maxKeyNameLength is the maximum length of the name of a datastore key
+const maxKeyNameLength = 1500
+
+// uniqueMarker is the entity stored for each unique value
+type uniqueMarker struct {
+	Owner *datastore.Key
+}
+
+// ErrUniqueViolation is returned by Save() when the value of a unique field is
+// already used by another entity of the same kind.
+type ErrUniqueViolation struct {
+	Kind  string
+	Field string
+	Value interface{}
+	Owner *datastore.Key
+}
+
+func (e *ErrUniqueViolation) Error() string {
+	return fmt.Sprintf("Value %v of field %s is already used by %s entity %s", e.Value, e.Field, e.Kind, e.Owner)
+}
+
+// ErrTooManyEntityGroups is returned when writing or deleting a model with
+// unique fields would touch more entity groups than a cross-group transaction
+// allows. Each marker is an entity group of its own, and changing a value
+// touches the markers of both the old and the new value, so models can only
+// have about a dozen unique fields.
+type ErrTooManyEntityGroups struct {
+	Kind   string
+	Groups int
+}
+
+func (e *ErrTooManyEntityGroups) Error() string {
+	return fmt.Sprintf("Writing %s entity with its unique markers touches %d entity groups, but a transaction can only touch %d", e.Kind, e.Groups, maxTransactionGroups)
+}
+
+// checkEntityGroups returns an *ErrTooManyEntityGroups if the keys are in
+// more entity groups than a cross-group transaction allows. Nil keys are
+// skipped.
+func checkEntityGroups(entityKind string, keys ...*datastore.Key) error {
+	groups := make(map[string]bool)
+	for _, k := range keys {
+		if k == nil {
+			continue
+		}
+		for k.Parent() != nil {
+			k = k.Parent()
+		}
+		groups[k.Encode()] = true
+	}
+	if len(groups) > maxTransactionGroups {
+		return &ErrTooManyEntityGroups{Kind: entityKind, Groups: len(groups)}
+	}
+	return nil
+}
+
+// uniqueMarkerKey returns the key of the marker for the value of a unique
+// property. Values of encrypted fields are replaced by an HMAC keyed with the
+// current encryption key, so they can't be recovered from the key, and values
+// which would make the key name too long by their SHA-256 hash. Like with
+// deterministic encryption, the markers of encrypted values only match while
+// the current key doesn't change. Zero values aren't enforced and return a
+// nil key.
+func uniqueMarkerKey(ctx context.Context, entityKind, property string, value interface{}, encrypted bool) (*datastore.Key, error) {
+	if value == nil || isZero(reflect.ValueOf(value)) {
+		return nil, nil
+	}
+	prefix := entityKind + "/" + property + "/"
+	str := fmt.Sprintf("%v", value)
+	if encrypted {
+		kp, err := getKeyProvider()
+		if err != nil {
+			return nil, err
+		}
+		_, key, err := kp.CurrentKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, deriveKey(key, "unique"))
+		mac.Write([]byte(prefix + str))
+		str = fmt.Sprintf("%x", mac.Sum(nil))
+	} else if len(prefix)+len(str) > maxKeyNameLength {
+		str = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(str)))
+	}
+	return NewKey(ctx, UniqueKind, prefix+str, 0, nil), nil
+}
+
+// releaseMarker deletes the unique marker with the given key if it's owned by
+// the entity with key owner.
+func releaseMarker(ctx context.Context, markerKey, owner *datastore.Key) error {
+	var marker uniqueMarker
+	if err := driverGet(ctx, markerKey, &marker); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !owner.Equal(marker.Owner) {
+		return nil
+	}
+	return driverDelete(ctx, markerKey)
+}
+
+// storedMarkerKeys returns the marker keys of the unique fields for the
+// values stored in props, in the same order as the fields.
+func (dm *DataModel) storedMarkerKeys(ctx context.Context, fields [][]int, props datastore.PropertyList) ([]*datastore.Key, error) {
+	t := reflect.TypeOf(dm.model).Elem()
+	keys := make([]*datastore.Key, len(fields))
+	for i, idx := range fields {
+		name := propertyName(t, idx)
+		encrypted := parseTagOptions(t.FieldByIndex(idx)).Has("encrypt")
+		for _, p := range props {
+			if p.Name != name {
+				continue
+			}
+			value := p.Value
+			if str, ok := value.(string); ok && encrypted {
+				dec, err := decryptValue(ctx, str, fieldAAD(dm.getEntityName(), name))
+				if err != nil {
+					return nil, err
+				}
+				value = string(dec)
+			}
+			key, err := uniqueMarkerKey(ctx, dm.getEntityName(), name, value, encrypted)
+			if err != nil {
+				return nil, err
+			}
+			keys[i] = key
+		}
+	}
+	return keys, nil
+}
+
+// write puts the model into the datastore. If it has unique fields, the
+// markers for them are created and those of old values deleted in the same
+// transaction. Soft deleted entities release their markers, so the values can
+// be used by other entities until they're restored.
+func (dm *DataModel) write() error {
+	fields := fieldsWithOption(reflect.TypeOf(dm.model).Elem(), "unique")
+	if len(fields) == 0 {
+		return dm.put(dm.Context())
+	}
+
+	return runInTransaction(dm.Context(), func(tc context.Context) error {
+		return dm.writeUnique(tc, fields)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// writeUnique puts the model and claims the markers of its unique fields in
+// the transaction tc, which has to be a cross-group one.
+func (dm *DataModel) writeUnique(tc context.Context, fields [][]int) error {
+	key := dm.Key()
+	v := reflect.ValueOf(dm.model).Elem()
+	deleted := dm.IsDeleted()
+
+	var stored datastore.PropertyList
+	if err := driverGet(tc, key, &stored); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	oldKeys, err := dm.storedMarkerKeys(tc, fields, stored)
+	if err != nil {
+		return err
+	}
+	markerKeys := make([]*datastore.Key, len(fields))
+	if !deleted {
+		for i, idx := range fields {
+			field := v.Type().FieldByIndex(idx)
+			value := v.FieldByIndex(idx).Interface()
+			if markerKeys[i], err = uniqueMarkerKey(tc, dm.getEntityName(), propertyName(v.Type(), idx), value, parseTagOptions(field).Has("encrypt")); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The transaction fails with an opaque error once it touches too many
+	// entity groups, so they're counted before any marker is touched
+	if err := checkEntityGroups(dm.getEntityName(), append(append([]*datastore.Key{key}, markerKeys...), oldKeys...)...); err != nil {
+		return err
+	}
+
+	for i, idx := range fields {
+		field := v.Type().FieldByIndex(idx)
+		value := v.FieldByIndex(idx).Interface()
+		markerKey := markerKeys[i]
+		if markerKey != nil {
+			var marker uniqueMarker
+			err := driverGet(tc, markerKey, &marker)
+			switch {
+			case err == datastore.ErrNoSuchEntity:
+				if _, err := driverPut(tc, markerKey, &uniqueMarker{Owner: key}); err != nil {
+					return err
+				}
+			case err != nil:
+				return err
+			case !key.Equal(marker.Owner):
+				return &ErrUniqueViolation{Kind: dm.getEntityName(), Field: field.Name, Value: value, Owner: marker.Owner}
+			}
+		}
+
+		// The old value's marker can belong to another entity by now,
+		// if this one was soft deleted
+		if oldKeys[i] != nil && !oldKeys[i].Equal(markerKey) {
+			if err := releaseMarker(tc, oldKeys[i], key); err != nil {
+				return err
+			}
+		}
+	}
+	return dm.put(tc)
+}
+
+// remove deletes the model from the datastore, along with the markers of its
+// unique fields.
+func (dm *DataModel) remove() error {
+	fields := fieldsWithOption(reflect.TypeOf(dm.model).Elem(), "unique")
+	if len(fields) == 0 {
+		return driverDelete(dm.Context(), dm.Key())
+	}
+
+	key := dm.Key()
+	return runInTransaction(dm.Context(), func(tc context.Context) error {
+		var stored datastore.PropertyList
+		if err := driverGet(tc, key, &stored); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		markerKeys, err := dm.storedMarkerKeys(tc, fields, stored)
+		if err != nil {
+			return err
+		}
+		if err := checkEntityGroups(dm.getEntityName(), append([]*datastore.Key{key}, markerKeys...)...); err != nil {
+			return err
+		}
+		for _, markerKey := range markerKeys {
+			if markerKey == nil {
+				continue
+			}
+			if err := releaseMarker(tc, markerKey, key); err != nil {
+				return err
+			}
+		}
+		return driverDelete(tc, key)
+	}, &datastore.TransactionOptions{XG: true})
+}
@@ -0,0 +1,164 @@
+package aedstorm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type testUniqueModel struct {
+	ID    string
+	Email string `aedstorm:"unique"`
+	Name  string
+}
+
+func (m *testUniqueModel) GetID() string {
+	return m.ID
+}
+
+func TestUniqueMarkerKey(t *testing.T) {
+	defer withTestKeys()()
+	c := context.Background()
+	k, err := uniqueMarkerKey(c, "User", "Email", "foo@example.com", false)
+	assert.NoError(t, err)
+	assert.Equal(t, UniqueKind, k.Kind())
+	assert.Equal(t, "User/Email/foo@example.com", k.StringID())
+
+	k, err = uniqueMarkerKey(c, "User", "Email", "foo@example.com", true)
+	assert.NoError(t, err)
+	assert.NotContains(t, k.StringID(), "foo@example.com")
+	assert.Len(t, k.StringID(), len("User/Email/")+64)
+	assert.NotContains(t, k.StringID(), fmt.Sprintf("%x", sha256.Sum256([]byte("foo@example.com"))))
+
+	long := strings.Repeat("x", maxKeyNameLength)
+	k, err = uniqueMarkerKey(c, "User", "Bio", long, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "User/Bio/sha256:"+fmt.Sprintf("%x", sha256.Sum256([]byte(long))), k.StringID())
+
+	for _, v := range []interface{}{"", int64(0), nil} {
+		k, err = uniqueMarkerKey(c, "User", "Email", v, false)
+		assert.NoError(t, err)
+		assert.Nil(t, k)
+	}
+}
+
+func TestUniqueMarkerKeyNoKeyProvider(t *testing.T) {
+	old := keyProvider
+	defer SetKeyProvider(old)
+	SetKeyProvider(nil)
+	_, err := uniqueMarkerKey(context.Background(), "User", "Email", "foo@example.com", true)
+	assert.Equal(t, ErrNoKeyProvider, err)
+}
+
+func TestStoredMarkerKeys(t *testing.T) {
+	c := context.Background()
+	dm := NewModel(&testUniqueModel{})
+	fields := [][]int{{1}}
+	keys, err := dm.storedMarkerKeys(c, fields, datastore.PropertyList{{Name: "Email", Value: "foo@example.com"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "testUniqueModel/Email/foo@example.com", keys[0].StringID())
+
+	keys, err = dm.storedMarkerKeys(c, fields, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, keys[0])
+}
+
+func TestErrUniqueViolation(t *testing.T) {
+	err := &ErrUniqueViolation{Kind: "User", Field: "Email", Value: "foo@example.com", Owner: datastore.NewKey(context.Background(), "User", "1", 0, nil)}
+	assert.Contains(t, err.Error(), "Value foo@example.com of field Email is already used by User entity")
+}
+
+func TestSaveUnique(t *testing.T) {
+	first := &testUniqueModel{Email: "unique@example.com"}
+	assert.NoError(t, NewModel(first).WithContext(ctx).Save())
+	// Saving again with the same value is fine
+	assert.NoError(t, NewModel(first).WithContext(ctx).Save())
+
+	second := &testUniqueModel{Email: "unique@example.com"}
+	err := NewModel(second).WithContext(ctx).Save()
+	if assert.IsType(t, &ErrUniqueViolation{}, err) {
+		assert.Equal(t, "Email", err.(*ErrUniqueViolation).Field)
+	}
+
+	// Changing the value frees the old one
+	first.Email = "changed@example.com"
+	assert.NoError(t, NewModel(first).WithContext(ctx).Save())
+	assert.NoError(t, NewModel(second).WithContext(ctx).Save())
+
+	// Deleting frees the value too
+	assert.NoError(t, NewModel(first).WithContext(ctx).HardDelete())
+	third := &testUniqueModel{Email: "changed@example.com"}
+	assert.NoError(t, NewModel(third).WithContext(ctx).Save())
+}
+
+type testUniqueSoftDeleteModel struct {
+	ID        string
+	Email     string `aedstorm:"unique"`
+	DeletedAt time.Time
+}
+
+func TestSoftDeleteReleasesUnique(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	first := &testUniqueSoftDeleteModel{ID: "first", Email: "foo@example.com"}
+	assert.NoError(t, NewModel(first).WithContext(mctx).Save())
+	assert.NoError(t, NewModel(first).WithContext(mctx).Delete())
+
+	// The value is free once the owner is soft deleted
+	second := &testUniqueSoftDeleteModel{ID: "second", Email: "foo@example.com"}
+	assert.NoError(t, NewModel(second).WithContext(mctx).Save())
+
+	// So restoring the first one fails
+	err := NewModel(first).WithContext(mctx).Restore()
+	assert.IsType(t, &ErrUniqueViolation{}, err)
+
+	// Hard deleting the first one leaves the marker of the second one alone
+	assert.NoError(t, NewModel(&testUniqueSoftDeleteModel{ID: "first"}).WithContext(mctx).WithDeleted().HardDelete())
+	third := &testUniqueSoftDeleteModel{ID: "third", Email: "foo@example.com"}
+	assert.IsType(t, &ErrUniqueViolation{}, NewModel(third).WithContext(mctx).Save())
+}
+
+type testManyUniqueModel struct {
+	ID                                    string
+	A, B, C, D, E, F, G, H, I, J, K, L, M string `aedstorm:"unique"`
+}
+
+func (m *testManyUniqueModel) set(prefix string) {
+	v := reflect.ValueOf(m).Elem()
+	for i := 1; i < v.NumField(); i++ {
+		v.Field(i).SetString(fmt.Sprintf("%s%d", prefix, i))
+	}
+}
+
+func TestUniqueTooManyEntityGroups(t *testing.T) {
+	mctx := NewMemoryContext(context.Background())
+	m := &testManyUniqueModel{ID: "a"}
+	m.set("old")
+	assert.NoError(t, NewModel(m).WithContext(mctx).Save())
+
+	// Changing every value touches the entity and 26 markers
+	m.set("new")
+	err := NewModel(m).WithContext(mctx).Save()
+	assert.Equal(t, &ErrTooManyEntityGroups{Kind: "testManyUniqueModel", Groups: 27}, err)
+	assert.EqualError(t, err, "Writing testManyUniqueModel entity with its unique markers touches 27 entity groups, but a transaction can only touch 25")
+
+	// Changing a few values at a time works
+	m.set("old")
+	m.A, m.B = "new1", "new2"
+	assert.NoError(t, NewModel(m).WithContext(mctx).Save())
+
+	res, err := NewQuery(&testManyUniqueModel{}).UpdateAll(mctx, func(m Model) error {
+		m.(*testManyUniqueModel).set("other")
+		return nil
+	})
+	assert.IsType(t, &ErrPartialFailure{}, err)
+	if assert.Len(t, res.Failed, 1) {
+		assert.IsType(t, &ErrTooManyEntityGroups{}, res.Failed[0].Err)
+	}
+}